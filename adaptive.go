@@ -0,0 +1,150 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * adaptive.go provides a limiter which finds the rate a downstream service will put up with by itself, for vendors
+ * who change the rate they allow without telling anyone. Callers report how each call went and the refill rate of the
+ * bucket climbs steadily while calls succeed and is cut sharply on errors, timeouts and 429s, like TCP congestion
+ * control.
+ *
+ * The rate is kept by the storage provider so that every node sharing the bucket follows the same one, see
+ * storage.AIMD.
+ */
+
+type (
+	Adaptive struct {
+		storage storage.AdaptiveStorage
+		bucket *Bucket
+		aimd storage.AIMD
+
+		// see AdaptiveOptions.MaxLatency
+		maxLatency time.Duration
+	}
+
+	AdaptiveOptions struct {
+		// The rate stays within MinRate and MaxRate tokens every Interval of the bucket, MinRate defaults to 1.
+		MinRate int
+		MaxRate int
+
+		// Optional, every success raises the rate by Increase and every failure multiplies it by Decrease, at most once
+		// every Cooldown. The defaults are 1, 0.5 and the Interval of the bucket.
+		Increase int
+		Decrease float64
+		Cooldown time.Duration
+
+		// Optional, a success which took longer then MaxLatency is reported as a failure.
+		MaxLatency time.Duration
+	}
+)
+
+// initialize options with defaults
+func (opts *AdaptiveOptions) init(bucket *Bucket) (*AdaptiveOptions, error) {
+	if opts.MinRate <= 0 {
+		opts.MinRate = 1
+	}
+
+	if opts.Increase <= 0 {
+		opts.Increase = 1
+	}
+
+	if opts.Decrease == 0 {
+		opts.Decrease = 0.5
+	}
+
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = bucket.interval
+	}
+
+	if opts.Decrease < 0 || opts.Decrease >= 1 {
+		return nil, errors.New("Decrease must be between 0 and 1.")
+	}
+
+	if bucket.rate < opts.MinRate || bucket.rate > opts.MaxRate {
+		return nil, errors.New("The rate of the bucket must be within MinRate and MaxRate.")
+	}
+
+	return opts, nil
+}
+
+// Adapt the refill rate of a bucket to feedback from downstream, starting out at the rate it was created with. Take
+// from the Adaptive rather then the bucket so that the rate it is at is used. The storage provider must implement
+// storage.AdaptiveStorage.
+func NewAdaptive(bucket *Bucket, options *AdaptiveOptions) (*Adaptive, error) {
+	if bucket.rate <= 0 {
+		return nil, errors.New("Only buckets with a rate can adapt.")
+	}
+
+	store, ok := bucket.storage.(storage.AdaptiveStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Adaptive limiters need a storage.AdaptiveStorage.", storage.ErrNotSupported)
+	}
+
+	options, err := options.init(bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	aimd := storage.AIMD{
+		Initial: bucket.rate,
+		Min: options.MinRate,
+		Max: options.MaxRate,
+		Increase: options.Increase,
+		Decrease: options.Decrease,
+		Cooldown: options.Cooldown,
+	}
+
+	return &Adaptive{storage: store, bucket: bucket, aimd: aimd, maxLatency: options.MaxLatency}, nil
+}
+
+// Take tokens at the current rate, see bucket.TakeN.
+func (limiter *Adaptive) TakeN(tokens int) (storage.Decision, error) {
+	return limiter.TakeNContext(context.Background(), tokens)
+}
+
+func (limiter *Adaptive) TakeNContext(ctx context.Context, tokens int) (storage.Decision, error) {
+	return limiter.storage.TakeAdaptive(ctx, limiter.bucket.Name, tokens, limiter.bucket.refill(), limiter.aimd)
+}
+
+// Take tokens at the current rate or return storage.ErrInsufficientTokens, see bucket.Take.
+func (limiter *Adaptive) Take(tokens int) error {
+	return limiter.TakeContext(context.Background(), tokens)
+}
+
+func (limiter *Adaptive) TakeContext(ctx context.Context, tokens int) error {
+	decision, err := limiter.TakeNContext(ctx, tokens)
+	if err == nil && !decision.Allowed {
+		return storage.ErrInsufficientTokens
+	}
+
+	return err
+}
+
+// Take a single token at the current rate.
+func (limiter *Adaptive) Allow() (storage.Decision, error) {
+	return limiter.AllowContext(context.Background())
+}
+
+func (limiter *Adaptive) AllowContext(ctx context.Context) (storage.Decision, error) {
+	return limiter.TakeNContext(ctx, 1)
+}
+
+// Report how a call downstream went and return the rate as it stands afterwards. Report errors, timeouts and 429s
+// as failures.
+func (limiter *Adaptive) Report(success bool, latency time.Duration) (int, error) {
+	return limiter.ReportContext(context.Background(), success, latency)
+}
+
+func (limiter *Adaptive) ReportContext(ctx context.Context, success bool, latency time.Duration) (int, error) {
+	if limiter.maxLatency > 0 && latency > limiter.maxLatency {
+		success = false
+	}
+
+	return limiter.storage.Report(ctx, limiter.bucket.Name, success, limiter.aimd)
+}
@@ -0,0 +1,79 @@
+package bucket_test
+
+import (
+	tb "github.com/b3ntly/bucket"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestAdaptive(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("the rate climbs on success and is cut on failure within its bounds", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Rate: 10, Interval: time.Second, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for the adaptive test")
+
+			limiter, err := tb.NewAdaptive(bucket, &tb.AdaptiveOptions{
+				MinRate: 2,
+				MaxRate: 12,
+				Cooldown: time.Millisecond * 50,
+				MaxLatency: time.Second,
+			})
+			asserts.Nil(err, "Failed to create an adaptive limiter")
+
+			for _, report := range []struct{
+				success bool
+				latency time.Duration
+				pause bool
+				rate int
+				message string
+			}{
+				{ true, 0, false, 11, "a success should raise the rate" },
+				{ true, 0, false, 11, "the rate should go up at most once a cooldown" },
+				{ true, 0, true, 12, "the rate should go up again after the cooldown" },
+				{ true, 0, true, 12, "the rate should not go past the maximum" },
+				{ false, 0, false, 6, "a failure should halve the rate straight away" },
+				{ false, 0, false, 6, "a burst of failures should only cut the rate once" },
+				{ true, 0, false, 6, "the rate should hold for a cooldown after a cut" },
+				{ true, time.Second * 2, true, 3, "a slow success should count as a failure" },
+				{ false, 0, true, 2, "the rate should not go below the minimum" },
+			} {
+				if report.pause {
+					time.Sleep(time.Millisecond * 60)
+				}
+
+				rate, err := limiter.Report(report.success, report.latency)
+				asserts.Nil(err, "limiter.Report should not return an error")
+				asserts.Equal(report.rate, rate, report.message)
+			}
+
+			decision, err := limiter.TakeN(10)
+			asserts.Nil(err, "limiter.TakeN should not return an error")
+			asserts.True(decision.Allowed, "the bucket should still hold its capacity")
+
+			decision, err = limiter.TakeN(1)
+			asserts.Nil(err, "limiter.TakeN should not return an error")
+			asserts.False(decision.Allowed, "the bucket should be empty")
+			asserts.True(decision.RetryAfter > time.Millisecond * 400, "the bucket should refill at the adapted rate")
+		})
+	}
+
+	t.Run("the bounds must hold the rate of the bucket", func(t *testing.T) {
+		bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Rate: 10 })
+		asserts.Nil(err, "Failed to create a bucket for the adaptive test")
+
+		_, err = tb.NewAdaptive(bucket, &tb.AdaptiveOptions{ MaxRate: 5 })
+		asserts.NotNil(err, "tb.NewAdaptive should return an error")
+
+		plain, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10 })
+		asserts.Nil(err, "Failed to create a bucket for the adaptive test")
+
+		_, err = tb.NewAdaptive(plain, &tb.AdaptiveOptions{ MaxRate: 5 })
+		asserts.NotNil(err, "tb.NewAdaptive should return an error for a bucket without a rate")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
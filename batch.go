@@ -0,0 +1,59 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * batch.go takes from and puts into many buckets in a single round trip to the storage provider, with RedisStorage
+ * that is one pipeline of EVALSHA rather then a round trip per bucket. Unlike a group (see group.go) every operation
+ * stands by itself, one bucket running short doesn't stop the others from being taken from.
+ *
+ * To batch calls made from many goroutines without changing them see RedisStorage.CoalesceWindow.
+ */
+
+// One take or put in a batch, see RunBatch.
+type BatchOp struct {
+	Bucket *Bucket
+	Tokens int
+
+	// put Tokens into the bucket rather then taking them
+	Put bool
+}
+
+// Run every operation in one round trip and describe how each went in the same order, see storage.BatchStorage. The
+// buckets must share a storage provider, which must implement storage.BatchStorage. Buckets with a parent can't be
+// batched.
+func RunBatch(ops ...BatchOp) ([]storage.OpResult, error) {
+	return RunBatchContext(context.Background(), ops...)
+}
+
+func RunBatchContext(ctx context.Context, ops ...BatchOp) ([]storage.OpResult, error) {
+	if len(ops) == 0 {
+		return nil, nil
+	}
+
+	store, ok := ops[0].Bucket.storage.(storage.BatchStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Batches need a storage.BatchStorage.", storage.ErrNotSupported)
+	}
+
+	batch := make([]storage.Op, len(ops))
+	for i, op := range ops {
+		if op.Bucket.storage != ops[0].Bucket.storage {
+			return nil, errors.New("Buckets in a batch must share a storage provider.")
+		}
+
+		if op.Bucket.parent != nil {
+			return nil, errors.New("Buckets with a parent can't be batched.")
+		}
+
+		// a bucket without a rate is taken from like Take, which fails for a bucket that was never created
+		batch[i] = storage.Op{Name: op.Bucket.Name, Tokens: op.Tokens, Put: op.Put, Refill: op.Bucket.refill()}
+	}
+
+	return store.Batch(ctx, batch)
+}
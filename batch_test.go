@@ -0,0 +1,49 @@
+package bucket_test
+
+import (
+	"errors"
+	"testing"
+	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("bucket.RunBatch takes from and puts into many buckets at once", func(t *testing.T) {
+			a, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 5, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for bucket.RunBatch test")
+
+			b, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 5, Rate: 1, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for bucket.RunBatch test")
+
+			results, err := tb.RunBatch(
+				tb.BatchOp{ Bucket: a, Tokens: 2 },
+				tb.BatchOp{ Bucket: b, Tokens: 6 },
+				tb.BatchOp{ Bucket: a, Tokens: 1, Put: true },
+			)
+			asserts.Nil(err, "bucket.RunBatch should not return an error")
+			asserts.True(results[0].Decision.Allowed, "the take from a should be allowed")
+			asserts.False(results[1].Decision.Allowed, "b running short should not affect a")
+			asserts.Nil(results[2].Err, "the put should not return an error")
+
+			count, err := a.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(4, count, "count should be after the take and the put")
+		})
+	}
+
+	t.Run("buckets in a batch must share a storage provider", func(t *testing.T) {
+		a, _ := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 5, Storage: &storage.MemoryStorage{} })
+		b, _ := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 5, Storage: &storage.MemoryStorage{} })
+
+		_, err := tb.RunBatch(tb.BatchOp{ Bucket: a, Tokens: 1 }, tb.BatchOp{ Bucket: b, Tokens: 1 })
+		asserts.NotNil(err, "bucket.RunBatch should not mix storage providers")
+		asserts.False(errors.Is(err, storage.ErrNotSupported), "both providers support batches")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -2,7 +2,10 @@ package bucket_test
 
 import (
 	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/go-redis/redis"
 	"testing"
+	"time"
 )
 
 func BenchmarkBucket_Create(b *testing.B) {
@@ -60,3 +63,16 @@ func BenchmarkBucket_Put(b *testing.B) {
 		})
 	}
 }
+
+func BenchmarkBucket_TakeCoalesced(b *testing.B) {
+	store := &storage.RedisStorage{ Client: redis.NewClient(redisOptions), CoalesceWindow: time.Millisecond }
+	bucket, _ := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: b.N, Storage: store })
+
+	// coalescing pays off with many callers at once
+	b.SetParallelism(64)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			_ = bucket.Take(1)
+		}
+	})
+}
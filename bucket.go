@@ -1,8 +1,10 @@
 package bucket
 
 import (
+	"context"
 	"github.com/b3ntly/bucket/storage"
 	"errors"
+	"fmt"
 	"time"
 	"github.com/go-redis/redis"
 )
@@ -40,12 +42,85 @@ type (
 
 		// the token value a bucket should hold when it is created, if the bucket already exists this does nothing
 		capacity int
+
+		// the number of tokens a bucket regains every interval, see Options.Rate
+		rate int
+		interval time.Duration
+
+		// see Options.WarmUp
+		warmUp time.Duration
+		coldRate int
+
+		// see Options.PollInterval
+		pollInterval time.Duration
+		maxPollInterval time.Duration
+
+		// goroutines blocked in bucket.Wait, see queue.go
+		queue *waitQueue
+
+		// see Options.SharedQueue
+		sharedQueue bool
+		queueLease time.Duration
+
+		// see Options.Parent, hierarchy.go
+		parent *Bucket
+		ceiling int
+
+		// see Options.FillStrategy
+		fillStrategy storage.FillStrategy
 	}
 
 	Options struct {
 		Storage storage.Storage
 		Name string
 		Capacity int
+
+		// When Rate is greater then 0 the bucket refills itself with Rate tokens every Interval, up to Capacity, with no
+		// need for bucket.Fill. Rather then running a goroutine the token value is worked out every time the bucket is
+		// used so it is cheap to have a great number of these. Interval defaults to one second.
+		//
+		// The storage provider must implement storage.RefillStorage.
+		Rate int
+		Interval time.Duration
+
+		// Optional, with a WarmUp period a refilling bucket which has been sitting idle starts out cold rather then
+		// letting its whole capacity through at once. A cold bucket refills at ColdRate (a third of Rate by default) and
+		// holds a share of Capacity in proportion, both climb to Rate and Capacity over WarmUp while the bucket is used.
+		// See storage.Refill.
+		WarmUp time.Duration
+		ColdRate int
+
+		// Optional, how often bucket.Wait checks the bucket when nothing tells it that tokens were added. The interval
+		// doubles after every check which comes up short, up to MaxPollInterval. Waiters on a storage provider which
+		// implements storage.NotifyStorage are woken by Put and Set instead and only poll every MaxPollInterval in case
+		// a notification went missing. The defaults are 50ms and 1s.
+		PollInterval time.Duration
+		MaxPollInterval time.Duration
+
+		// Optional, with SharedQueue waiters from every process using the bucket wait in one queue kept in storage
+		// rather then each process serving its own waiters, see bucket.WaitPriority. Each waiter holds a lease on its
+		// place in the queue which it renews while waiting, the place of a waiter which crashed is given up once its
+		// lease of QueueLease runs out. QueueLease defaults to 10 seconds.
+		//
+		// The storage provider must implement storage.QueueStorage.
+		SharedQueue bool
+		QueueLease time.Duration
+
+		// Optional, a bucket with a Parent has its own tokens guaranteed to it and every take from it is charged to the
+		// parent as well, even when that leaves the parent short. Once the bucket runs out it may borrow tokens the parent
+		// has to spare, as long as it takes no more then Ceiling tokens every Interval all told. Without a Ceiling the
+		// bucket never borrows. See hierarchy.go
+		//
+		// The bucket must share its parent's storage provider, which must implement storage.GroupStorage.
+		Parent *Bucket
+		Ceiling int
+
+		// Optional, how bucket.Fill, CoordinatedFill and DynamicFill top the bucket up on every tick. The default,
+		// storage.FillSet, sets the token value to the rate of the fill whatever the bucket held. storage.FillAdd adds
+		// the rate on top of what is left without going past Capacity and storage.FillFull fills the bucket to Capacity.
+		//
+		// The storage provider must implement storage.FillStorage for anything but storage.FillSet.
+		FillStrategy storage.FillStrategy
 	}
 )
 
@@ -63,6 +138,26 @@ func (opts *Options) init(store storage.Storage) *Options {
 		opts.Storage = store
 	}
 
+	if opts.Rate > 0 && opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Millisecond * 50
+	}
+
+	if opts.MaxPollInterval <= 0 {
+		opts.MaxPollInterval = time.Second
+	}
+
+	if opts.MaxPollInterval < opts.PollInterval {
+		opts.MaxPollInterval = opts.PollInterval
+	}
+
+	if opts.QueueLease <= 0 {
+		opts.QueueLease = time.Second * 10
+	}
+
 	return opts
 }
 
@@ -75,92 +170,418 @@ func (opts *Options) init(store storage.Storage) *Options {
 // in the database). Redis will also reject sharing a bucket name whose value is 0, this was a personal choice because
 // I found myself incorrectly using bucket names I thought did not exist but actually did (from leftover tests).
 func New(options *Options) (*Bucket, error) {
-	return create(options.init(DefaultMemoryStore))
+	return create(context.Background(), options.init(DefaultMemoryStore))
+}
+
+// Like New but the storage provider gives up on pinging and creating the bucket once ctx is done.
+func NewContext(ctx context.Context, options *Options) (*Bucket, error) {
+	return create(ctx, options.init(DefaultMemoryStore))
 }
 
 // Create a bucket with Redis storage
 func NewWithRedis(options *Options) (*Bucket, error){
-	return create(options.init(DefaultRedisStore))
+	return create(context.Background(), options.init(DefaultRedisStore))
 }
 
-func create(options *Options) (*Bucket, error){
-	bucket := &Bucket{Name: options.Name, capacity: options.Capacity, storage: options.Storage}
+func create(ctx context.Context, options *Options) (*Bucket, error){
+	bucket := &Bucket{
+		Name: options.Name,
+		capacity: options.Capacity,
+		storage: options.Storage,
+		rate: options.Rate,
+		interval: options.Interval,
+		warmUp: options.WarmUp,
+		coldRate: options.ColdRate,
+		pollInterval: options.PollInterval,
+		maxPollInterval: options.MaxPollInterval,
+		queue: &waitQueue{},
+		sharedQueue: options.SharedQueue,
+		queueLease: options.QueueLease,
+		parent: options.Parent,
+		ceiling: options.Ceiling,
+		fillStrategy: options.FillStrategy,
+	}
+
+	if _, ok := bucket.storage.(storage.RefillStorage); bucket.rate > 0 && !ok {
+		return nil, fmt.Errorf("%w Refilling buckets need a storage.RefillStorage.", storage.ErrNotSupported)
+	}
+
+	if _, ok := bucket.storage.(storage.QueueStorage); bucket.sharedQueue && !ok {
+		return nil, fmt.Errorf("%w Shared queues need a storage.QueueStorage.", storage.ErrNotSupported)
+	}
+
+	switch bucket.fillStrategy {
+	case storage.FillSet, storage.FillAdd, storage.FillFull:
+	default:
+		return nil, storage.ErrUnknownStrategy
+	}
+
+	if _, ok := bucket.storage.(storage.FillStorage); bucket.fillStrategy != storage.FillSet && !ok {
+		return nil, fmt.Errorf("%w Fill strategies need a storage.FillStorage.", storage.ErrNotSupported)
+	}
+
+	if bucket.warmUp > 0 && bucket.rate <= 0 {
+		return nil, errors.New("Only buckets with a rate can warm up.")
+	}
+
+	if err := bucket.checkParent(); err != nil {
+		return nil, err
+	}
 
 	// ensure our redis connection is valid
-	err := bucket.storage.Ping()
+	store := storage.WithContext(bucket.storage)
+	err := store.PingContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	err = bucket.storage.Create(bucket.Name, bucket.capacity)
+	err = store.CreateContext(ctx, bucket.Name, bucket.capacity)
 	return bucket, err
 }
 
 // Decrement the token value of a bucket if the number of tokens in the bucket is >= tokensDesired. It will return
-// an error if not enough tokens exist.
+// storage.ErrInsufficientTokens if not enough tokens exist.
 func (bucket *Bucket) Take(tokensDesired int) error {
-	return bucket.storage.Take(bucket.Name, tokensDesired)
+	return bucket.TakeContext(context.Background(), tokensDesired)
+}
+
+// Like Take but the storage provider gives up once ctx is done and returns ctx.Err(). Every method of Bucket has a
+// version like this.
+func (bucket *Bucket) TakeContext(ctx context.Context, tokensDesired int) error {
+	if _, ok := bucket.refiller(); !ok && bucket.parent == nil {
+		return storage.WithContext(bucket.storage).TakeContext(ctx, bucket.Name, tokensDesired)
+	}
+
+	decision, err := bucket.TakeNContext(ctx, tokensDesired)
+	if err == nil && !decision.Allowed {
+		return storage.ErrInsufficientTokens
+	}
+
+	return err
+}
+
+// Decrement the token value of a bucket if the number of tokens in the bucket is >= tokens and describe the bucket
+// afterwards: whether the tokens were taken, how many remain out of the capacity, how long until there would be
+// enough tokens and how long until the bucket is full again. Not having enough tokens is not an error.
+//
+// The decision is worked out in the same atomic operation as the take when the storage provider implements
+// storage.RefillStorage, or storage.BatchStorage for a bucket without a rate. Otherwise it is pieced together from a
+// separate Take and Count, a take which went through is still allowed if the Count fails with Remaining left at 0.
+func (bucket *Bucket) TakeN(tokens int) (storage.Decision, error) {
+	return bucket.TakeNContext(context.Background(), tokens)
+}
+
+func (bucket *Bucket) TakeNContext(ctx context.Context, tokens int) (storage.Decision, error) {
+	if bucket.parent != nil {
+		return bucket.takeLineage(ctx, tokens)
+	}
+
+	if refiller, ok := bucket.refiller(); ok {
+		return refiller.TakeRefill(ctx, bucket.Name, tokens, bucket.refill())
+	}
+
+	// a batch of one take describes the bucket in the same step, see storage.Op
+	if batcher, ok := bucket.storage.(storage.BatchStorage); ok {
+		results, err := batcher.Batch(ctx, []storage.Op{{Name: bucket.Name, Tokens: tokens, Refill: bucket.refill()}})
+		if err != nil {
+			return storage.Decision{}, err
+		}
+
+		return results[0].Decision, results[0].Err
+	}
+
+	store := storage.WithContext(bucket.storage)
+	decision := storage.Decision{Limit: bucket.capacity, RetryAfter: -1, ResetAfter: -1}
+	if err := store.TakeContext(ctx, bucket.Name, tokens); errors.Is(err, storage.ErrInsufficientTokens) {
+		decision.Remaining, err = store.CountContext(ctx, bucket.Name)
+		return decision, err
+	} else if err != nil {
+		return decision, err
+	}
+
+	// the tokens are gone whatever happens to the count so the take is reported as allowed
+	decision.Allowed, decision.RetryAfter = true, 0
+	if count, err := store.CountContext(ctx, bucket.Name); err == nil {
+		decision.Remaining = count
+	}
+
+	if decision.Remaining >= bucket.capacity {
+		decision.ResetAfter = 0
+	}
+
+	return decision, nil
+}
+
+// Take a single token, see bucket.TakeN
+func (bucket *Bucket) Allow() (storage.Decision, error) {
+	return bucket.AllowContext(context.Background())
+}
+
+func (bucket *Bucket) AllowContext(ctx context.Context) (storage.Decision, error) {
+	return bucket.TakeNContext(ctx, 1)
 }
 
 // returns a conditional amount of tokens representing all the tokens
 func (bucket *Bucket) TakeAll() (int, error){
-	return bucket.storage.TakeAll(bucket.Name)
+	return bucket.TakeAllContext(context.Background())
+}
+
+func (bucket *Bucket) TakeAllContext(ctx context.Context) (int, error){
+	if refiller, ok := bucket.refiller(); ok {
+		return refiller.TakeAllRefill(ctx, bucket.Name, bucket.refill())
+	}
+
+	return storage.WithContext(bucket.storage).TakeAllContext(ctx, bucket.Name)
 }
 
 // Increment the token value by a given amount.
 func (bucket *Bucket) Put(amount int) error {
-	return bucket.storage.Put(bucket.Name, amount)
+	return bucket.PutContext(context.Background(), amount)
+}
+
+func (bucket *Bucket) PutContext(ctx context.Context, amount int) error {
+	return storage.WithContext(bucket.storage).PutContext(ctx, bucket.Name, amount)
+}
+
+// Like Put but the token value never goes past the capacity of the bucket, tokens which don't fit are dropped. Returns
+// the token value afterwards. The storage provider must implement storage.FillStorage.
+func (bucket *Bucket) PutCapped(amount int) (int, error) {
+	return bucket.PutCappedContext(context.Background(), amount)
+}
+
+func (bucket *Bucket) PutCappedContext(ctx context.Context, amount int) (int, error) {
+	store, ok := bucket.storage.(storage.FillStorage)
+	if !ok {
+		return 0, fmt.Errorf("%w Capped puts need a storage.FillStorage.", storage.ErrNotSupported)
+	}
+
+	// like Put
+	if amount <= 0 {
+		return 0, storage.ErrInvalidAmount
+	}
+
+	return store.Fill(ctx, bucket.Name, amount, bucket.capacity, storage.FillAdd)
 }
 
 // Return an integer count of a bucket's token value
 func (bucket *Bucket) Count() (int, error) {
-	return bucket.storage.Count(bucket.Name)
+	return bucket.CountContext(context.Background())
 }
 
-// Attempt on a 500ms interval to call bucket.Take with a nil response. It returns an instance of Watchable from which
-// the polling can be cancelled and errors or nil may be received. See ./examples/watchable.go to get an idea of how it works.
-func (bucket *Bucket) Watch(tokens int, duration time.Duration) *Watchable {
-	watchable := NewWatchable()
-	timeout := time.After(duration)
+func (bucket *Bucket) CountContext(ctx context.Context) (int, error) {
+	if refiller, ok := bucket.refiller(); ok {
+		return refiller.CountRefill(ctx, bucket.Name, bucket.refill())
+	}
 
-	go func(bucket *Bucket, watchable *Watchable, timeout <-chan time.Time, tokens int) {
-		// time.Ticker returns a channel which fires every time the duration provided is passed
-		ticker := time.NewTicker(time.Millisecond * 500)
-		defer ticker.Stop()
+	return storage.WithContext(bucket.storage).CountContext(ctx, bucket.Name)
+}
 
-		for {
+// Return the storage provider as a storage.RefillStorage if the bucket refills itself.
+func (bucket *Bucket) refiller() (storage.RefillStorage, bool) {
+	if bucket.rate <= 0 {
+		return nil, false
+	}
+
+	refiller, ok := bucket.storage.(storage.RefillStorage)
+	return refiller, ok
+}
+
+func (bucket *Bucket) refill() storage.Refill {
+	return storage.Refill{
+		Capacity: bucket.capacity,
+		Rate: bucket.rate,
+		Interval: bucket.interval,
+		WarmUp: bucket.warmUp,
+		ColdRate: bucket.coldRate,
+	}
+}
+
+// Block until tokens can be taken from the bucket and take them, or until ctx is done in which case ctx.Err() is
+// returned. Not having enough tokens is not an error here, any other error from the storage provider is returned.
+//
+// Waiters queue up and are served strictly in the order they called Wait, see bucket.WaitPriority. A refilling bucket
+// is checked again once the decision says there should be enough tokens. Otherwise the waiter is woken by Put and Set
+// when the storage provider implements storage.NotifyStorage, or polls the bucket on Options.PollInterval with backoff
+// when it does not.
+func (bucket *Bucket) Wait(ctx context.Context, tokens int) (storage.Decision, error) {
+	return bucket.WaitPriority(ctx, tokens, Normal)
+}
+
+// Like Wait but the waiter joins the queue in the given class, Interactive waiters are served before Normal ones which
+// are served before Batch ones. Within a class waiters are served first come first served and only the waiter at the
+// head of the queue takes from the bucket, a waiter which gives up leaves the queue straight away.
+//
+// The queue belongs to this *Bucket, waiters using a different *Bucket for the same name or calling Take directly
+// don't queue up behind it. With Options.SharedQueue the queue is kept in storage instead and every waiter for the
+// bucket, in any process, queues up in it.
+func (bucket *Bucket) WaitPriority(ctx context.Context, tokens int, priority Priority) (storage.Decision, error) {
+	w := bucket.queue.join(priority)
+	defer bucket.queue.leave(w)
+
+	if queue, ok := bucket.storage.(storage.QueueStorage); ok && bucket.sharedQueue {
+		return bucket.waitShared(ctx, queue, tokens, priority)
+	}
+
+	var notifications <-chan struct{}
+	notifier, subscribe := bucket.storage.(storage.NotifyStorage)
+	poll := bucket.pollInterval
+
+	for {
+		if !bucket.queue.isHead(w) {
 			select {
+			case <-w.wake:
+				continue
+			case <-ctx.Done():
+				return storage.Decision{}, ctx.Err()
+			}
+		}
 
-			// attempt to take the desiredTokens on every ticker event, expect an error though and continue the loop
-			case <-ticker.C:
-				// we expect an error here so we do not send into watchable.Failed
-				if err := bucket.storage.Take(bucket.Name, tokens); err == nil {
-					watchable.Success <- nil
-					return
-				}
+		// only the head of the queue listens for notifications, subscribe before the first take so a Put in between
+		// can't be missed
+		if subscribe {
+			channel, stop, err := notifier.Subscribe(ctx, bucket.Name)
+			if err != nil && !errors.Is(err, storage.ErrNotSupported) {
+				return storage.Decision{}, err
+			}
 
-			// cancel the watchable on timeout
-			case <- timeout:
-				watchable.Failed <- errors.New("Timeout.")
-				return
+			if err == nil {
+				defer stop()
+			}
+
+			notifications, subscribe = channel, false
+		}
 
-			// on cancel end the ticker loop, possibly with an error
-			case err := <-watchable.Cancel:
-				watchable.Failed <- err
-				return
+		decision, err := bucket.TakeNContext(ctx, tokens)
+		if err != nil || decision.Allowed {
+			return decision, err
+		}
+
+		wait := poll
+		if notifications != nil {
+			wait = bucket.maxPollInterval
+		}
+
+		if decision.RetryAfter > 0 && decision.RetryAfter < wait {
+			wait = decision.RetryAfter
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case _, ok := <-notifications:
+			// the provider stopped listening, poll from here on
+			if !ok {
+				notifications = nil
+			}
+
+		case <-timer.C:
+			if poll *= 2; poll > bucket.maxPollInterval {
+				poll = bucket.maxPollInterval
 			}
+
+		case <-ctx.Done():
+			timer.Stop()
+			return decision, ctx.Err()
+		}
+
+		timer.Stop()
+	}
+}
+
+// Wait in the queue kept in storage. Only the waiter at the head of the queue listens for tokens being put in, the
+// rest wait to hear that their ticket was granted or reached the head. Every waiter renews its lease a few times a
+// lease and checks on its ticket while doing so in case a notification went missing.
+func (bucket *Bucket) waitShared(ctx context.Context, queue storage.QueueStorage, tokens int, priority Priority) (storage.Decision, error) {
+	ticket := storage.Ticket{ID: storage.NewTicketID(), Tokens: tokens, Priority: int(priority), Lease: bucket.queueLease}
+
+	// subscribe before joining so a grant can't be missed
+	granted, stop, err := queue.SubscribeTicket(ctx, bucket.Name, ticket.ID)
+	if errors.Is(err, storage.ErrNotSupported) {
+		// check on the ticket every time the lease is renewed instead
+		granted, stop, err = nil, func() {}, nil
+	}
+
+	if err != nil {
+		return storage.Decision{}, err
+	}
+	defer stop()
+
+	var notifications <-chan struct{}
+	notifier, subscribe := bucket.storage.(storage.NotifyStorage)
+
+	status, err := queue.Queue(ctx, bucket.Name, ticket, bucket.refill())
+
+	for err == nil && !status.Granted {
+		if status.Position == 0 && subscribe {
+			subscribe = false
+
+			// without notifications the head falls back to checking on RetryAfter
+			channel, stop, subscribeErr := notifier.Subscribe(ctx, bucket.Name)
+			if subscribeErr != nil {
+				continue
+			}
+
+			defer stop()
+			notifications = channel
+
+			// tokens may have been put in before we subscribed
+			status, err = queue.Queue(ctx, bucket.Name, ticket, bucket.refill())
+			continue
+		}
+
+		wait := bucket.queueLease / 3
+		if status.Position == 0 && status.Decision.RetryAfter > 0 && status.Decision.RetryAfter < wait {
+			wait = status.Decision.RetryAfter
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-granted:
+		case <-notifications:
+		case <-timer.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+
+		timer.Stop()
+
+		if err == nil {
+			status, err = queue.Queue(ctx, bucket.Name, ticket, bucket.refill())
 		}
-	}(bucket, watchable, timeout, tokens)
+	}
+
+	if err != nil {
+		// leave the queue whatever happened to ctx, handing back anything granted in the meantime
+		queue.Dequeue(context.Background(), bucket.Name, ticket, bucket.refill())
+		return status.Decision, err
+	}
+
+	return status.Decision, nil
+}
 
-	return watchable
+// The number of goroutines waiting on the bucket in bucket.Wait, bucket.WaitPriority or bucket.Watch.
+func (bucket *Bucket) QueueDepth() int {
+	return bucket.queue.depth()
 }
 
-// Start a ticker that will periodically set the token value to a given rate on the defined interval. Returns
-// a Watchable object identical to bucket.Watch, and thus may be canceled and observed.
-func (bucket *Bucket) Fill(rate int, interval time.Duration) *Watchable {
-	watchable := NewWatchable()
+// Wait up to duration for tokens in the background, see bucket.Wait. The task succeeds once the tokens are taken and
+// fails with context.DeadlineExceeded if they could not be taken in time.
+func (bucket *Bucket) Watch(tokens int, duration time.Duration) *Task {
+	return start(func(ctx context.Context) error {
+		ctx, cancel := context.WithTimeout(ctx, duration)
+		defer cancel()
+
+		_, err := bucket.Wait(ctx, tokens)
+		return err
+	})
+}
 
-	go func(bucket *Bucket, watchable *Watchable, rate int, interval time.Duration){
+// Start a ticker that will periodically set the token value to a given rate on the defined interval, or add it capped
+// at the capacity and so on depending on Options.FillStrategy. It runs until the returned task is stopped, or fails on
+// the first error from the storage provider.
+func (bucket *Bucket) Fill(rate int, interval time.Duration) *Task {
+	return start(func(ctx context.Context) error {
 		ticker := time.NewTicker(interval)
 		defer ticker.Stop()
 
@@ -172,55 +593,119 @@ func (bucket *Bucket) Fill(rate int, interval time.Duration) *Watchable {
 		for {
 			select {
 			case <- ticker.C:
-
-				err := bucket.storage.Set(bucket.Name, rate)
-
 				// our program may rely on our bucket to be refilled reliably, so we should fail hard on error
-				if err != nil {
-					watchable.Failed <- err
-					return
+				if err := bucket.fill(ctx, rate); err != nil {
+					return err
 				}
 
-			// on cancel end the ticker loop, possibly with an error
-			case err := <-watchable.Cancel:
-				watchable.Failed <- err
-				return
+			case <- ctx.Done():
+				return ctx.Err()
 			}
 		}
-	}(bucket, watchable, rate, interval)
+	})
+}
 
-	return watchable
+// Top the bucket up with rate tokens the way Options.FillStrategy says, in a single call to the storage provider.
+func (bucket *Bucket) fill(ctx context.Context, rate int) error {
+	if bucket.fillStrategy == storage.FillSet {
+		return storage.WithContext(bucket.storage).SetContext(ctx, bucket.Name, rate)
+	}
+
+	_, err := bucket.storage.(storage.FillStorage).Fill(ctx, bucket.Name, rate, bucket.capacity, bucket.fillStrategy)
+	return err
 }
 
-// Dynamic fill fills the bucket every time it reads from interval
-func (bucket *Bucket) DynamicFill(rate int, interval chan time.Time) *Watchable {
-	watchable := NewWatchable()
+// Like Fill but for a bucket which several nodes fill, only one of the nodes calling CoordinatedFill for the bucket
+// fills it at a time. The nodes elect a leader with a semaphore of one lease named after the bucket (see
+// bucket.NewSemaphore) which the leader renews on every tick before it fills the bucket. When the leader stops or
+// dies its lease is released or runs out after three intervals and another node takes over on its next tick.
+// Task.Leadership reports when this node gains and loses the lead.
+//
+// The storage provider must implement storage.SemaphoreStorage, otherwise the task fails straight away.
+func (bucket *Bucket) CoordinatedFill(rate int, interval time.Duration) *Task {
+	task := newTask()
+	task.leadership = make(chan bool, 1)
+
+	task.run(func(ctx context.Context) error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
 
-	go func(bucket *Bucket, watchable *Watchable, rate int, interval chan time.Time){
+		if rate > bucket.capacity {
+			rate = bucket.capacity
+		}
+
+		election, err := NewSemaphore(&SemaphoreOptions{Storage: bucket.storage, Name: bucket.Name + ":leader", Limit: 1, TTL: interval * 3})
+		if err != nil {
+			return err
+		}
+
+		var lease *Lease
+		defer func() {
+			if lease != nil {
+				lease.ReleaseContext(context.Background())
+			}
+		}()
 
 		for {
-			if rate > bucket.capacity {
-				rate = bucket.capacity
+			if lease == nil {
+				if lease, err = election.TryAcquireContext(ctx); err == nil {
+					task.lead(true)
+				} else if !errors.Is(err, storage.ErrInsufficientTokens) {
+					return err
+				}
 			}
 
 			select {
-			case <- interval:
+			case <- ticker.C:
+			case <- ctx.Done():
+				return ctx.Err()
+			}
+
+			if lease == nil {
+				continue
+			}
+
+			// renew the lead before every fill so a leader which lost it never fills alongside the new one
+			if err := lease.RenewContext(ctx); errors.Is(err, storage.ErrLeaseExpired) {
+				lease = nil
+				task.lead(false)
+				continue
+			} else if err != nil {
+				return err
+			}
+
+			if err := bucket.fill(ctx, rate); err != nil {
+				return err
+			}
+		}
+	})
 
+	return task
+}
 
-				err := bucket.storage.Set(bucket.Name, rate)
+// Dynamic fill fills the bucket every time it reads from interval. It runs until the returned task is stopped or
+// interval is closed, in which case the task succeeds, or fails on the first error from the storage provider.
+func (bucket *Bucket) DynamicFill(rate int, interval chan time.Time) *Task {
+	return start(func(ctx context.Context) error {
+		if rate > bucket.capacity {
+			rate = bucket.capacity
+		}
+
+		for {
+			select {
+			case _, ok := <- interval:
+				if !ok {
+					return nil
+				}
 
 				// our program may rely on our bucket to be refilled reliably, so we should fail hard on error
-				if err != nil {
-					watchable.Failed <- err
-					return
+				if err := bucket.fill(ctx, rate); err != nil {
+					return err
 				}
 
-			case err := <- watchable.Cancel:
-				watchable.Failed <- err
-				return
+			case <- ctx.Done():
+				return ctx.Err()
 			}
 		}
-	}(bucket, watchable, rate, interval)
-
-	return watchable
-}
\ No newline at end of file
+	})
+}
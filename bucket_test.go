@@ -1,6 +1,7 @@
 package bucket_test
 
 import (
+	"context"
 	tb "github.com/b3ntly/bucket"
 	"github.com/b3ntly/bucket/storage"
 	"github.com/go-redis/redis"
@@ -9,6 +10,7 @@ import (
 	"testing"
 	"time"
 	"fmt"
+	"errors"
 )
 
 // INTEGRATION TESTING
@@ -44,6 +46,17 @@ func MockBucketName() string {
 }
 
 
+// poll until the condition holds or a second has passed, for work done in the background
+func Eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 5) {
+		if condition() {
+			return true
+		}
+	}
+
+	return condition()
+}
+
 func MockStorage() []storage.Storage {
 	redisStorage := &storage.RedisStorage{ Client: redis.NewClient(redisOptions) }
 	memoryStorage := &storage.MemoryStorage{}
@@ -105,11 +118,12 @@ func TestTokenBucket(t *testing.T) {
 			asserts.Nil(err, "Incorrectly returned an error for bucket.Watch() test")
 
 			// call bucket.Watch with a one minute timeout, this becomes a race condition but *should* never matter
-			done := bucket.Watch(11, time.Second*10).Done()
+			task := bucket.Watch(11, time.Second*10)
 			err = bucket.Put(1)
 			asserts.Nil(err, "Incorrectly returned an error on bucket.Watch() test (2)")
 
-			err = <-done
+			err = task.Wait()
+			asserts.Equal(tb.Succeeded, task.Status(), "bucket.Watch should succeed")
 
 			asserts.Nil(err, "Incorrectly returned an error on bucket.Watch() test (3)")
 		})
@@ -122,9 +136,10 @@ func TestTokenBucket(t *testing.T) {
 			asserts.Nil(err, "Failed to create a bucket for bucket.Watch().timeout test")
 
 			// call bucket.Watch with a one minute timeout, this becomes a race condition but *should* never matter
-			done := bucket.Watch(11, time.Millisecond*1).Done()
-			err = <-done
-			asserts.Error(err, "Failed to return an error due to a timeout on bucket.Watch()")
+			task := bucket.Watch(11, time.Millisecond*1)
+			<-task.Done()
+			asserts.Equal(context.DeadlineExceeded, task.Err(), "Failed to return an error due to a timeout on bucket.Watch()")
+			asserts.Equal(tb.Failed, task.Status(), "bucket.Watch should fail on timeout")
 		})
 
 		t.Run("bucket.Count should count", func(t *testing.T){
@@ -146,11 +161,16 @@ func TestTokenBucket(t *testing.T) {
 			bucket, err := test.constructor(test.options)
 			asserts.Nil(err, "Failed to create a bucket for bucket.Fill.cancelable test")
 
-			watchable := bucket.Fill(100, time.Second * 1)
-			done := watchable.Done()
-			watchable.Cancel <- nil
-			err = <-done
-			asserts.Nil(err, "bucket.Fill should cancel without an error")
+			task := bucket.Fill(100, time.Second * 1)
+			asserts.Equal(tb.Running, task.Status(), "bucket.Fill should run until stopped")
+
+			task.Stop()
+			asserts.Equal(context.Canceled, task.Err(), "a stopped task should report context.Canceled")
+			asserts.Equal(tb.Cancelled, task.Status(), "a stopped task should be cancelled")
+
+			// stopping again or after the task has finished does nothing
+			task.Stop()
+			asserts.Equal(tb.Cancelled, task.Status(), "a stopped task should stay cancelled")
 		})
 
 		t.Run("bucket.Fill actually fills", func(t *testing.T){
@@ -159,14 +179,9 @@ func TestTokenBucket(t *testing.T) {
 			bucket, err := test.constructor(test.options)
 			asserts.Nil(err, "Failed to create a bucket for bucket.Fill.cancelable test")
 
-			watchable := bucket.Fill(100, time.Millisecond * 1)
-			done := watchable.Done()
+			task := bucket.Fill(100, time.Millisecond * 1)
 			time.Sleep(time.Millisecond * 5)
-
-			watchable.Cancel <- nil
-			<-done
-
-			asserts.Nil(err, "bucket.Fill should cancel without an error")
+			task.Stop()
 
 			count, err := bucket.Count()
 			asserts.Nil(err, "bucket.Count should not return an error for bucket.Fill")
@@ -182,14 +197,12 @@ func TestTokenBucket(t *testing.T) {
 				asserts.Nil(err, "Failed to create a bucket for bucket.DynamicFill.cancelable test")
 
 				signal := make(chan time.Time)
-				watchable := bucket.DynamicFill(100, signal)
-				done := watchable.Done()
+				task := bucket.DynamicFill(100, signal)
 				signal <- time.Now()
+				close(signal)
 
-				watchable.Cancel <- nil
-				<-done
-
-				asserts.Nil(err, "bucket.Fill should cancel without an error")
+				err = task.Wait()
+				asserts.Nil(err, "bucket.DynamicFill should succeed once the channel is closed")
 
 				count, err := bucket.Count()
 				asserts.Nil(err, "bucket.Count should not return an error for bucket.Fill")
@@ -198,6 +211,48 @@ func TestTokenBucket(t *testing.T) {
 			})
 		})
 
+		t.Run("bucket.TakeN describes the bucket after taking from it", func(t *testing.T) {
+			test.options.Name = MockBucketName()
+			test.options.Capacity = 10
+			bucket, err := test.constructor(test.options)
+			asserts.Nil(err, "Failed to create a bucket for bucket.TakeN test")
+
+			decision, err := bucket.TakeN(4)
+			asserts.Nil(err, "bucket.TakeN should not return an error")
+			asserts.True(decision.Allowed, "bucket.TakeN should be allowed")
+			asserts.Equal(6, decision.Remaining, "remaining should be the tokens left")
+			asserts.Equal(10, decision.Limit, "limit should be the capacity")
+
+			decision, err = bucket.TakeN(7)
+			asserts.Nil(err, "bucket.TakeN should not return an error for insufficient tokens")
+			asserts.False(decision.Allowed, "bucket.TakeN should not be allowed")
+			asserts.Equal(6, decision.Remaining, "remaining should be unchanged")
+			asserts.Equal(time.Duration(-1), decision.RetryAfter, "a bucket which does not refill never will")
+
+			err = bucket.Take(7)
+			asserts.True(errors.Is(err, storage.ErrInsufficientTokens), "every provider should report insufficient tokens the same way")
+		})
+
+		t.Run("bucket.TakeContext returns ctx.Err() once ctx is done", func(t *testing.T) {
+			test.options.Name = MockBucketName()
+			test.options.Capacity = 10
+			bucket, err := test.constructor(test.options)
+			asserts.Nil(err, "Failed to create a bucket for bucket.TakeContext test")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err = bucket.TakeContext(ctx, 1)
+			asserts.Equal(context.Canceled, err, "bucket.TakeContext should return ctx.Err()")
+
+			_, err = bucket.TakeNContext(ctx, 1)
+			asserts.Equal(context.Canceled, err, "bucket.TakeNContext should return ctx.Err()")
+
+			count, err := bucket.CountContext(context.Background())
+			asserts.Nil(err, "bucket.CountContext should not return an error")
+			asserts.Equal(10, count, "count should be unchanged")
+		})
+
 		// I'm really only writing this one for the sweet test coverage karma, it's covered by a unit test in ./storage
 		t.Run("bucket.TakeAll will return the current token value of a bucket then set it to zero", func(t *testing.T){
 			expectedCount := 12
@@ -216,6 +271,457 @@ func TestTokenBucket(t *testing.T) {
 		})
 	}
 
+	t.Run("bucket.Take on a bucket which is gone returns ErrBucketNotFound", func(t *testing.T) {
+		bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: &storage.RedisStorage{ Client: testClient } })
+		asserts.Nil(err, "Failed to create a bucket for bucket.Take test")
+
+		err = testClient.Del(bucket.Name).Err()
+		asserts.Nil(err, "the bucket should be deleted")
+
+		err = bucket.Take(1)
+		asserts.True(errors.Is(err, storage.ErrBucketNotFound), "bucket.Take should return ErrBucketNotFound rather then insufficient tokens")
+
+		_, err = bucket.TakeN(1)
+		asserts.True(errors.Is(err, storage.ErrBucketNotFound), "bucket.TakeN should return ErrBucketNotFound rather then insufficient tokens")
+	})
+
+	t.Run("bucket.TakeN reports a take which went through even when the count fails", func(t *testing.T) {
+		bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: uncountableStorage{ &storage.MemoryStorage{} } })
+		asserts.Nil(err, "Failed to create a bucket for bucket.TakeN test")
+
+		decision, err := bucket.TakeN(4)
+		asserts.Nil(err, "bucket.TakeN should not return an error once the tokens are taken")
+		asserts.True(decision.Allowed, "bucket.TakeN should be allowed")
+		asserts.Equal(0, decision.Remaining, "remaining should be 0 when it can't be counted")
+	})
+
 	err = testClient.FlushDb().Err()
 	asserts.Nil(err, "redist test db should flush")
 }
+
+// a storage provider which only implements Storage and can't count its buckets
+type uncountableStorage struct {
+	storage.Storage
+}
+
+func (us uncountableStorage) Count(bucketName string) (int, error) {
+	return 0, storage.ErrStorageUnavailable
+}
+
+func TestRefillingBucket(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("bucket with a rate refills itself without bucket.Fill", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{
+				Name: MockBucketName(),
+				Capacity: 5,
+				Rate: 5,
+				Interval: time.Millisecond * 50,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a refilling bucket")
+
+			err = bucket.Take(5)
+			asserts.Nil(err, "Should be able to take the initial capacity")
+
+			err = bucket.Take(1)
+			asserts.Error(err, "Should not be able to take from an empty bucket")
+
+			time.Sleep(time.Millisecond * 30)
+
+			err = bucket.Take(1)
+			asserts.Nil(err, "Bucket should have refilled")
+		})
+
+		t.Run("refilling bucket never holds more then its capacity", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{
+				Name: MockBucketName(),
+				Capacity: 3,
+				Rate: 100,
+				Interval: time.Millisecond * 10,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a refilling bucket")
+
+			_, err = bucket.TakeAll()
+			asserts.Nil(err, "bucket.TakeAll should not return an error")
+
+			time.Sleep(time.Millisecond * 20)
+
+			count, err := bucket.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(3, count, "count should be capped at capacity")
+		})
+
+		t.Run("a cold bucket only lets through a share of its capacity and warms up with use", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{
+				Name: MockBucketName(),
+				Capacity: 30,
+				Rate: 30,
+				Interval: time.Millisecond * 30,
+				WarmUp: time.Millisecond * 60,
+				ColdRate: 10,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a warming bucket")
+
+			count, err := bucket.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(10, count, "a cold bucket should hold a third of its capacity")
+
+			// keep using the bucket for longer then the warm up period
+			for i := 0; i < 10; i++ {
+				_, err = bucket.TakeAll()
+				asserts.Nil(err, "bucket.TakeAll should not return an error")
+				time.Sleep(time.Millisecond * 10)
+			}
+
+			taken, err := bucket.TakeAll()
+			asserts.Nil(err, "bucket.TakeAll should not return an error")
+			asserts.True(taken >= 8, "a warm bucket should refill at the full rate")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
+
+// a storage provider which can't notify waiters
+type pollingStorage struct {
+	storage.Storage
+}
+
+func TestBucketWait(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range append(MockStorage(), pollingStorage{ &storage.MemoryStorage{} }) {
+		t.Run("bucket.Wait returns once tokens are put in", func(t *testing.T) {
+			options := &tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: store, PollInterval: time.Millisecond * 10 }
+
+			// only a provider which can't notify should need to poll
+			if _, ok := store.(storage.NotifyStorage); ok {
+				options.PollInterval, options.MaxPollInterval = time.Minute, time.Minute
+			}
+
+			bucket, err := tb.New(options)
+			asserts.Nil(err, "Failed to create a bucket for bucket.Wait test")
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+			defer cancel()
+
+			waited := make(chan error, 1)
+			go func() {
+				decision, err := bucket.Wait(ctx, 11)
+				asserts.True(decision.Allowed, "bucket.Wait should take the tokens")
+				waited <- err
+			}()
+
+			time.Sleep(time.Millisecond * 50)
+			err = bucket.Put(1)
+			asserts.Nil(err, "bucket.Put should not return an error")
+
+			select {
+			case err = <-waited:
+				asserts.Nil(err, "bucket.Wait should not return an error")
+			case <-time.After(time.Second):
+				asserts.Fail("bucket.Wait should return soon after bucket.Put")
+			}
+
+			count, err := bucket.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(0, count, "bucket.Wait should have taken every token")
+		})
+
+		t.Run("bucket.Wait returns ctx.Err() once ctx is done", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 1, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for bucket.Wait test")
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+			defer cancel()
+
+			_, err = bucket.Wait(ctx, 2)
+			asserts.Equal(context.DeadlineExceeded, err, "bucket.Wait should return ctx.Err()")
+		})
+	}
+
+	for _, store := range MockStorage() {
+		t.Run("bucket.Wait on a refilling bucket sleeps until the tokens should be there", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{
+				Name: MockBucketName(),
+				Capacity: 10,
+				Rate: 10,
+				Interval: time.Millisecond * 500,
+				Storage: store,
+				PollInterval: time.Minute,
+				MaxPollInterval: time.Minute,
+			})
+			asserts.Nil(err, "Failed to create a bucket for bucket.Wait test")
+
+			err = bucket.Take(10)
+			asserts.Nil(err, "bucket.Take should not return an error")
+
+			start := time.Now()
+			decision, err := bucket.Wait(context.Background(), 2)
+			asserts.Nil(err, "bucket.Wait should not return an error")
+			asserts.True(decision.Allowed, "bucket.Wait should take the tokens")
+			asserts.True(time.Since(start) >= time.Millisecond * 90 && time.Since(start) < time.Millisecond * 500, "bucket.Wait should wait for two tokens to refill")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
+
+func TestBucketSharedQueue(t *testing.T) {
+	asserts := assert.New(t)
+
+	t.Run("waiters on different nodes are served in the order they started waiting", func(t *testing.T) {
+		name := MockBucketName()
+
+		// two nodes, each with its own client and *Bucket
+		var buckets []*tb.Bucket
+		for i := 0; i < 2; i++ {
+			bucket, err := tb.New(&tb.Options{
+				Name: name,
+				Capacity: 10,
+				Storage: &storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+				SharedQueue: true,
+			})
+			asserts.Nil(err, "Failed to create a bucket for the shared queue test")
+			buckets = append(buckets, bucket)
+		}
+
+		_, err := buckets[0].TakeAll()
+		asserts.Nil(err, "bucket.TakeAll should not return an error")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second * 5)
+		defer cancel()
+
+		served := make(chan int, 2)
+		for i, tokens := range []int{ 5, 1 } {
+			go func(i int, tokens int) {
+				_, err := buckets[i].Wait(ctx, tokens)
+				asserts.Nil(err, "bucket.Wait should not return an error")
+				served <- i
+			}(i, tokens)
+
+			// let the first waiter join before the second
+			asserts.True(Eventually(func() bool {
+				return testClient.ZCard("{" + name + "}:queue").Val() == int64(i + 1)
+			}), "the waiter should join the queue")
+		}
+
+		// enough for the second waiter but it is behind the first
+		err = buckets[1].Put(1)
+		asserts.Nil(err, "bucket.Put should not return an error")
+
+		select {
+		case i := <-served:
+			asserts.Fail(fmt.Sprintf("waiter %v should not have been served yet", i))
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		// enough for the first waiter and nothing left for the second
+		err = buckets[1].Put(4)
+		asserts.Nil(err, "bucket.Put should not return an error")
+
+		select {
+		case i := <-served:
+			asserts.Equal(0, i, "the first waiter should be served first")
+		case <-time.After(time.Second):
+			asserts.Fail("bucket.Wait should return soon after bucket.Put")
+		}
+
+		select {
+		case i := <-served:
+			asserts.Fail(fmt.Sprintf("waiter %v should not have been served yet", i))
+		case <-time.After(time.Millisecond * 100):
+		}
+
+		err = buckets[1].Put(1)
+		asserts.Nil(err, "bucket.Put should not return an error")
+
+		select {
+		case i := <-served:
+			asserts.Equal(1, i, "the second waiter should be served next")
+		case <-time.After(time.Second):
+			asserts.Fail("bucket.Wait should return soon after bucket.Put")
+		}
+
+		count, err := buckets[0].Count()
+		asserts.Nil(err, "bucket.Count should not return an error")
+		asserts.Equal(0, count, "the waiters should have taken every token")
+	})
+
+	t.Run("a shared queue needs a storage.QueueStorage", func(t *testing.T) {
+		_, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: &storage.MemoryStorage{}, SharedQueue: true })
+		asserts.True(errors.Is(err, storage.ErrNotSupported), "tb.New should return ErrNotSupported")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
+
+// a MemoryStorage which counts how often buckets are set
+type countingStorage struct {
+	*storage.MemoryStorage
+	sets int32
+}
+
+func (cs *countingStorage) SetContext(ctx context.Context, bucketName string, tokens int) error {
+	atomic.AddInt32(&cs.sets, 1)
+	return cs.MemoryStorage.SetContext(ctx, bucketName, tokens)
+}
+
+func TestFillStrategy(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("storage.FillAdd keeps tokens put between ticks and stops at the capacity", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: store, FillStrategy: storage.FillAdd })
+			asserts.Nil(err, "Failed to create a bucket for storage.FillAdd test")
+
+			_, err = bucket.TakeAll()
+			asserts.Nil(err, "bucket.TakeAll should not return an error")
+
+			err = bucket.Put(1)
+			asserts.Nil(err, "bucket.Put should not return an error")
+
+			signal := make(chan time.Time)
+			task := bucket.DynamicFill(4, signal)
+			signal <- time.Now()
+			signal <- time.Now()
+			close(signal)
+			asserts.Nil(task.Wait(), "bucket.DynamicFill should succeed once the channel is closed")
+
+			count, err := bucket.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(9, count, "count should be both fills and the put")
+
+			signal = make(chan time.Time)
+			task = bucket.DynamicFill(4, signal)
+			signal <- time.Now()
+			close(signal)
+			asserts.Nil(task.Wait(), "bucket.DynamicFill should succeed once the channel is closed")
+
+			count, err = bucket.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(10, count, "count should stop at the capacity")
+		})
+
+		t.Run("storage.FillFull fills the bucket to its capacity", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: store, FillStrategy: storage.FillFull })
+			asserts.Nil(err, "Failed to create a bucket for storage.FillFull test")
+
+			err = bucket.Take(7)
+			asserts.Nil(err, "bucket.Take should not return an error")
+
+			signal := make(chan time.Time)
+			task := bucket.DynamicFill(1, signal)
+			signal <- time.Now()
+			close(signal)
+			asserts.Nil(task.Wait(), "bucket.DynamicFill should succeed once the channel is closed")
+
+			count, err := bucket.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(10, count, "count should be the capacity")
+		})
+
+		t.Run("bucket.PutCapped drops tokens which don't fit", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for bucket.PutCapped test")
+
+			err = bucket.Take(3)
+			asserts.Nil(err, "bucket.Take should not return an error")
+
+			count, err := bucket.PutCapped(5)
+			asserts.Nil(err, "bucket.PutCapped should not return an error")
+			asserts.Equal(10, count, "count should stop at the capacity")
+
+			_, err = bucket.PutCapped(0)
+			asserts.Equal(storage.ErrInvalidAmount, err, "bucket.PutCapped should reject an amount which is not positive")
+		})
+
+		t.Run("a bucket with a strategy which isn't one of ours is refused", func(t *testing.T) {
+			_, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: store, FillStrategy: storage.FillStrategy(7) })
+			asserts.Equal(storage.ErrUnknownStrategy, err, "tb.New should return ErrUnknownStrategy")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
+
+func TestCoordinatedFill(t *testing.T) {
+	asserts := assert.New(t)
+
+	// the stores of two nodes sharing the bucket
+	counting := &countingStorage{ MemoryStorage: &storage.MemoryStorage{} }
+	nodes := [][]storage.Storage{
+		{ counting, counting },
+		{ &storage.RedisStorage{ Client: redis.NewClient(redisOptions) }, &storage.RedisStorage{ Client: redis.NewClient(redisOptions) } },
+	}
+
+	for _, stores := range nodes {
+		t.Run("only the leader fills and another node takes over once it stops", func(t *testing.T) {
+			name := MockBucketName()
+			interval := time.Millisecond * 20
+
+			var tasks []*tb.Task
+			for _, store := range stores {
+				bucket, err := tb.New(&tb.Options{ Name: name, Capacity: 10, Storage: store })
+				asserts.Nil(err, "Failed to create a bucket for bucket.CoordinatedFill test")
+
+				tasks = append(tasks, bucket.CoordinatedFill(10, interval))
+
+				// let the first node win the election
+				if len(tasks) == 1 {
+					select {
+					case lead := <-tasks[0].Leadership():
+						asserts.True(lead, "the first node should become the leader")
+					case <-time.After(time.Second):
+						asserts.Fail("the first node should become the leader")
+					}
+				}
+			}
+
+			leader, follower := tasks[0], tasks[1]
+			atomic.StoreInt32(&counting.sets, 0)
+
+			time.Sleep(interval * 10)
+			asserts.True(leader.Leader(), "the leader should keep the lead")
+			asserts.False(follower.Leader(), "there should only be one leader")
+
+			if stores[0] == counting {
+				sets := atomic.LoadInt32(&counting.sets)
+				asserts.True(sets >= 5 && sets <= 11, fmt.Sprintf("only the leader should fill, got %v fills in 10 intervals", sets))
+			}
+
+			leader.Stop()
+			_, open := <-leader.Leadership()
+			asserts.False(leader.Leader(), "a stopped task should not lead")
+			asserts.True(open, "the stopped leader should report losing the lead")
+
+			select {
+			case lead := <-follower.Leadership():
+				asserts.True(lead, "the follower should take over")
+			case <-time.After(time.Second):
+				asserts.Fail("the follower should take over")
+			}
+
+			follower.Stop()
+		})
+	}
+
+	t.Run("bucket.CoordinatedFill needs a storage.SemaphoreStorage", func(t *testing.T) {
+		bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: pollingStorage{ &storage.MemoryStorage{} } })
+		asserts.Nil(err, "Failed to create a bucket for bucket.CoordinatedFill test")
+
+		err = bucket.CoordinatedFill(10, time.Millisecond).Wait()
+		asserts.True(errors.Is(err, storage.ErrNotSupported), "the task should fail with ErrNotSupported")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -27,25 +27,24 @@ func main(){
 	// err == nil
 
 	// watch for 10 tokens to be available, timing out after 5 seconds
-	done := b.Watch(10, time.Second * 5).Done()
-	// err == nil
+	task := b.Watch(10, time.Second * 5)
 
 	// put 100 tokens into the bucket
 	err = b.Put(100)
 	// error == nil
 
-	// listen for bucket.Watch to return via the returned channel, it will return nil if 10 tokens could be acquired
-	// else it will return an error from timing out, a manual cancelation (see ./watchable.go) or an actual error
-	err = <- done
+	// wait for bucket.Watch to finish, it will return nil if 10 tokens could be acquired else it will return an
+	// error from timing out, a manual cancelation (see ./task.go) or an actual error
+	err = task.Wait()
 	// error == nil
 
 	// will fill the bucket at the given rate when the interval channel is sent to
 	signal := make(chan time.Time)
-	watchable := b.DynamicFill(100, signal)
+	filling := b.DynamicFill(100, signal)
 	signal <- time.Now()
 
 	// stop the bucket from filling any longer
-	watchable.Close(nil)
+	filling.Stop()
 
 	// take all the tokens out of the bucket
 	tokens, err := b.TakeAll()
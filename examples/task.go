@@ -0,0 +1,26 @@
+package main
+
+import (
+	"time"
+	"github.com/b3ntly/bucket"
+	"fmt"
+)
+
+func main(){
+	b, _ := bucket.New(&bucket.Options{
+		Name: "my_bucket",
+		Capacity: 10,
+	})
+	// error == nil
+
+	task := b.Watch(11, time.Second * 5)
+
+	// stop the task, this is safe to call any number of times even once the task has finished
+	task.Stop()
+
+	// any number of goroutines may wait on task.Done()
+	<- task.Done()
+
+	fmt.Println(task.Status(), task.Err())
+	// cancelled context canceled
+}
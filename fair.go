@@ -0,0 +1,147 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * fair.go provides a limiter which shares one global rate between tenants by weight, for example a vendor quota
+ * shared by every customer. Only the tenants which are active right now split the rate, so a tenant gets more of it
+ * as others go quiet rather then a fixed capacity which goes to waste while it is idle.
+ *
+ * Shares are worked out by the storage provider on every take from the weights of the tenants active at the time, so
+ * with RedisStorage every node sees the same shares. See storage.Pool.
+ */
+
+type (
+	FairShare struct {
+		storage storage.PoolStorage
+
+		// the name of the limiter, it prefixes every key so that limiters may share storage
+		Name string
+
+		pool storage.Pool
+
+		mutex sync.RWMutex
+		weights map[string]int
+	}
+
+	FairShareOptions struct {
+		Storage storage.Storage
+		Name string
+
+		// Rate tokens every Interval are shared by the active tenants, Interval defaults to one second
+		Rate int
+		Interval time.Duration
+
+		// The weight of each tenant, tenants which are not listed weigh 1. See FairShare.SetWeight.
+		Weights map[string]int
+
+		// Optional, the fewest tokens every Interval an active tenant gets however many tenants there are.
+		MinShare int
+
+		// Optional, how long a tenant stays active after it last took from the limiter, defaults to ten Intervals.
+		Idle time.Duration
+	}
+)
+
+// initialize options with defaults
+func (opts *FairShareOptions) init() (*FairShareOptions, error) {
+	if opts.Storage == nil {
+		opts.Storage = DefaultMemoryStore
+	}
+
+	if opts.Interval <= 0 {
+		opts.Interval = time.Second
+	}
+
+	if opts.Idle <= 0 {
+		opts.Idle = opts.Interval * 10
+	}
+
+	if opts.Rate <= 0 {
+		return nil, errors.New("Fair share limiters require a positive rate.")
+	}
+
+	if opts.MinShare < 0 {
+		return nil, errors.New("The minimum share can't be negative.")
+	}
+
+	for _, weight := range opts.Weights {
+		if weight <= 0 {
+			return nil, errors.New("Weights must be positive.")
+		}
+	}
+
+	return opts, opts.Storage.Ping()
+}
+
+// Create a fair share limiter, it uses in-memory storage unless told otherwise. The storage provider must implement
+// storage.PoolStorage.
+func NewFairShare(options *FairShareOptions) (*FairShare, error) {
+	options, err := options.init()
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := options.Storage.(storage.PoolStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Fair share limiters need a storage.PoolStorage.", storage.ErrNotSupported)
+	}
+
+	weights := map[string]int{}
+	for tenant, weight := range options.Weights {
+		weights[tenant] = weight
+	}
+
+	pool := storage.Pool{Rate: options.Rate, Interval: options.Interval, MinShare: options.MinShare, Idle: options.Idle}
+	return &FairShare{storage: store, Name: options.Name, pool: pool, weights: weights}, nil
+}
+
+// Change the weight of a tenant, it takes effect from the tenant's next take. Every node sharing the limiter should
+// agree on the weights, otherwise the weight a tenant last took with is the one that counts.
+func (limiter *FairShare) SetWeight(tenant string, weight int) error {
+	if weight <= 0 {
+		return errors.New("Weights must be positive.")
+	}
+
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.weights[tenant] = weight
+	return nil
+}
+
+func (limiter *FairShare) weight(tenant string) int {
+	limiter.mutex.RLock()
+	defer limiter.mutex.RUnlock()
+
+	if weight, ok := limiter.weights[tenant]; ok {
+		return weight
+	}
+
+	return 1
+}
+
+// Take tokens from the tenant's share. The decision's Limit is the tenant's share as it stands.
+func (limiter *FairShare) Take(tenant string, tokens int) (storage.Decision, error) {
+	return limiter.TakeContext(context.Background(), tenant, tokens)
+}
+
+func (limiter *FairShare) TakeContext(ctx context.Context, tenant string, tokens int) (storage.Decision, error) {
+	return limiter.storage.TakeShare(ctx, limiter.Name, tenant, limiter.weight(tenant), tokens, limiter.pool)
+}
+
+// Take a single token from the tenant's share.
+func (limiter *FairShare) Allow(tenant string) (storage.Decision, error) {
+	return limiter.AllowContext(context.Background(), tenant)
+}
+
+func (limiter *FairShare) AllowContext(ctx context.Context, tenant string) (storage.Decision, error) {
+	return limiter.TakeContext(ctx, tenant, 1)
+}
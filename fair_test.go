@@ -0,0 +1,76 @@
+package bucket_test
+
+import (
+	"errors"
+	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestFairShare(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("active tenants share the rate by weight", func(t *testing.T) {
+			limiter, err := tb.NewFairShare(&tb.FairShareOptions{
+				Name: MockBucketName(),
+				Rate: 12,
+				Interval: time.Minute,
+				Weights: map[string]int{ "big": 2 },
+				Idle: time.Millisecond * 200,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a fair share limiter")
+
+			decision, err := limiter.Take("big", 1)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.True(decision.Allowed, "a lone tenant should have tokens")
+			asserts.Equal(12, decision.Limit, "a lone tenant should have the whole rate")
+			asserts.Equal(11, decision.Remaining, "the take should come out of the tenant's share")
+
+			decision, err = limiter.Take("small", 1)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.Equal(4, decision.Limit, "a tenant of weight 1 should get a third")
+
+			decision, err = limiter.Take("big", 1)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.Equal(8, decision.Limit, "a tenant of weight 2 should get two thirds")
+			asserts.Equal(7, decision.Remaining, "the tenant's tokens should be cut down to its new share")
+
+			// keep big active while small goes idle
+			time.Sleep(time.Millisecond * 120)
+			_, err = limiter.Take("big", 1)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			time.Sleep(time.Millisecond * 120)
+
+			decision, err = limiter.Take("big", 1)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.Equal(12, decision.Limit, "an idle tenant's share should go to the active ones")
+
+			decision, err = limiter.Take("big", 6)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.False(decision.Allowed, "a tenant should not take past its tokens")
+		})
+	}
+
+	t.Run("weights must be positive", func(t *testing.T) {
+		_, err := tb.NewFairShare(&tb.FairShareOptions{ Name: MockBucketName(), Rate: 10, Weights: map[string]int{ "a": 0 } })
+		asserts.NotNil(err, "tb.NewFairShare should return an error")
+
+		limiter, err := tb.NewFairShare(&tb.FairShareOptions{ Name: MockBucketName(), Rate: 10 })
+		asserts.Nil(err, "Failed to create a fair share limiter")
+
+		err = limiter.SetWeight("a", -1)
+		asserts.NotNil(err, "limiter.SetWeight should return an error")
+	})
+
+	t.Run("a fair share limiter needs a storage.PoolStorage", func(t *testing.T) {
+		_, err := tb.NewFairShare(&tb.FairShareOptions{ Name: MockBucketName(), Rate: 10, Storage: pollingStorage{ &storage.MemoryStorage{} } })
+		asserts.True(errors.Is(err, storage.ErrNotSupported), "tb.NewFairShare should return ErrNotSupported")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,58 @@
+package bucket
+
+import (
+	"context"
+	"fmt"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * fixed.go provides a fixed window limiter, it allows a number of tokens per window of time such as per minute.
+ *
+ * Every window is its own key, derived from the limiter name, the key and the start of the window. Keys expire along
+ * with their window, with EXPIRE in redis and a background sweeper for MemoryStorage. It is the cheapest limiter
+ * there is but up to twice the limit may get through around the edge of a window, see window.go if that matters.
+ */
+
+type FixedWindow struct {
+	storage storage.FixedWindowStorage
+
+	// the name of the limiter, it prefixes every key so that limiters may share storage
+	Name string
+
+	window storage.Window
+}
+
+// Create a fixed window limiter, it uses in-memory storage unless told otherwise. The storage provider must implement
+// storage.FixedWindowStorage.
+func NewFixedWindow(options *WindowOptions) (*FixedWindow, error) {
+	options, err := options.init()
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := options.Storage.(storage.FixedWindowStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Fixed windows need a storage.FixedWindowStorage.", storage.ErrNotSupported)
+	}
+
+	return &FixedWindow{storage: store, Name: options.Name, window: storage.Window{Limit: options.Limit, Length: options.Window}}, nil
+}
+
+// Take tokens from the given key if the current window has room for them.
+func (limiter *FixedWindow) Take(key string, tokens int) (storage.Decision, error) {
+	return limiter.TakeContext(context.Background(), key, tokens)
+}
+
+func (limiter *FixedWindow) TakeContext(ctx context.Context, key string, tokens int) (storage.Decision, error) {
+	return limiter.storage.TakeFixed(ctx, limiter.Name + ":" + key, tokens, limiter.window)
+}
+
+// Take a single token from the given key.
+func (limiter *FixedWindow) Allow(key string) (storage.Decision, error) {
+	return limiter.AllowContext(context.Background(), key)
+}
+
+func (limiter *FixedWindow) AllowContext(ctx context.Context, key string) (storage.Decision, error) {
+	return limiter.TakeContext(ctx, key, 1)
+}
@@ -0,0 +1,97 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * gcra.go provides a limiter built on the generic cell rate algorithm (GCRA).
+ *
+ * Rather then a token value the limiter stores a single timestamp per key, the theoretical arrival time of the next
+ * request. Requests are spaced evenly at Rate per Period and up to Burst requests may arrive at once on top of that.
+ * One limiter serves any number of keys, for example one per IP address, and each key costs a single integer.
+ */
+
+type (
+	GCRA struct {
+		storage storage.GCRAStorage
+
+		// the name of the limiter, it prefixes every key so that limiters may share storage
+		Name string
+
+		limit storage.GCRA
+	}
+
+	GCRAOptions struct {
+		Storage storage.Storage
+		Name string
+
+		// the number of requests allowed at once on top of the steady rate
+		Burst int
+
+		// Rate requests are allowed every Period, Period defaults to one second
+		Rate int
+		Period time.Duration
+	}
+)
+
+// Create a GCRA limiter, it uses in-memory storage unless told otherwise. The storage provider must implement
+// storage.GCRAStorage.
+func NewGCRA(options *GCRAOptions) (*GCRA, error) {
+	if options.Storage == nil {
+		options.Storage = DefaultMemoryStore
+	}
+
+	if options.Period <= 0 {
+		options.Period = time.Second
+	}
+
+	if options.Rate <= 0 || options.Burst < 0 {
+		return nil, errors.New("GCRA requires a positive rate and a burst of at least 0.")
+	}
+
+	// the storage providers keep time in microseconds, see storage.GCRA
+	if options.Period / time.Duration(options.Rate) < time.Microsecond {
+		return nil, errors.New("GCRA can't space requests less then a microsecond apart.")
+	}
+
+	store, ok := options.Storage.(storage.GCRAStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w GCRA needs a storage.GCRAStorage.", storage.ErrNotSupported)
+	}
+
+	if err := options.Storage.Ping(); err != nil {
+		return nil, err
+	}
+
+	limiter := &GCRA{
+		storage: store,
+		Name: options.Name,
+		limit: storage.GCRA{Burst: options.Burst, Rate: options.Rate, Period: options.Period},
+	}
+
+	return limiter, nil
+}
+
+// Take quantity from the given key. A request which is not allowed is not an error, check Decision.Allowed and use
+// Decision.RetryAfter to tell the client when to come back.
+func (limiter *GCRA) Take(key string, quantity int) (storage.Decision, error) {
+	return limiter.TakeContext(context.Background(), key, quantity)
+}
+
+func (limiter *GCRA) TakeContext(ctx context.Context, key string, quantity int) (storage.Decision, error) {
+	return limiter.storage.Throttle(ctx, limiter.Name + ":" + key, quantity, limiter.limit)
+}
+
+// Take a single request from the given key.
+func (limiter *GCRA) Allow(key string) (storage.Decision, error) {
+	return limiter.AllowContext(context.Background(), key)
+}
+
+func (limiter *GCRA) AllowContext(ctx context.Context, key string) (storage.Decision, error) {
+	return limiter.TakeContext(ctx, key, 1)
+}
@@ -0,0 +1,74 @@
+package bucket_test
+
+import (
+	tb "github.com/b3ntly/bucket"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGCRA(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("GCRA allows a burst then spaces requests evenly", func(t *testing.T) {
+			limiter, err := tb.NewGCRA(&tb.GCRAOptions{
+				Name: MockBucketName(),
+				Burst: 2,
+				Rate: 10,
+				Period: time.Millisecond * 200,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a GCRA limiter")
+
+			for i := 0; i < 3; i++ {
+				decision, err := limiter.Allow("127.0.0.1")
+				asserts.Nil(err, "limiter.Allow should not return an error")
+				asserts.True(decision.Allowed, "burst should be allowed")
+				asserts.Equal(3, decision.Limit, "limit should be burst + 1")
+				asserts.Equal(2 - i, decision.Remaining, "remaining should count down")
+			}
+
+			decision, err := limiter.Allow("127.0.0.1")
+			asserts.Nil(err, "limiter.Allow should not return an error")
+			asserts.False(decision.Allowed, "request past the burst should be limited")
+			asserts.True(decision.RetryAfter > 0 && decision.RetryAfter <= time.Millisecond * 20, "retry after should be at most one emission interval")
+			retryAfter := decision.RetryAfter
+
+			decision, err = limiter.Allow("127.0.0.2")
+			asserts.Nil(err, "limiter.Allow should not return an error")
+			asserts.True(decision.Allowed, "keys should be limited independently")
+
+			time.Sleep(retryAfter + time.Millisecond * 5)
+
+			decision, err = limiter.Allow("127.0.0.1")
+			asserts.Nil(err, "limiter.Allow should not return an error")
+			asserts.True(decision.Allowed, "request should be allowed after waiting")
+		})
+
+		t.Run("GCRA never allows more then the burst at once", func(t *testing.T) {
+			limiter, err := tb.NewGCRA(&tb.GCRAOptions{ Name: MockBucketName(), Burst: 1, Rate: 1, Storage: store })
+			asserts.Nil(err, "Failed to create a GCRA limiter")
+
+			decision, err := limiter.Take("key", 3)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.False(decision.Allowed, "quantity above the limit should never be allowed")
+			asserts.Equal(time.Duration(-1), decision.RetryAfter, "retry after should be -1")
+		})
+	}
+
+	t.Run("GCRA refuses a rate it can't space out", func(t *testing.T) {
+		_, err := tb.NewGCRA(&tb.GCRAOptions{ Name: MockBucketName(), Rate: 2000000, Storage: MockStorage()[1] })
+		asserts.NotNil(err, "requests less then a microsecond apart should be refused")
+
+		limiter, err := tb.NewGCRA(&tb.GCRAOptions{ Name: MockBucketName(), Rate: 1000000, Storage: MockStorage()[1] })
+		asserts.Nil(err, "requests a microsecond apart should be allowed")
+
+		decision, err := limiter.Take("key", 1)
+		asserts.Nil(err, "limiter.Take should not return an error")
+		asserts.True(decision.Allowed, "the first request should be allowed")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,74 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * group.go takes from several buckets at once, all or nothing. Charging a request against a per-user, a per-tenant and
+ * a global bucket with three calls to Take leaks tokens whenever a later call fails, a group never does.
+ */
+
+type Group struct {
+	storage storage.GroupStorage
+	buckets []*Bucket
+}
+
+// Group buckets to take from together. The buckets must share a storage provider, which must implement
+// storage.GroupStorage. Buckets with a parent can't be grouped since the group would take from them without charging
+// their parents or their ceilings, see hierarchy.go.
+func NewGroup(buckets ...*Bucket) (*Group, error) {
+	if len(buckets) == 0 {
+		return nil, errors.New("A group needs at least one bucket.")
+	}
+
+	for _, bucket := range buckets {
+		if bucket.storage != buckets[0].storage {
+			return nil, errors.New("Buckets in a group must share a storage provider.")
+		}
+
+		if bucket.parent != nil {
+			return nil, errors.New("Buckets with a parent can't be grouped.")
+		}
+	}
+
+	store, ok := buckets[0].storage.(storage.GroupStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Groups need a storage.GroupStorage.", storage.ErrNotSupported)
+	}
+
+	return &Group{storage: store, buckets: buckets}, nil
+}
+
+// Take tokens from every bucket in the group if they all have enough, otherwise return storage.ErrInsufficientTokens
+// and leave every bucket alone.
+func (group *Group) Take(tokens int) error {
+	return group.TakeContext(context.Background(), tokens)
+}
+
+func (group *Group) TakeContext(ctx context.Context, tokens int) error {
+	decisions, err := group.TakeNContext(ctx, tokens)
+	if err == nil && !decisions[0].Allowed {
+		return storage.ErrInsufficientTokens
+	}
+
+	return err
+}
+
+// Take tokens from every bucket in the group if they all have enough and describe each bucket afterwards, in the order
+// the buckets were grouped. See bucket.TakeN and storage.GroupStorage.
+func (group *Group) TakeN(tokens int) ([]storage.Decision, error) {
+	return group.TakeNContext(context.Background(), tokens)
+}
+
+func (group *Group) TakeNContext(ctx context.Context, tokens int) ([]storage.Decision, error) {
+	withdrawals := make([]storage.Withdrawal, len(group.buckets))
+	for i, bucket := range group.buckets {
+		withdrawals[i] = storage.Withdrawal{Name: bucket.Name, Tokens: tokens, Refill: bucket.refill()}
+	}
+
+	return group.storage.TakeGroup(ctx, withdrawals)
+}
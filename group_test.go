@@ -0,0 +1,74 @@
+package bucket_test
+
+import (
+	"errors"
+	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("group.Take takes from every bucket or from none", func(t *testing.T) {
+			var buckets []*tb.Bucket
+			for _, capacity := range []int{ 10, 10, 4 } {
+				bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: capacity, Storage: store })
+				asserts.Nil(err, "Failed to create a bucket for the group test")
+				buckets = append(buckets, bucket)
+			}
+
+			group, err := tb.NewGroup(buckets...)
+			asserts.Nil(err, "tb.NewGroup should not return an error")
+
+			err = group.Take(3)
+			asserts.Nil(err, "group.Take should not return an error")
+
+			err = group.Take(3)
+			asserts.Equal(storage.ErrInsufficientTokens, err, "group.Take should return ErrInsufficientTokens")
+
+			for i, expected := range []int{ 7, 7, 1 } {
+				count, err := buckets[i].Count()
+				asserts.Nil(err, "bucket.Count should not return an error")
+				asserts.Equal(expected, count, "a refused group should leave every bucket alone")
+			}
+		})
+	}
+
+	t.Run("the buckets in a group must share a storage provider", func(t *testing.T) {
+		stores := MockStorage()
+		first, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: stores[0] })
+		asserts.Nil(err, "Failed to create a bucket for the group test")
+		second, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: stores[1] })
+		asserts.Nil(err, "Failed to create a bucket for the group test")
+
+		_, err = tb.NewGroup(first, second)
+		asserts.NotNil(err, "tb.NewGroup should return an error")
+	})
+
+	t.Run("buckets with a parent can't be grouped", func(t *testing.T) {
+		store := &storage.MemoryStorage{}
+		parent, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Rate: 10, Interval: time.Minute, Storage: store })
+		asserts.Nil(err, "Failed to create the parent bucket")
+
+		child, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 2, Rate: 2, Interval: time.Minute, Storage: store, Parent: parent, Ceiling: 5 })
+		asserts.Nil(err, "Failed to create a child bucket")
+
+		_, err = tb.NewGroup(parent, child)
+		asserts.NotNil(err, "tb.NewGroup should refuse a bucket with a parent")
+	})
+
+	t.Run("a group needs a storage.GroupStorage", func(t *testing.T) {
+		bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: pollingStorage{ &storage.MemoryStorage{} } })
+		asserts.Nil(err, "Failed to create a bucket for the group test")
+
+		_, err = tb.NewGroup(bucket)
+		asserts.True(errors.Is(err, storage.ErrNotSupported), "tb.NewGroup should return ErrNotSupported")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,160 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/b3ntly/bucket/storage"
+	"time"
+)
+
+/**
+ * hierarchy.go lets buckets borrow from a parent, much like classes in the Linux HTB qdisc. A vendor quota might be the
+ * parent bucket with a child bucket for every team, each team is guaranteed its own rate and an idle team's share goes
+ * to whichever team is busy.
+ *
+ * A take from a child is tried against the child's own tokens first and then against each ancestor in turn for as long
+ * as the buckets on the way up may borrow. Every try is a single group take (see group.go): the lender must have the
+ * tokens and so must the ceiling of every bucket borrowing on the way down, while every bucket above the lender is
+ * charged whether it has the tokens or not. Charging the parent for a child's guaranteed tokens can leave the parent
+ * owing tokens, which is what keeps the other children from borrowing more then the parent really has.
+ *
+ * A ceiling is a bucket of its own, named after the bucket like its state is (see storage.StateKey) so that it hashes
+ * to the same Redis Cluster node, which refills Ceiling tokens every Interval and is charged for every take from the
+ * bucket.
+ */
+
+// Make sure a bucket fits under its parent.
+func (bucket *Bucket) checkParent() error {
+	if bucket.parent == nil {
+		if bucket.ceiling > 0 {
+			return errors.New("Only buckets with a parent can borrow.")
+		}
+
+		return nil
+	}
+
+	if bucket.parent.storage != bucket.storage {
+		return errors.New("A bucket must share its parent's storage provider.")
+	}
+
+	if _, ok := bucket.storage.(storage.GroupStorage); !ok {
+		return fmt.Errorf("%w Buckets with a parent need a storage.GroupStorage.", storage.ErrNotSupported)
+	}
+
+	if bucket.sharedQueue {
+		return errors.New("Buckets with a parent can't share a queue.")
+	}
+
+	if bucket.ceiling > 0 && bucket.rate <= 0 {
+		return errors.New("Only buckets with a rate can have a ceiling.")
+	}
+
+	if bucket.ceiling > 0 && bucket.ceiling < bucket.rate {
+		return errors.New("The ceiling must be at least the rate.")
+	}
+
+	return nil
+}
+
+// The bucket followed by its parent, its parent's parent and so on.
+func (bucket *Bucket) lineage() []*Bucket {
+	var lineage []*Bucket
+	for b := bucket; b != nil; b = b.parent {
+		lineage = append(lineage, b)
+	}
+
+	return lineage
+}
+
+func (bucket *Bucket) withdrawal(tokens int, force bool) storage.Withdrawal {
+	return storage.Withdrawal{Name: bucket.Name, Tokens: tokens, Refill: bucket.refill(), Force: force}
+}
+
+func (bucket *Bucket) ceilingWithdrawal(tokens int, force bool) storage.Withdrawal {
+	refill := storage.Refill{Capacity: bucket.ceiling, Rate: bucket.ceiling, Interval: bucket.interval}
+	return storage.Withdrawal{Name: storage.StateKey(bucket.Name, "ceiling"), Tokens: tokens, Refill: refill, Force: force}
+}
+
+// The withdrawals for taking tokens from lineage[lender], the lender's own withdrawal comes first.
+func borrow(lineage []*Bucket, lender int, tokens int) []storage.Withdrawal {
+	withdrawals := []storage.Withdrawal{lineage[lender].withdrawal(tokens, false)}
+
+	for i, b := range lineage {
+		switch {
+		case i < lender:
+			withdrawals = append(withdrawals, b.ceilingWithdrawal(tokens, false))
+		case i > lender:
+			withdrawals = append(withdrawals, b.withdrawal(tokens, true))
+		}
+
+		if i >= lender && b.ceiling > 0 {
+			withdrawals = append(withdrawals, b.ceilingWithdrawal(tokens, true))
+		}
+	}
+
+	return withdrawals
+}
+
+// Take tokens from the bucket or borrow them from an ancestor. A take served by the bucket's own tokens describes the
+// bucket, a borrowed one describes the ancestor it was borrowed from. A refused take describes the bucket but with the
+// RetryAfter of whichever try would succeed soonest.
+func (bucket *Bucket) takeLineage(ctx context.Context, tokens int) (storage.Decision, error) {
+	store := bucket.storage.(storage.GroupStorage)
+	lineage := bucket.lineage()
+
+	var refused storage.Decision
+
+	for lender := range lineage {
+		decisions, err := store.TakeGroup(ctx, borrow(lineage, lender, tokens))
+		if err != nil {
+			return storage.Decision{}, err
+		}
+
+		if decisions[0].Allowed {
+			return decisions[0], nil
+		}
+
+		// the try could go ahead once the last of the buckets which must have the tokens does, forced withdrawals never
+		// hold it up
+		retry := decisions[0].RetryAfter
+		for _, decision := range decisions[1:lender + 1] {
+			retry = later(retry, decision.RetryAfter)
+		}
+
+		if lender == 0 {
+			refused = decisions[0]
+		}
+
+		refused.RetryAfter = sooner(refused.RetryAfter, retry)
+
+		// a bucket without a ceiling doesn't borrow
+		if lineage[lender].ceiling <= 0 {
+			break
+		}
+	}
+
+	return refused, nil
+}
+
+// the sooner of two waits where -1 means never
+func sooner(a, b time.Duration) time.Duration {
+	if a < 0 || (b >= 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+// the later of two waits where -1 means never
+func later(a, b time.Duration) time.Duration {
+	if a < 0 || b < 0 {
+		return -1
+	}
+
+	if b > a {
+		return b
+	}
+
+	return a
+}
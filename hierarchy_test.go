@@ -0,0 +1,118 @@
+package bucket_test
+
+import (
+	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestHierarchy(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("children borrow what their parent has to spare and keep their guarantee", func(t *testing.T) {
+			// a vendor quota of 10 a minute split between two teams
+			vendor, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Rate: 10, Interval: time.Minute, Storage: store })
+			asserts.Nil(err, "Failed to create the parent bucket")
+
+			busy, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 4, Rate: 4, Interval: time.Minute, Storage: store, Parent: vendor, Ceiling: 10 })
+			asserts.Nil(err, "Failed to create a child bucket")
+
+			idle, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 6, Rate: 6, Interval: time.Minute, Storage: store, Parent: vendor })
+			asserts.Nil(err, "Failed to create a child bucket")
+
+			decision, err := busy.TakeN(4)
+			asserts.Nil(err, "bucket.TakeN should not return an error")
+			asserts.True(decision.Allowed, "the busy team should have its own tokens")
+
+			decision, err = busy.TakeN(4)
+			asserts.Nil(err, "bucket.TakeN should not return an error")
+			asserts.True(decision.Allowed, "the busy team should borrow the idle team's share")
+			asserts.Equal(2, decision.Remaining, "the decision should describe the parent it borrowed from")
+
+			// the idle team still gets its guarantee, the vendor bucket ends up owing tokens
+			err = idle.Take(6)
+			asserts.Nil(err, "the idle team should have its own tokens")
+
+			count, err := vendor.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(-4, count, "every take should have been charged to the parent")
+
+			decision, err = busy.TakeN(1)
+			asserts.Nil(err, "bucket.TakeN should not return an error")
+			asserts.False(decision.Allowed, "there should be nothing left to borrow")
+			asserts.True(decision.RetryAfter > 0, "the busy team should be told when its own tokens are back")
+
+			count, err = busy.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(0, count, "a refused take should not touch the bucket")
+		})
+
+		t.Run("a child without a ceiling never borrows", func(t *testing.T) {
+			parent, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Rate: 10, Interval: time.Minute, Storage: store })
+			asserts.Nil(err, "Failed to create the parent bucket")
+
+			child, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 2, Rate: 2, Interval: time.Minute, Storage: store, Parent: parent })
+			asserts.Nil(err, "Failed to create a child bucket")
+
+			err = child.Take(3)
+			asserts.Equal(storage.ErrInsufficientTokens, err, "the child should not borrow")
+
+			count, err := parent.Count()
+			asserts.Nil(err, "bucket.Count should not return an error")
+			asserts.Equal(10, count, "the parent should be untouched")
+		})
+
+		t.Run("a ceiling limits what a child may borrow", func(t *testing.T) {
+			parent, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Rate: 10, Interval: time.Minute, Storage: store })
+			asserts.Nil(err, "Failed to create the parent bucket")
+
+			child, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 2, Rate: 2, Interval: time.Minute, Storage: store, Parent: parent, Ceiling: 5 })
+			asserts.Nil(err, "Failed to create a child bucket")
+
+			err = child.Take(2)
+			asserts.Nil(err, "the child should have its own tokens")
+
+			err = child.Take(3)
+			asserts.Nil(err, "the child should borrow up to its ceiling")
+
+			err = child.Take(1)
+			asserts.Equal(storage.ErrInsufficientTokens, err, "the child should not borrow past its ceiling")
+		})
+	}
+
+	t.Run("a bucket must fit under its parent", func(t *testing.T) {
+		stores := MockStorage()
+		parent, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: stores[0] })
+		asserts.Nil(err, "Failed to create the parent bucket")
+
+		_, err = tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 2, Storage: stores[1], Parent: parent })
+		asserts.NotNil(err, "a child should share its parent's storage provider")
+
+		_, err = tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 2, Rate: 2, Storage: stores[0], Ceiling: 5 })
+		asserts.NotNil(err, "only a child should have a ceiling")
+
+		_, err = tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 2, Rate: 2, Storage: stores[0], Parent: parent, Ceiling: 1 })
+		asserts.NotNil(err, "the ceiling should be at least the rate")
+	})
+
+	t.Run("a ceiling is kept under a key hash tagged with the bucket name", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient }
+		parent, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Rate: 10, Interval: time.Minute, Storage: store })
+		asserts.Nil(err, "Failed to create the parent bucket")
+
+		child, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 2, Rate: 2, Interval: time.Minute, Storage: store, Parent: parent, Ceiling: 5 })
+		asserts.Nil(err, "Failed to create a child bucket")
+
+		asserts.Nil(child.Take(1), "bucket.Take should not return an error")
+
+		exists, err := testClient.Exists("{" + child.Name + "}:ceiling").Result()
+		asserts.Nil(err, "client.Exists should not return an error")
+		asserts.Equal(int64(1), exists, "the ceiling should hash like the bucket")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,113 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * leaky.go provides a leaky bucket which delays requests rather then rejecting them, in the style of nginx's
+ * limit_req.
+ *
+ * Requests join a queue which drains at a constant rate and are released one at a time as it does. Only when Burst
+ * requests are already waiting is a request rejected. With NoDelay queued requests go ahead straight away but still
+ * take up room in the queue until it drains, which smooths bursts without adding latency.
+ *
+ * The depth of the queue lives in storage so several nodes may drain one logical queue.
+ */
+
+type (
+	LeakyBucket struct {
+		storage storage.LeakyStorage
+
+		// the name of the bucket, it prefixes every key so that buckets may share storage
+		Name string
+
+		leak storage.Leak
+	}
+
+	LeakyOptions struct {
+		Storage storage.Storage
+		Name string
+
+		// the queue drains at Rate requests every Interval, Interval defaults to one second
+		Rate int
+		Interval time.Duration
+
+		// the number of requests which may wait in the queue
+		Burst int
+
+		// release queued requests immediately rather then when the queue drains to them
+		NoDelay bool
+	}
+)
+
+// Create a leaky bucket, it uses in-memory storage unless told otherwise. The storage provider must implement
+// storage.LeakyStorage.
+func NewLeakyBucket(options *LeakyOptions) (*LeakyBucket, error) {
+	if options.Storage == nil {
+		options.Storage = DefaultMemoryStore
+	}
+
+	if options.Interval <= 0 {
+		options.Interval = time.Second
+	}
+
+	if options.Rate <= 0 || options.Burst < 0 {
+		return nil, errors.New("Leaky buckets require a positive rate and a burst of at least 0.")
+	}
+
+	store, ok := options.Storage.(storage.LeakyStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Leaky buckets need a storage.LeakyStorage.", storage.ErrNotSupported)
+	}
+
+	if err := options.Storage.Ping(); err != nil {
+		return nil, err
+	}
+
+	leak := storage.Leak{Rate: options.Rate, Interval: options.Interval, Burst: options.Burst, NoDelay: options.NoDelay}
+	return &LeakyBucket{storage: store, Name: options.Name, leak: leak}, nil
+}
+
+// Join the queue for the given key. If the request was allowed the caller should wait Decision.Delay before going
+// ahead, if it was not the queue is full.
+func (lb *LeakyBucket) Take(key string, requests int) (storage.Decision, error) {
+	return lb.TakeContext(context.Background(), key, requests)
+}
+
+func (lb *LeakyBucket) TakeContext(ctx context.Context, key string, requests int) (storage.Decision, error) {
+	return lb.storage.Leak(ctx, lb.Name + ":" + key, requests, lb.leak)
+}
+
+// Join the queue for the given key and sleep until the request is released. It returns storage.ErrQueueFull if the
+// queue is full.
+func (lb *LeakyBucket) Wait(key string) (storage.Decision, error) {
+	return lb.WaitContext(context.Background(), key)
+}
+
+// Like Wait but stops sleeping and returns ctx.Err() once ctx is done. The request keeps its place in the queue
+// regardless, there is no taking it back out.
+func (lb *LeakyBucket) WaitContext(ctx context.Context, key string) (storage.Decision, error) {
+	decision, err := lb.TakeContext(ctx, key, 1)
+	if err != nil {
+		return decision, err
+	}
+
+	if !decision.Allowed {
+		return decision, storage.ErrQueueFull
+	}
+
+	timer := time.NewTimer(decision.Delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return decision, nil
+	case <-ctx.Done():
+		return decision, ctx.Err()
+	}
+}
@@ -0,0 +1,94 @@
+package bucket_test
+
+import (
+	"context"
+	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestLeakyBucket(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("leaky bucket delays requests and rejects them once the queue is full", func(t *testing.T) {
+			lb, err := tb.NewLeakyBucket(&tb.LeakyOptions{
+				Name: MockBucketName(),
+				Rate: 10,
+				Interval: time.Second,
+				Burst: 2,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a leaky bucket")
+
+			delays := []time.Duration{}
+			for i := 0; i < 3; i++ {
+				decision, err := lb.Take("key", 1)
+				asserts.Nil(err, "lb.Take should not return an error")
+				asserts.True(decision.Allowed, "requests within the burst should be queued")
+				delays = append(delays, decision.Delay)
+			}
+
+			asserts.Equal(time.Duration(0), delays[0], "the first request should not be delayed")
+			asserts.True(delays[1] > 0 && delays[1] <= time.Millisecond * 100, "the second request should wait one period")
+			asserts.True(delays[2] > delays[1], "later requests should wait longer")
+
+			decision, err := lb.Take("key", 1)
+			asserts.Nil(err, "lb.Take should not return an error")
+			asserts.False(decision.Allowed, "a request past the burst should be rejected")
+			asserts.True(decision.RetryAfter > 0, "retry after should be positive")
+
+			_, err = lb.Wait("key")
+			asserts.Equal(storage.ErrQueueFull, err, "lb.Wait should return storage.ErrQueueFull when the queue is full")
+		})
+
+		t.Run("lb.WaitContext stops waiting once the context is done", func(t *testing.T) {
+			lb, err := tb.NewLeakyBucket(&tb.LeakyOptions{
+				Name: MockBucketName(),
+				Rate: 1,
+				Burst: 2,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a leaky bucket")
+
+			_, err = lb.Wait("key")
+			asserts.Nil(err, "the first request should go ahead straight away")
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+			defer cancel()
+
+			start := time.Now()
+			decision, err := lb.WaitContext(ctx, "key")
+			asserts.Equal(context.DeadlineExceeded, err, "lb.WaitContext should return ctx.Err()")
+			asserts.True(decision.Delay > time.Millisecond * 900, "the request should have been delayed a whole period")
+			asserts.True(time.Since(start) < time.Millisecond * 500, "lb.WaitContext should return at the deadline")
+		})
+
+		t.Run("leaky bucket with nodelay admits queued requests immediately", func(t *testing.T) {
+			lb, err := tb.NewLeakyBucket(&tb.LeakyOptions{
+				Name: MockBucketName(),
+				Rate: 1,
+				Burst: 3,
+				NoDelay: true,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a leaky bucket")
+
+			for i := 0; i < 4; i++ {
+				decision, err := lb.Wait("key")
+				asserts.Nil(err, "lb.Wait should not return an error")
+				asserts.Equal(time.Duration(0), decision.Delay, "requests should not be delayed")
+				asserts.Equal(3 - i, decision.Remaining, "room in the queue should count down")
+			}
+
+			decision, err := lb.Take("key", 1)
+			asserts.Nil(err, "lb.Take should not return an error")
+			asserts.False(decision.Allowed, "a request past the burst should be rejected")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,103 @@
+package bucket
+
+import "sync"
+
+// The class of a waiter in a bucket's queue, see bucket.WaitPriority. Waiters of a lower class are only served once no
+// waiter of a higher class is left, waiters of the same class are served in the order they arrived.
+type Priority int
+
+const (
+	Interactive Priority = iota
+	Normal
+	Batch
+)
+
+// Waiters for a bucket, in the order they should be served. Only the head of the queue tries to take tokens so a
+// large request is never starved by a stream of small ones arriving after it.
+type waitQueue struct {
+	mutex sync.Mutex
+	classes [Batch + 1][]*waiter
+}
+
+type waiter struct {
+	priority Priority
+
+	// receives when the waiter may have become the head of the queue
+	wake chan struct{}
+}
+
+// Add a waiter to the back of its class.
+func (queue *waitQueue) join(priority Priority) *waiter {
+	if priority < Interactive {
+		priority = Interactive
+	}
+
+	if priority > Batch {
+		priority = Batch
+	}
+
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	w := &waiter{priority: priority, wake: make(chan struct{}, 1)}
+	queue.classes[priority] = append(queue.classes[priority], w)
+	queue.wakeHead()
+
+	return w
+}
+
+// Remove a waiter from wherever it is in the queue, whether it was served or gave up.
+func (queue *waitQueue) leave(w *waiter) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	class := queue.classes[w.priority]
+	for i, other := range class {
+		if other == w {
+			queue.classes[w.priority] = append(class[:i:i], class[i+1:]...)
+			break
+		}
+	}
+
+	queue.wakeHead()
+}
+
+func (queue *waitQueue) isHead(w *waiter) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	return queue.head() == w
+}
+
+func (queue *waitQueue) depth() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	depth := 0
+	for _, class := range queue.classes {
+		depth += len(class)
+	}
+
+	return depth
+}
+
+// The caller must hold the lock.
+func (queue *waitQueue) head() *waiter {
+	for _, class := range queue.classes {
+		if len(class) > 0 {
+			return class[0]
+		}
+	}
+
+	return nil
+}
+
+// Tell the head of the queue it's their turn without blocking. The caller must hold the lock.
+func (queue *waitQueue) wakeHead() {
+	if head := queue.head(); head != nil {
+		select {
+		case head.wake <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package bucket_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	tb "github.com/b3ntly/bucket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitQueue(t *testing.T) {
+	asserts := assert.New(t)
+
+	// start a waiter which sends its name to served once it is served
+	wait := func(bucket *tb.Bucket, ctx context.Context, name string, tokens int, priority tb.Priority, served chan string) {
+		go func() {
+			if _, err := bucket.WaitPriority(ctx, tokens, priority); err == nil {
+				served <- name
+			}
+		}()
+
+		// give the waiter time to join the queue so the order is known
+		for depth := bucket.QueueDepth(); bucket.QueueDepth() == depth; {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for _, store := range MockStorage() {
+		t.Run("waiters are served first come first served even if a later one could be served sooner", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 0, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for the queue test")
+
+			served := make(chan string, 2)
+			wait(bucket, context.Background(), "large", 5, tb.Normal, served)
+			wait(bucket, context.Background(), "small", 1, tb.Normal, served)
+			asserts.Equal(2, bucket.QueueDepth(), "both waiters should be queued")
+
+			err = bucket.Put(1)
+			asserts.Nil(err, "bucket.Put should not return an error")
+
+			select {
+			case name := <-served:
+				asserts.Fail("no waiter should be served before the head of the queue", name)
+			case <-time.After(time.Millisecond * 100):
+			}
+
+			err = bucket.Put(5)
+			asserts.Nil(err, "bucket.Put should not return an error")
+			asserts.Equal("large", <-served, "the head of the queue should be served first")
+			asserts.Equal("small", <-served, "the next waiter should be served with what is left")
+		})
+
+		t.Run("higher priority classes are served first", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 0, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for the queue test")
+
+			served := make(chan string, 3)
+			wait(bucket, context.Background(), "batch", 1, tb.Batch, served)
+			wait(bucket, context.Background(), "normal", 1, tb.Normal, served)
+			wait(bucket, context.Background(), "interactive", 1, tb.Interactive, served)
+
+			for _, expected := range []string{ "interactive", "normal", "batch" } {
+				err = bucket.Put(1)
+				asserts.Nil(err, "bucket.Put should not return an error")
+				asserts.Equal(expected, <-served, "waiters should be served by class")
+			}
+		})
+
+		t.Run("a waiter which gives up leaves the queue", func(t *testing.T) {
+			bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 0, Storage: store })
+			asserts.Nil(err, "Failed to create a bucket for the queue test")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			served := make(chan string, 2)
+			wait(bucket, ctx, "impatient", 5, tb.Normal, served)
+			wait(bucket, context.Background(), "patient", 1, tb.Normal, served)
+
+			cancel()
+			for bucket.QueueDepth() != 1 {
+				time.Sleep(time.Millisecond)
+			}
+
+			err = bucket.Put(1)
+			asserts.Nil(err, "bucket.Put should not return an error")
+			asserts.Equal("patient", <-served, "the waiter behind should move up")
+			asserts.Equal(0, bucket.QueueDepth(), "the queue should be empty")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,182 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * semaphore.go provides a counting semaphore for limiting how many jobs run at once. Taking a token from a bucket
+ * before a job and putting it back afterwards leaks the token for good when the process crashes in between, the
+ * slots of a semaphore are leased instead and a lease which is not renewed in time is reclaimed.
+ *
+ * Every lease comes with a fencing token, see storage.SemaphoreStorage.
+ */
+
+type (
+	Semaphore struct {
+		storage storage.SemaphoreStorage
+
+		// the name of the semaphore, may have implications for certain storage providers
+		Name string
+
+		limit int
+		ttl time.Duration
+		pollInterval time.Duration
+	}
+
+	SemaphoreOptions struct {
+		Storage storage.Storage
+		Name string
+
+		// the number of leases which may be held at once
+		Limit int
+
+		// Optional, how long a lease lasts unless it is renewed, defaults to 30 seconds.
+		TTL time.Duration
+
+		// Optional, how often semaphore.Acquire checks for a free slot at most, defaults to 50ms.
+		PollInterval time.Duration
+	}
+
+	// A slot of a semaphore, held until it is released or runs out.
+	Lease struct {
+		semaphore *Semaphore
+
+		// unique to the lease
+		ID string
+
+		// greater then the fence of every lease granted before this one by the same semaphore
+		Fence int64
+	}
+)
+
+// initialize options with defaults
+func (opts *SemaphoreOptions) init() (*SemaphoreOptions, error) {
+	if opts.Storage == nil {
+		opts.Storage = DefaultMemoryStore
+	}
+
+	if opts.TTL <= 0 {
+		opts.TTL = time.Second * 30
+	}
+
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Millisecond * 50
+	}
+
+	if opts.Limit <= 0 {
+		return nil, errors.New("Semaphores require a positive limit.")
+	}
+
+	return opts, opts.Storage.Ping()
+}
+
+// Create a semaphore, it uses in-memory storage unless told otherwise. The storage provider must implement
+// storage.SemaphoreStorage.
+func NewSemaphore(options *SemaphoreOptions) (*Semaphore, error) {
+	options, err := options.init()
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := options.Storage.(storage.SemaphoreStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Semaphores need a storage.SemaphoreStorage.", storage.ErrNotSupported)
+	}
+
+	return &Semaphore{storage: store, Name: options.Name, limit: options.Limit, ttl: options.TTL, pollInterval: options.PollInterval}, nil
+}
+
+// Lease a slot if one is free, otherwise return storage.ErrInsufficientTokens.
+func (sem *Semaphore) TryAcquire() (*Lease, error) {
+	return sem.TryAcquireContext(context.Background())
+}
+
+func (sem *Semaphore) TryAcquireContext(ctx context.Context) (*Lease, error) {
+	lease, _, err := sem.acquire(ctx)
+	return lease, err
+}
+
+func (sem *Semaphore) acquire(ctx context.Context) (*Lease, storage.Decision, error) {
+	id := storage.NewTicketID()
+
+	fence, decision, err := sem.storage.Acquire(ctx, sem.Name, id, sem.limit, sem.ttl)
+	if err != nil {
+		return nil, decision, err
+	}
+
+	if !decision.Allowed {
+		return nil, decision, storage.ErrInsufficientTokens
+	}
+
+	return &Lease{semaphore: sem, ID: id, Fence: fence}, decision, nil
+}
+
+// Block until a slot is free and lease it, or until ctx is done in which case ctx.Err() is returned. Slots are checked
+// for whenever the first lease would run out and every PollInterval in case one is released before then.
+func (sem *Semaphore) Acquire(ctx context.Context) (*Lease, error) {
+	for {
+		lease, decision, err := sem.acquire(ctx)
+		if !errors.Is(err, storage.ErrInsufficientTokens) {
+			return lease, err
+		}
+
+		wait := sem.pollInterval
+		if decision.RetryAfter >= 0 && decision.RetryAfter < wait {
+			wait = decision.RetryAfter
+		}
+
+		timer := time.NewTimer(wait)
+
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Extend the lease to the TTL of the semaphore from now. Returns storage.ErrLeaseExpired if the lease has already been
+// released or ran out, in which case the holder should stop whatever it was doing with it.
+func (lease *Lease) Renew() error {
+	return lease.RenewContext(context.Background())
+}
+
+func (lease *Lease) RenewContext(ctx context.Context) error {
+	return lease.semaphore.storage.Renew(ctx, lease.semaphore.Name, lease.ID, lease.semaphore.ttl)
+}
+
+// Give the slot back, releasing a lease twice does nothing.
+func (lease *Lease) Release() error {
+	return lease.ReleaseContext(context.Background())
+}
+
+func (lease *Lease) ReleaseContext(ctx context.Context) error {
+	return lease.semaphore.storage.Release(ctx, lease.semaphore.Name, lease.ID)
+}
+
+// Renew the lease in the background three times a TTL until the task is stopped. The task fails with the error from
+// Renew, storage.ErrLeaseExpired if the lease was lost, and the holder should stop acting on it.
+func (lease *Lease) KeepAlive() *Task {
+	return start(func(ctx context.Context) error {
+		ticker := time.NewTicker(lease.semaphore.ttl / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if err := lease.RenewContext(ctx); err != nil {
+					return err
+				}
+
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	})
+}
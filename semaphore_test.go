@@ -0,0 +1,76 @@
+package bucket_test
+
+import (
+	"context"
+	"errors"
+	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSemaphore(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("a semaphore leases up to its limit and reclaims leases which run out", func(t *testing.T) {
+			sem, err := tb.NewSemaphore(&tb.SemaphoreOptions{ Name: MockBucketName(), Limit: 2, TTL: time.Millisecond * 100, Storage: store })
+			asserts.Nil(err, "Failed to create a semaphore")
+
+			first, err := sem.TryAcquire()
+			asserts.Nil(err, "sem.TryAcquire should not return an error")
+
+			second, err := sem.TryAcquire()
+			asserts.Nil(err, "sem.TryAcquire should not return an error")
+			asserts.True(second.Fence > first.Fence, "fencing tokens should increase")
+
+			_, err = sem.TryAcquire()
+			asserts.Equal(storage.ErrInsufficientTokens, err, "sem.TryAcquire should return ErrInsufficientTokens")
+
+			err = first.Release()
+			asserts.Nil(err, "lease.Release should not return an error")
+
+			third, err := sem.TryAcquire()
+			asserts.Nil(err, "a released slot should be free again")
+
+			// the second lease is kept alive while the third runs out as if its holder crashed
+			task := second.KeepAlive()
+
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+
+			start := time.Now()
+			fourth, err := sem.Acquire(ctx)
+			asserts.Nil(err, "sem.Acquire should not return an error")
+			asserts.True(time.Since(start) >= time.Millisecond * 80, "sem.Acquire should wait for the lease to run out")
+			asserts.True(fourth.Fence > third.Fence, "fencing tokens should increase")
+
+			err = third.Renew()
+			asserts.True(errors.Is(err, storage.ErrLeaseExpired), "lease.Renew should return ErrLeaseExpired")
+
+			asserts.Equal(tb.Running, task.Status(), "the lease should still be kept alive")
+			task.Stop()
+
+			err = second.Renew()
+			asserts.Nil(err, "the lease kept alive should still be held")
+		})
+	}
+
+	t.Run("sem.Acquire returns ctx.Err() once ctx is done", func(t *testing.T) {
+		sem, err := tb.NewSemaphore(&tb.SemaphoreOptions{ Name: MockBucketName(), Limit: 1 })
+		asserts.Nil(err, "Failed to create a semaphore")
+
+		_, err = sem.TryAcquire()
+		asserts.Nil(err, "sem.TryAcquire should not return an error")
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+		defer cancel()
+
+		_, err = sem.Acquire(ctx)
+		asserts.Equal(context.DeadlineExceeded, err, "sem.Acquire should return ctx.Err()")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,230 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"time"
+)
+
+// AIMD describes how the rate of an adaptive bucket follows feedback from downstream, with additive increase and
+// multiplicative decrease like TCP congestion control. Every success raises the rate by Increase and every failure
+// multiplies it by Decrease, within Min and Max. The rate starts out at Initial.
+//
+// A burst of failures is usually one problem rather then many so the rate changes at most once every Cooldown, and
+// after a cut it holds for a Cooldown before climbing again.
+type AIMD struct {
+	Initial int
+	Min int
+	Max int
+
+	Increase int
+	Decrease float64
+	Cooldown time.Duration
+}
+
+// Storage providers which can keep the rate of an adaptive bucket, so that every node sharing the bucket follows the
+// same rate. TakeAdaptive takes from a lazily refilled bucket (see Refill) at the stored rate in place of refill.Rate,
+// Report adjusts the rate and returns it.
+type AdaptiveStorage interface {
+	TakeAdaptive(ctx context.Context, bucketName string, tokens int, refill Refill, aimd AIMD) (Decision, error)
+	Report(ctx context.Context, bucketName string, success bool, aimd AIMD) (int, error)
+}
+
+// The rate an adaptive bucket is at and when it last went up and down in MemoryStorage. The rate is swept along with
+// the bucket, or once the cooldown after its last change is over for a bucket which is never taken from.
+type adaptiveRate struct {
+	rate int
+	increased time.Time
+	decreased time.Time
+	cooldown time.Duration
+}
+
+// Work out the rate following a report made at now.
+func (aimd AIMD) adjust(state adaptiveRate, success bool, now time.Time) adaptiveRate {
+	if now.Sub(state.decreased) < aimd.Cooldown {
+		return state
+	}
+
+	if success && now.Sub(state.increased) >= aimd.Cooldown {
+		state.rate, state.increased = aimd.clamp(state.rate + aimd.Increase), now
+	}
+
+	if !success {
+		state.rate, state.decreased = aimd.clamp(int(math.Floor(float64(state.rate) * aimd.Decrease))), now
+	}
+
+	return state
+}
+
+func (aimd AIMD) clamp(rate int) int {
+	if rate < aimd.Min {
+		return aimd.Min
+	}
+
+	if rate > aimd.Max {
+		return aimd.Max
+	}
+
+	return rate
+}
+
+// the keys the adaptive scripts expect after refillKeys
+func adaptiveKeys(bucketName string) []string {
+	return append(refillKeys(bucketName), stateKey(bucketName, "rate"), stateKey(bucketName, "increased"), stateKey(bucketName, "decreased"))
+}
+
+const (
+	luaAdaptive = luaBucket + `
+		local ratekey, increased, decreased = KEYS[4], KEYS[5], KEYS[6]
+
+		local function currentrate(initial)
+			return tonumber(redis.call("GET", ratekey)) or initial
+		end
+
+		-- The rate is kept as long as the bucket, see expire. ttl is from PTTL, a missing key leaves the rate as it is.
+		local function follow(ttl)
+			for _, key in ipairs({ratekey, increased, decreased}) do
+				if ttl > 0 then
+					redis.call("PEXPIRE", key, ttl)
+				elseif ttl == -1 then
+					redis.call("PERSIST", key)
+				end
+			end
+		end
+	`
+
+	// KEYS: see adaptiveKeys
+	// ARGV: tokens, initial rate followed by Refill.args
+	//
+	// Returns {allowed, remaining, retry after, reset after}, see decide.
+	luaTakeAdaptive = luaAdaptive + `
+		local amount, rate = tonumber(ARGV[1]), currentrate(tonumber(ARGV[2]))
+		local b = open(1, {capacity = tonumber(ARGV[3]), rate = rate, interval = tonumber(ARGV[5]), cold = rate, warmup = 0})
+
+		if b.count < amount then
+			return decide(b, 0, amount)
+		end
+
+		b.count = b.count - amount
+		save(b)
+		follow(redis.call("PTTL", b.key))
+		return decide(b, 1, amount)
+	`
+
+	// The Lua counterpart of AIMD.adjust.
+	//
+	// KEYS: see adaptiveKeys
+	// ARGV: 1 for a success and otherwise 0, initial, min, max, increase, decrease, cooldown, expiration in milliseconds
+	luaReport = luaAdaptive + `
+		local success, rate = ARGV[1] == "1", currentrate(tonumber(ARGV[2]))
+		local min, max, increase, decrease, cooldown = tonumber(ARGV[3]), tonumber(ARGV[4]), tonumber(ARGV[5]), tonumber(ARGV[6]), tonumber(ARGV[7])
+		local up, down = tonumber(redis.call("GET", increased)) or 0, tonumber(redis.call("GET", decreased)) or 0
+		local stamp = string.format("%.0f", now)
+
+		-- SET drops the expiration so carry over the bucket's, or the rate's own once the bucket has expired, or
+		-- RedisStorage.Expiration when there is neither
+		local ttl = redis.call("PTTL", KEYS[1])
+		if ttl == -2 then
+			ttl = redis.call("PTTL", ratekey)
+		end
+
+		if ttl == -2 and tonumber(ARGV[8]) > 0 then
+			ttl = tonumber(ARGV[8])
+		end
+
+		if now - down < cooldown then
+			return rate
+		end
+
+		if success and now - up >= cooldown then
+			rate = math.min(max, math.max(min, rate + increase))
+			redis.call("SET", increased, stamp)
+		end
+
+		if not success then
+			rate = math.min(max, math.max(min, math.floor(rate * decrease)))
+			redis.call("SET", decreased, stamp)
+		end
+
+		redis.call("SET", ratekey, rate)
+		follow(ttl)
+		return rate
+	`
+)
+
+// the rate an adaptive bucket is at, the caller must hold the write lock
+func (ms *MemoryStorage) adaptiveRate(bucketName string, aimd AIMD) *adaptiveRate {
+	if ms.rates == nil {
+		ms.rates = map[string]*adaptiveRate{}
+	}
+
+	if ms.rates[bucketName] == nil {
+		ms.rates[bucketName] = &adaptiveRate{rate: aimd.Initial}
+	}
+
+	ms.rates[bucketName].cooldown = aimd.Cooldown
+	ms.sweepInBackground()
+	return ms.rates[bucketName]
+}
+
+func (ms *MemoryStorage) TakeAdaptive(ctx context.Context, bucketName string, tokens int, refill Refill, aimd AIMD) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	refill.Rate, refill.WarmUp = ms.adaptiveRate(bucketName, aimd).rate, 0
+
+	now := time.Now()
+	count := ms.refill(bucketName, refill, now)
+	allowed := count >= tokens
+
+	if allowed {
+		count -= tokens
+		ms.buckets[bucketName] = count
+	}
+
+	return refill.decide(allowed, count, tokens, ms.refilled[bucketName], ms.warmth[bucketName], now), nil
+}
+
+func (ms *MemoryStorage) Report(ctx context.Context, bucketName string, success bool, aimd AIMD) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	state := ms.adaptiveRate(bucketName, aimd)
+	*state = aimd.adjust(*state, success, time.Now())
+	return state.rate, nil
+}
+
+func (rs *RedisStorage) TakeAdaptive(ctx context.Context, bucketName string, tokens int, refill Refill, aimd AIMD) (Decision, error) {
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	args := append([]interface{}{tokens, aimd.Initial}, refill.args()...)
+	return rs.evalDecision(ctx, luaTakeAdaptive, adaptiveKeys(bucketName), refill.Capacity, args...)
+}
+
+func (rs *RedisStorage) Report(ctx context.Context, bucketName string, success bool, aimd AIMD) (int, error) {
+	flag := 0
+	if success {
+		flag = 1
+	}
+
+	decrease := strconv.FormatFloat(aimd.Decrease, 'f', -1, 64)
+	args := []interface{}{flag, aimd.Initial, aimd.Min, aimd.Max, aimd.Increase, decrease, micros(aimd.Cooldown), int64(rs.Expiration / time.Millisecond)}
+
+	rate, err := rs.evalInt(ctx, luaReport, adaptiveKeys(bucketName), args...)
+	return int(rate), err
+}
@@ -0,0 +1,98 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func TestAdaptiveStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+	aimd := storage.AIMD{ Initial: 100, Min: 1, Max: 100, Increase: 1, Decrease: 0.1, Cooldown: time.Minute }
+	refill := storage.Refill{ Capacity: 1, Rate: 100, Interval: time.Second }
+
+	// two nodes sharing a bucket through redis
+	first := &storage.RedisStorage{ Client: redis.NewClient(redisOptions) }
+	second := &storage.RedisStorage{ Client: redis.NewClient(redisOptions) }
+
+	t.Run("a cut made by one node slows down every node", func(t *testing.T) {
+		name := MockBucketName()
+
+		rate, err := first.Report(context.Background(), name, false, aimd)
+		asserts.Nil(err, "store.Report should not return an error")
+		asserts.Equal(10, rate, "the rate should be cut to a tenth")
+
+		decision, err := second.TakeAdaptive(context.Background(), name, 1, refill, aimd)
+		asserts.Nil(err, "store.TakeAdaptive should not return an error")
+		asserts.True(decision.Allowed, "the bucket should start out full")
+
+		decision, err = second.TakeAdaptive(context.Background(), name, 1, refill, aimd)
+		asserts.Nil(err, "store.TakeAdaptive should not return an error")
+		asserts.False(decision.Allowed, "the bucket should be empty")
+		asserts.True(decision.RetryAfter > time.Millisecond * 50 && decision.RetryAfter <= time.Millisecond * 100, "a token should take 100ms at the cut rate rather then 10ms")
+	})
+
+	t.Run("redis keeps the rate as long as the bucket", func(t *testing.T) {
+		name := MockBucketName()
+
+		_, err := first.Report(context.Background(), name, false, aimd)
+		asserts.Nil(err, "store.Report should not return an error")
+
+		_, err = first.TakeAdaptive(context.Background(), name, 1, storage.Refill{ Capacity: 10, Rate: 1, Interval: time.Second }, aimd)
+		asserts.Nil(err, "store.TakeAdaptive should not return an error")
+
+		_, err = first.Report(context.Background(), name, true, storage.AIMD{ Initial: 100, Min: 1, Max: 100, Increase: 1, Decrease: 0.1 })
+		asserts.Nil(err, "store.Report should not return an error")
+
+		for _, state := range []string{ "rate", "increased", "decreased" } {
+			ttl, err := testClient.PTTL("{" + name + "}:" + state).Result()
+			asserts.Nil(err, "client.PTTL should not return an error")
+			asserts.True(ttl > 0 && ttl <= time.Second, "the " + state + " key should expire with the bucket")
+		}
+	})
+
+	t.Run("redis expires the rate of a bucket which is only reported on", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient, Expiration: time.Minute }
+		name := MockBucketName()
+
+		_, err := store.Report(context.Background(), name, false, aimd)
+		asserts.Nil(err, "store.Report should not return an error")
+
+		for _, state := range []string{ "rate", "decreased" } {
+			ttl, err := testClient.PTTL("{" + name + "}:" + state).Result()
+			asserts.Nil(err, "client.PTTL should not return an error")
+			asserts.True(ttl > 0 && ttl <= time.Minute, "the " + state + " key should expire after Expiration")
+		}
+	})
+
+	t.Run("memory sweeps the rate once the bucket is gone and the cooldown is over", func(t *testing.T) {
+		store := &storage.MemoryStorage{ SweepInterval: time.Hour }
+		defer store.Close()
+
+		name := MockBucketName()
+		short := storage.AIMD{ Initial: 100, Min: 1, Max: 100, Increase: 1, Decrease: 0.1, Cooldown: time.Millisecond * 20 }
+
+		rate, err := store.Report(context.Background(), name, false, short)
+		asserts.Nil(err, "store.Report should not return an error")
+		asserts.Equal(10, rate, "the rate should be cut to a tenth")
+
+		store.Sweep()
+		rate, err = store.Report(context.Background(), name, false, short)
+		asserts.Nil(err, "store.Report should not return an error")
+		asserts.Equal(10, rate, "the rate should be kept through its cooldown")
+
+		time.Sleep(time.Millisecond * 50)
+		store.Sweep()
+
+		rate, err = store.Report(context.Background(), name, true, short)
+		asserts.Nil(err, "store.Report should not return an error")
+		asserts.Equal(100, rate, "a swept rate should start over from Initial")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
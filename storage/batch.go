@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// One take or put in a batch, see BatchStorage. A take is worked out like RefillStorage.TakeRefill with Refill
+// describing the bucket. A Refill with a Rate of 0 is a take like Take from a bucket which doesn't refill, which must
+// have been created, Refill.Capacity is still the limit of the decision. A put is like Put.
+type Op struct {
+	Name string
+	Tokens int
+	Put bool
+	Refill Refill
+}
+
+// How one operation in a batch went, Decision is only filled in for takes.
+type OpResult struct {
+	Decision Decision
+	Err error
+}
+
+// Storage providers which can run takes and puts across many buckets in a single round trip. Unlike a group (see
+// GroupStorage) the operations have nothing to do with each other, each one is allowed or fails by itself. There is
+// one result per operation in the same order, the error is for a batch which could not be run at all.
+type BatchStorage interface {
+	Batch(ctx context.Context, ops []Op) ([]OpResult, error)
+}
+
+// KEYS: the bucket
+// ARGV: tokens, channel
+//
+// Put with its notification, see RedisStorage.PutContext.
+const luaPut = `
+	local count = redis.call("INCRBY", KEYS[1], ARGV[1])
+	redis.call("PUBLISH", ARGV[2], "put")
+	return count
+`
+
+// KEYS: the bucket
+// ARGV: tokens, capacity
+//
+// Take from a bucket which doesn't refill and describe it like luaTakeRefill, or return {code} like luaGetAndDecr
+// when it can't be taken from.
+const luaTake = `
+	local raw = redis.call("GET", KEYS[1])
+	if not raw then
+		return {-2}
+	end
+
+	local count = tonumber(raw)
+	if count == nil then
+		return {-3}
+	end
+
+	local amount, capacity = tonumber(ARGV[1]), tonumber(ARGV[2])
+	local allowed, retry, reset = 0, -1, 0
+
+	if count >= amount then
+		count = redis.call("DECRBY", KEYS[1], amount)
+		allowed, retry = 1, 0
+	end
+
+	if count < capacity then
+		reset = -1
+	end
+
+	return {allowed, math.max(0, count), retry, reset}
+`
+
+// Scripts are run by SHA and only sent in full to a server which hasn't seen them yet, see redis.Script.Run. The
+// script for each body is made once and kept here.
+var scripts sync.Map
+
+func script(body string) *redis.Script {
+	if loaded, ok := scripts.Load(body); ok {
+		return loaded.(*redis.Script)
+	}
+
+	loaded, _ := scripts.LoadOrStore(body, redis.NewScript(body))
+	return loaded.(*redis.Script)
+}
+
+// A script to run in a pipeline, see evalPipelined.
+type scriptCall struct {
+	body string
+	keys []string
+	args []interface{}
+}
+
+// Run every call in one pipeline by SHA. Calls a server didn't have the script for are sent again in full in a second
+// pipeline, which loads the script for next time. The error of each call is left on its command.
+func evalPipelined(client redis.UniversalClient, calls []scriptCall) []*redis.Cmd {
+	cmds := make([]*redis.Cmd, len(calls))
+
+	client.Pipelined(func(pipe *redis.Pipeline) error {
+		for i, call := range calls {
+			cmds[i] = script(call.body).EvalSha(pipe, call.keys, call.args...)
+		}
+		return nil
+	})
+
+	var missing []int
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT ") {
+			missing = append(missing, i)
+		}
+	}
+
+	if len(missing) > 0 {
+		client.Pipelined(func(pipe *redis.Pipeline) error {
+			for _, i := range missing {
+				cmds[i] = script(calls[i].body).Eval(pipe, calls[i].keys, calls[i].args...)
+			}
+			return nil
+		})
+	}
+
+	return cmds
+}
+
+func (ms *MemoryStorage) Batch(ctx context.Context, ops []Op) ([]OpResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	results := make([]OpResult, len(ops))
+	for i, op := range ops {
+		switch {
+		case op.Put:
+			results[i].Err = ms.Put(op.Name, op.Tokens)
+		case op.Refill.Rate <= 0:
+			results[i].Decision, results[i].Err = ms.take(op.Name, op.Tokens, op.Refill)
+		default:
+			results[i].Decision, results[i].Err = ms.TakeRefill(ctx, op.Name, op.Tokens, op.Refill)
+		}
+	}
+
+	return results, nil
+}
+
+// Take from a bucket which doesn't refill and describe it, the bucket must have been created like for Take.
+func (ms *MemoryStorage) take(bucketName string, tokens int, refill Refill) (Decision, error) {
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	count, exists := ms.buckets[bucketName]
+	if !exists {
+		return Decision{}, &Error{Kind: ErrBucketNotFound, Name: bucketName}
+	}
+
+	allowed := count >= tokens
+	if allowed {
+		count -= tokens
+		ms.buckets[bucketName] = count
+	}
+
+	return refill.decide(allowed, count, tokens, time.Time{}, 0, time.Time{}), nil
+}
+
+// The batch is sent as one pipeline of EVALSHA, bypassing CoalesceWindow.
+func (rs *RedisStorage) Batch(ctx context.Context, ops []Op) ([]OpResult, error) {
+	results := make([]OpResult, len(ops))
+	if len(ops) == 0 {
+		return results, ctx.Err()
+	}
+
+	// operations which are invalid are never sent
+	var calls []scriptCall
+	var sent []int
+
+	for i, op := range ops {
+		if results[i].Err = validAmount(op.Tokens); results[i].Err != nil {
+			continue
+		}
+
+		switch {
+		case op.Put:
+			calls = append(calls, scriptCall{luaPut, []string{op.Name}, []interface{}{op.Tokens, notifyChannel(op.Name)}})
+		case op.Refill.Rate <= 0:
+			calls = append(calls, scriptCall{luaTake, []string{op.Name}, []interface{}{op.Tokens, op.Refill.Capacity}})
+		default:
+			calls = append(calls, scriptCall{luaTakeRefill, refillKeys(op.Name), append([]interface{}{op.Tokens}, op.Refill.args()...)})
+		}
+
+		sent = append(sent, i)
+	}
+
+	if len(calls) == 0 {
+		return results, ctx.Err()
+	}
+
+	var cmds []*redis.Cmd
+	err := rs.do(ctx, ops[sent[0]].Name, func(client redis.UniversalClient) error {
+		cmds = evalPipelined(client, calls)
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for j, i := range sent {
+		results[i] = opResult(ops[i], cmds[j])
+	}
+
+	return results, nil
+}
+
+// Read the result of an operation off its command.
+func opResult(op Op, cmd *redis.Cmd) OpResult {
+	if op.Put {
+		return OpResult{Err: redisError(op.Name, cmd.Err())}
+	}
+
+	reply, err := ints(cmd.Val(), cmd.Err())
+	if err != nil {
+		return OpResult{Err: redisError(op.Name, err)}
+	}
+
+	// a single negative code is an error from luaTake
+	if len(reply) == 1 && reply[0] < 0 {
+		return OpResult{Err: scriptError(op.Name, reply[0])}
+	}
+
+	decision, err := decisionFromReply(reply, op.Refill.Capacity)
+	return OpResult{Decision: decision, Err: err}
+}
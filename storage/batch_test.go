@@ -0,0 +1,136 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockBatchStorage() []storage.BatchStorage {
+	return []storage.BatchStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+func TestBatchStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+	ctx := context.Background()
+
+	for _, store := range MockBatchStorage() {
+		t.Run("store.Batch runs every operation by itself", func(t *testing.T) {
+			plain, refilling := MockBucketName(), MockBucketName()
+
+			err := store.(storage.Storage).Create(plain, 5)
+			asserts.Nil(err, "store.Create should not return an error")
+
+			results, err := store.Batch(ctx, []storage.Op{
+				{ Name: plain, Tokens: 3, Refill: storage.Refill{ Capacity: 5 } },
+				{ Name: refilling, Tokens: 11, Refill: storage.Refill{ Capacity: 10, Rate: 1, Interval: time.Minute } },
+				{ Name: plain, Tokens: 4, Put: true },
+				{ Name: plain, Tokens: 0 },
+			})
+			asserts.Nil(err, "store.Batch should not return an error")
+			asserts.Len(results, 4, "there should be a result for each operation")
+
+			asserts.Nil(results[0].Err, "the take should not return an error")
+			asserts.True(results[0].Decision.Allowed, "the take should be allowed")
+			asserts.Equal(2, results[0].Decision.Remaining, "remaining should be the tokens left")
+
+			asserts.Nil(results[1].Err, "a refused take should not return an error")
+			asserts.False(results[1].Decision.Allowed, "a take past the capacity should not be allowed")
+
+			asserts.Nil(results[2].Err, "the put should not return an error")
+			asserts.True(errors.Is(results[3].Err, storage.ErrInvalidAmount), "an invalid amount should fail by itself")
+
+			count, err := store.(storage.Storage).Count(plain)
+			asserts.Nil(err, "store.Count should not return an error")
+			asserts.Equal(6, count, "count should be after the take and the put")
+		})
+
+		t.Run("a take from a bucket which doesn't refill and was never created returns ErrBucketNotFound", func(t *testing.T) {
+			name := MockBucketName()
+
+			results, err := store.Batch(ctx, []storage.Op{{ Name: name, Tokens: 1, Refill: storage.Refill{ Capacity: 5 } }})
+			asserts.Nil(err, "store.Batch should not return an error")
+			asserts.True(errors.Is(results[0].Err, storage.ErrBucketNotFound), "the take should return ErrBucketNotFound")
+
+			_, err = store.(storage.Storage).Count(name)
+			asserts.True(errors.Is(err, storage.ErrBucketNotFound), "the take should not create the bucket")
+		})
+	}
+
+	t.Run("scripts are sent in full to a server which doesn't have them", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient }
+		name := MockBucketName()
+
+		err := testClient.ScriptFlush().Err()
+		asserts.Nil(err, "client.ScriptFlush should not return an error")
+
+		results, err := store.Batch(ctx, []storage.Op{{ Name: name, Tokens: 1, Refill: storage.Refill{ Capacity: 5, Rate: 1, Interval: time.Minute } }})
+		asserts.Nil(err, "store.Batch should not return an error")
+		asserts.Nil(results[0].Err, "the take should not return an error")
+		asserts.True(results[0].Decision.Allowed, "the take should be allowed")
+
+		decision, err := store.TakeRefill(ctx, name, 1, storage.Refill{ Capacity: 5, Rate: 1, Interval: time.Minute })
+		asserts.Nil(err, "store.TakeRefill should not return an error")
+		asserts.Equal(3, decision.Remaining, "remaining should be the tokens left")
+	})
+
+	t.Run("concurrent takes are coalesced into batches", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient, CoalesceWindow: time.Millisecond * 5, CoalesceMax: 16 }
+		name := MockBucketName()
+		refill := storage.Refill{ Capacity: 30, Rate: 1, Interval: time.Hour }
+
+		var allowed int32
+		var wg sync.WaitGroup
+
+		for i := 0; i < 50; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				decision, err := store.TakeRefill(ctx, name, 1, refill)
+				asserts.Nil(err, "store.TakeRefill should not return an error")
+
+				if decision.Allowed {
+					atomic.AddInt32(&allowed, 1)
+				}
+			}()
+		}
+
+		wg.Wait()
+		asserts.Equal(int32(30), allowed, "exactly the capacity should be taken")
+
+		err := store.Put(name, 2)
+		asserts.Nil(err, "store.Put should not return an error")
+
+		count, err := store.Count(name)
+		asserts.Nil(err, "store.Count should not return an error")
+		asserts.Equal(2, count, "count should include the coalesced put")
+	})
+
+	t.Run("takes from buckets which don't refill are coalesced like Take", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient, CoalesceWindow: time.Millisecond * 5 }
+		name := MockBucketName()
+
+		asserts.Nil(store.Create(name, 1), "store.Create should not return an error")
+		asserts.Nil(store.Take(name, 1), "store.Take should not return an error")
+
+		err := store.Take(name, 1)
+		asserts.Equal(storage.ErrInsufficientTokens, err, "store.Take should return insufficient tokens")
+
+		err = store.Take(MockBucketName(), 1)
+		asserts.True(errors.Is(err, storage.ErrBucketNotFound), "store.Take should return ErrBucketNotFound")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
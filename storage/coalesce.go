@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A coalescer collects the takes and puts made through a RedisStorage with a CoalesceWindow and sends them to redis
+// as one batch, see RedisStorage.Batch. The first call to arrive starts the window and the batch is flushed when the
+// window ends or once it holds CoalesceMax calls, whichever comes first.
+type coalescer struct {
+	rs *RedisStorage
+	window time.Duration
+	max int
+
+	mutex sync.Mutex
+	pending []*pendingOp
+	timer *time.Timer
+}
+
+// A call waiting for its batch to be flushed.
+type pendingOp struct {
+	op Op
+	done chan OpResult
+}
+
+// The coalescer of the storage, made the first time it is needed.
+func (rs *RedisStorage) coalescing() *coalescer {
+	rs.coalesceOnce.Do(func() {
+		max := rs.CoalesceMax
+		if max <= 0 {
+			max = 128
+		}
+
+		rs.coalescer = &coalescer{rs: rs, window: rs.CoalesceWindow, max: max}
+	})
+
+	return rs.coalescer
+}
+
+// Add the operation to the next batch and wait for its result, or until ctx is done in which case ctx.Err() is
+// returned. An operation whose caller gave up is still sent with its batch so it may have been applied, see
+// ContextStorage.
+func (c *coalescer) do(ctx context.Context, op Op) (OpResult, error) {
+	if err := ctx.Err(); err != nil {
+		return OpResult{}, err
+	}
+
+	pending := &pendingOp{op: op, done: make(chan OpResult, 1)}
+
+	c.mutex.Lock()
+	c.pending = append(c.pending, pending)
+
+	switch len(c.pending) {
+	case c.max:
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+
+		batch := c.pending
+		c.pending = nil
+		go c.flush(batch)
+
+	case 1:
+		c.timer = time.AfterFunc(c.window, c.flushPending)
+	}
+	c.mutex.Unlock()
+
+	select {
+	case result := <-pending.done:
+		return result, nil
+	case <-ctx.Done():
+		return OpResult{}, ctx.Err()
+	}
+}
+
+// Flush whatever is waiting once the window ends.
+func (c *coalescer) flushPending() {
+	c.mutex.Lock()
+	batch := c.pending
+	c.pending = nil
+	c.mutex.Unlock()
+
+	if len(batch) > 0 {
+		c.flush(batch)
+	}
+}
+
+func (c *coalescer) flush(batch []*pendingOp) {
+	ops := make([]Op, len(batch))
+	for i, pending := range batch {
+		ops[i] = pending.op
+	}
+
+	// the batch belongs to every caller in it so it isn't cut short by any one of them giving up
+	results, err := c.rs.Batch(context.Background(), ops)
+
+	for i, pending := range batch {
+		if err != nil {
+			pending.done <- OpResult{Err: err}
+		} else {
+			pending.done <- results[i]
+		}
+	}
+}
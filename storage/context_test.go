@@ -0,0 +1,88 @@
+package storage_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+// a Storage which only implements the plain interface
+type plainStorage struct {
+	storage.Storage
+}
+
+func TestContextStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+
+	stores := []storage.ContextStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+		storage.WithContext(plainStorage{ &storage.MemoryStorage{} }),
+	}
+
+	for _, store := range stores {
+		t.Run("a context which is done stops the operation before it starts", func(t *testing.T) {
+			name := MockBucketName()
+			err := store.CreateContext(context.Background(), name, 10)
+			asserts.Nil(err, "store.CreateContext should not return an error")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+
+			err = store.TakeContext(ctx, name, 1)
+			asserts.Equal(context.Canceled, err, "store.TakeContext should return ctx.Err()")
+
+			err = store.PutContext(ctx, name, 1)
+			asserts.Equal(context.Canceled, err, "store.PutContext should return ctx.Err()")
+
+			count, err := store.CountContext(context.Background(), name)
+			asserts.Nil(err, "store.CountContext should not return an error")
+			asserts.Equal(10, count, "count should be unchanged")
+		})
+	}
+
+	t.Run("redis gives up on a server which does not answer once the deadline passes", func(t *testing.T) {
+		// accept connections and never reply to them
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		asserts.Nil(err, "net.Listen should not return an error")
+		defer listener.Close()
+
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+			}
+		}()
+
+		// no ReadTimeout so only the deadline stops the wait
+		client := redis.NewClient(&redis.Options{ Addr: listener.Addr().String(), ReadTimeout: -1, MaxRetries: 0 })
+		stores := []*storage.RedisStorage{
+			{ Client: client },
+			{ Client: client, CoalesceWindow: time.Millisecond },
+		}
+
+		for _, store := range stores {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond * 50)
+
+			start := time.Now()
+			err = store.TakeContext(ctx, MockBucketName(), 1)
+			asserts.Equal(context.DeadlineExceeded, err, "store.TakeContext should return ctx.Err()")
+			asserts.True(time.Since(start) < time.Second, "store.TakeContext should return soon after the deadline")
+
+			_, err = store.TakeRefill(ctx, MockBucketName(), 1, storage.Refill{ Capacity: 10 })
+			asserts.Equal(context.DeadlineExceeded, err, "store.TakeRefill should return ctx.Err()")
+			cancel()
+		}
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
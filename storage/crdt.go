@@ -0,0 +1,366 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CRDTStorage keeps buckets as PN-counters so that replicas in different regions can each take from a bucket without
+// asking the others and still agree on its token value in the end. Every replica counts the tokens it added and the
+// tokens it took by itself, the token value is what every replica added less what every replica took. Replicas swap
+// their counts with their Peers over a Transport every SyncInterval and merge them by keeping the greater count of
+// each replica, so states can be merged in any order and any number of times and every replica ends up in the same
+// state once they have all heard from each other.
+//
+// The limit is approximate. A replica only knows what the others took as of the last sync, so between syncs a bucket
+// can be overdrawn by as much as the other replicas take in one SyncInterval, more while replicas can't reach each
+// other. Sync more often to bound the overshoot more tightly.
+//
+// Create gives every replica the same starting value rather then adding it once per replica, replicas should create
+// a bucket with the same capacity. Set adds or takes the difference from the value this replica knows of, so two
+// replicas setting the same bucket at once both count.
+//
+// Replicas keep their state in memory and nothing else, not even the Redis of their region. Every process should be a
+// replica of its own with a name which is never used again, for example with the time it started in it. A process
+// which restarts under the name it had before starts its counts over from 0 and the merge keeps the greater of those
+// and the counts its peers remember, so whatever it takes before it has synced is lost to the count.
+type CRDTStorage struct {
+	// the name of this replica, unique among every replica
+	Replica string
+
+	// the replicas to sync with, see Transport
+	Peers []string
+	Transport Transport
+
+	// Optional, how often to sync with every peer in the background, defaults to one second. Syncing starts with the
+	// first bucket created and stops on Close.
+	SyncInterval time.Duration
+
+	mutex sync.RWMutex
+	buckets map[string]*Counter
+
+	syncer sync.Once
+	stop chan struct{}
+	stopped sync.Once
+}
+
+// The state of one bucket, a PN-counter. P holds the tokens each replica added and N the tokens each replica took,
+// both keyed by the name of the replica. Base is the value the bucket was created with.
+type Counter struct {
+	Base int `json:"base"`
+	P map[string]int `json:"p"`
+	N map[string]int `json:"n"`
+}
+
+// The state of every bucket of a replica as it is sent to its peers.
+type CRDTState struct {
+	Replica string `json:"replica"`
+	Buckets map[string]*Counter `json:"buckets"`
+}
+
+func newCounter(base int) *Counter {
+	return &Counter{Base: base, P: map[string]int{}, N: map[string]int{}}
+}
+
+// The token value of the bucket.
+func (counter *Counter) Value() int {
+	value := counter.Base
+	for _, tokens := range counter.P {
+		value += tokens
+	}
+
+	for _, tokens := range counter.N {
+		value -= tokens
+	}
+
+	return value
+}
+
+// Merge another replica's state of the bucket into this one.
+func (counter *Counter) merge(other *Counter) {
+	if other.Base > counter.Base {
+		counter.Base = other.Base
+	}
+
+	for replica, tokens := range other.P {
+		if tokens > counter.P[replica] {
+			counter.P[replica] = tokens
+		}
+	}
+
+	for replica, tokens := range other.N {
+		if tokens > counter.N[replica] {
+			counter.N[replica] = tokens
+		}
+	}
+}
+
+func (counter *Counter) copy() *Counter {
+	copied := newCounter(counter.Base)
+	copied.merge(counter)
+	return copied
+}
+
+// Add to or take from the bucket as this replica, a negative number of tokens is taken. The caller must hold the
+// write lock.
+func (cs *CRDTStorage) add(counter *Counter, tokens int) {
+	if tokens > 0 {
+		counter.P[cs.Replica] += tokens
+	} else {
+		counter.N[cs.Replica] -= tokens
+	}
+}
+
+// the bucket's counter, the caller must hold a lock
+func (cs *CRDTStorage) counter(bucketName string) (*Counter, error) {
+	counter, ok := cs.buckets[bucketName]
+	if !ok {
+		return nil, &Error{Kind: ErrBucketNotFound, Name: bucketName}
+	}
+
+	return counter, nil
+}
+
+// Return a copy of the replica's state.
+func (cs *CRDTStorage) State() CRDTState {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	state := CRDTState{Replica: cs.Replica, Buckets: map[string]*Counter{}}
+	for name, counter := range cs.buckets {
+		state.Buckets[name] = counter.copy()
+	}
+
+	return state
+}
+
+// Merge the state of another replica into this one.
+func (cs *CRDTStorage) Merge(state CRDTState) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if cs.buckets == nil {
+		cs.buckets = map[string]*Counter{}
+	}
+
+	for name, other := range state.Buckets {
+		if other == nil {
+			continue
+		}
+
+		if cs.buckets[name] == nil {
+			cs.buckets[name] = newCounter(other.Base)
+		}
+
+		cs.buckets[name].merge(other)
+	}
+}
+
+// Swap states with every peer once, merging what they send back. Peers are synced with at the same time so a peer
+// which is slow to answer doesn't hold up the rest, peers which can't be reached are skipped and the first error is
+// returned once the rest have been synced with. This is done in the background every SyncInterval, with a deadline of
+// the interval, so there is normally no need to call it.
+func (cs *CRDTStorage) Sync(ctx context.Context) error {
+	state := cs.State()
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var first error
+
+	for _, peer := range cs.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+
+			remote, err := cs.Transport.Exchange(ctx, peer, state)
+			if err != nil {
+				mutex.Lock()
+				if first == nil {
+					first = err
+				}
+				mutex.Unlock()
+				return
+			}
+
+			cs.Merge(remote)
+		}(peer)
+	}
+
+	wg.Wait()
+	return first
+}
+
+// Start syncing in the background, the caller must hold the write lock.
+func (cs *CRDTStorage) syncInBackground() {
+	cs.syncer.Do(func() {
+		interval := cs.SyncInterval
+		if interval <= 0 {
+			interval = time.Second
+		}
+
+		cs.stop = make(chan struct{})
+
+		go func() {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					// a peer which can't be reached or hangs is tried again on the next tick
+					ctx, cancel := context.WithTimeout(context.Background(), interval)
+					cs.Sync(ctx)
+					cancel()
+				case <-cs.stop:
+					return
+				}
+			}
+		}()
+	})
+}
+
+// Stop syncing in the background.
+func (cs *CRDTStorage) Close() error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	cs.stopped.Do(func() {
+		if cs.stop != nil {
+			close(cs.stop)
+		}
+	})
+
+	return nil
+}
+
+// Replicas sync over HTTP by posting their state to each other, see HTTPTransport. The state of this replica merged
+// with the one posted is sent back.
+func (cs *CRDTStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Replicas sync with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var state CRDTState
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	cs.Merge(state)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cs.State())
+}
+
+func (cs *CRDTStorage) Ping() error { return nil }
+
+// Create the bucket on this replica if no replica it has heard from created it.
+func (cs *CRDTStorage) Create(name string, capacity int) error {
+	if capacity < 0 {
+		return ErrInvalidAmount
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if cs.buckets == nil {
+		cs.buckets = map[string]*Counter{}
+	}
+
+	cs.syncInBackground()
+
+	if _, exists := cs.buckets[name]; !exists {
+		cs.buckets[name] = newCounter(capacity)
+	}
+
+	return nil
+}
+
+// Take the tokens if this replica believes the bucket has them.
+func (cs *CRDTStorage) Take(bucketName string, tokens int) error {
+	if err := validAmount(tokens); err != nil {
+		return err
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	counter, err := cs.counter(bucketName)
+	if err != nil {
+		return err
+	}
+
+	if counter.Value() < tokens {
+		return ErrInsufficientTokens
+	}
+
+	cs.add(counter, -tokens)
+	return nil
+}
+
+func (cs *CRDTStorage) TakeAll(bucketName string) (int, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	counter, err := cs.counter(bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	count := counter.Value()
+	if count <= 0 {
+		return 0, nil
+	}
+
+	cs.add(counter, -count)
+	return count, nil
+}
+
+// Add or take the difference between tokens and the token value this replica knows of. The bucket must have been
+// created, made up here with a Base of 0 it would end up with the value on top of the Base it was created with.
+func (cs *CRDTStorage) Set(bucketName string, tokens int) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	counter, err := cs.counter(bucketName)
+	if err != nil {
+		return err
+	}
+
+	cs.add(counter, tokens - counter.Value())
+	return nil
+}
+
+func (cs *CRDTStorage) Put(bucketName string, tokens int) error {
+	if err := validAmount(tokens); err != nil {
+		return err
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	counter, err := cs.counter(bucketName)
+	if err != nil {
+		return err
+	}
+
+	cs.add(counter, tokens)
+	return nil
+}
+
+// The token value as this replica knows it.
+func (cs *CRDTStorage) Count(bucketName string) (int, error) {
+	cs.mutex.RLock()
+	defer cs.mutex.RUnlock()
+
+	counter, err := cs.counter(bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	return counter.Value(), nil
+}
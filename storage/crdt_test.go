@@ -0,0 +1,233 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+// a replica for each name, each syncing with all the others over the transport
+func MockReplicas(transport storage.Transport, names ...string) []*storage.CRDTStorage {
+	var replicas []*storage.CRDTStorage
+	for _, name := range names {
+		var peers []string
+		for _, peer := range names {
+			if peer != name {
+				peers = append(peers, peer)
+			}
+		}
+
+		// sync by hand
+		replicas = append(replicas, &storage.CRDTStorage{ Replica: name, Peers: peers, Transport: transport, SyncInterval: time.Hour })
+	}
+
+	return replicas
+}
+
+// a transport on which the peer named hung never answers
+type hangingTransport struct {
+	*storage.MemoryTransport
+	given int32
+}
+
+func (ht *hangingTransport) Exchange(ctx context.Context, peer string, state storage.CRDTState) (storage.CRDTState, error) {
+	if peer != "hung" {
+		return ht.MemoryTransport.Exchange(ctx, peer, state)
+	}
+
+	<-ctx.Done()
+	atomic.AddInt32(&ht.given, 1)
+	return storage.CRDTState{}, ctx.Err()
+}
+
+func TestCRDTStorage(t *testing.T) {
+	asserts := assert.New(t)
+	ctx := context.Background()
+
+	t.Run("replicas converge once they sync", func(t *testing.T) {
+		transport := &storage.MemoryTransport{}
+		replicas := MockReplicas(transport, "us", "eu", "ap")
+		name := MockBucketName()
+
+		for _, replica := range replicas {
+			defer replica.Close()
+			transport.Add(replica)
+
+			err := replica.Create(name, 30)
+			asserts.Nil(err, "replica.Create should not return an error")
+		}
+
+		asserts.Nil(replicas[0].Take(name, 5), "replica.Take should not return an error")
+		asserts.Nil(replicas[1].Take(name, 7), "replica.Take should not return an error")
+		asserts.Nil(replicas[2].Put(name, 2), "replica.Put should not return an error")
+
+		count, err := replicas[0].Count(name)
+		asserts.Nil(err, "replica.Count should not return an error")
+		asserts.Equal(25, count, "a replica should only know of its own takes before syncing")
+
+		asserts.Nil(replicas[0].Sync(ctx), "replica.Sync should not return an error")
+		asserts.Nil(replicas[1].Sync(ctx), "replica.Sync should not return an error")
+
+		for _, replica := range replicas {
+			count, err := replica.Count(name)
+			asserts.Nil(err, "replica.Count should not return an error")
+			asserts.Equal(20, count, "every replica should agree on the token value")
+		}
+	})
+
+	t.Run("a partition overdraws by no more then each side takes until it heals", func(t *testing.T) {
+		transport := &storage.MemoryTransport{}
+		replicas := MockReplicas(transport, "us", "eu")
+		name := MockBucketName()
+
+		for _, replica := range replicas {
+			defer replica.Close()
+			transport.Add(replica)
+
+			err := replica.Create(name, 10)
+			asserts.Nil(err, "replica.Create should not return an error")
+		}
+
+		transport.Partition([]string{ "us" }, []string{ "eu" })
+
+		err := replicas[0].Sync(ctx)
+		asserts.True(errors.Is(err, storage.ErrStorageUnavailable), "replica.Sync should fail across a partition")
+
+		asserts.Nil(replicas[0].Take(name, 8), "replica.Take should not return an error")
+		asserts.Nil(replicas[1].Take(name, 6), "each side should see the tokens the other took as still there")
+
+		transport.Heal()
+		asserts.Nil(replicas[1].Sync(ctx), "replica.Sync should not return an error once healed")
+
+		for _, replica := range replicas {
+			count, err := replica.Count(name)
+			asserts.Nil(err, "replica.Count should not return an error")
+			asserts.Equal(-4, count, "the overshoot should be owed once the partition heals")
+
+			err = replica.Take(name, 1)
+			asserts.Equal(storage.ErrInsufficientTokens, err, "no replica should take until the bucket is paid back")
+		}
+	})
+
+	t.Run("replicas sync in the background", func(t *testing.T) {
+		transport := &storage.MemoryTransport{}
+		replicas := MockReplicas(transport, "us", "eu")
+		name := MockBucketName()
+
+		for _, replica := range replicas {
+			replica.SyncInterval = time.Millisecond * 10
+			defer replica.Close()
+			transport.Add(replica)
+
+			err := replica.Create(name, 10)
+			asserts.Nil(err, "replica.Create should not return an error")
+		}
+
+		asserts.Nil(replicas[0].Take(name, 3), "replica.Take should not return an error")
+
+		count := 0
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			if count, _ = replicas[1].Count(name); count == 7 {
+				break
+			}
+		}
+
+		asserts.Equal(7, count, "the take should reach the other replica")
+	})
+
+	t.Run("a peer which hangs doesn't hold up syncing with the others", func(t *testing.T) {
+		transport := &hangingTransport{ MemoryTransport: &storage.MemoryTransport{} }
+		replicas := MockReplicas(transport, "us", "eu")
+		name := MockBucketName()
+
+		replicas[0].Peers = append([]string{ "hung" }, replicas[0].Peers...)
+
+		for _, replica := range replicas {
+			replica.SyncInterval = time.Millisecond * 10
+			defer replica.Close()
+			transport.Add(replica)
+
+			err := replica.Create(name, 10)
+			asserts.Nil(err, "replica.Create should not return an error")
+		}
+
+		asserts.Nil(replicas[0].Take(name, 3), "replica.Take should not return an error")
+
+		count := 0
+		for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 10) {
+			if count, _ = replicas[1].Count(name); count == 7 && atomic.LoadInt32(&transport.given) > 1 {
+				break
+			}
+		}
+
+		asserts.Equal(7, count, "the take should reach the replica which answers")
+		asserts.True(atomic.LoadInt32(&transport.given) > 1, "a sync should give up on the hung peer once its interval is over")
+	})
+
+	t.Run("set and create are refused where a merge would go wrong", func(t *testing.T) {
+		replica := &storage.CRDTStorage{ Replica: "us", SyncInterval: time.Hour }
+		defer replica.Close()
+
+		err := replica.Set(MockBucketName(), 5)
+		asserts.True(errors.Is(err, storage.ErrBucketNotFound), "replica.Set should return ErrBucketNotFound for a bucket it doesn't have")
+
+		err = replica.Create(MockBucketName(), -1)
+		asserts.Equal(storage.ErrInvalidAmount, err, "replica.Create should refuse a negative capacity")
+	})
+
+	t.Run("a replica which restarts should do so under a new name", func(t *testing.T) {
+		transport := &storage.MemoryTransport{}
+		replicas := MockReplicas(transport, "us", "eu")
+		name := MockBucketName()
+
+		for _, replica := range replicas {
+			defer replica.Close()
+			transport.Add(replica)
+			asserts.Nil(replica.Create(name, 10), "replica.Create should not return an error")
+		}
+
+		asserts.Nil(replicas[0].Take(name, 5), "replica.Take should not return an error")
+		asserts.Nil(replicas[0].Sync(ctx), "replica.Sync should not return an error")
+
+		// us restarts twice, once under its old name and once under a new one, and takes 2 before syncing
+		for _, restarted := range []string{ "us", "us-2" } {
+			replica := &storage.CRDTStorage{ Replica: restarted, Peers: []string{ "eu" }, Transport: transport, SyncInterval: time.Hour }
+			defer replica.Close()
+
+			asserts.Nil(replica.Create(name, 10), "replica.Create should not return an error")
+			asserts.Nil(replica.Take(name, 2), "replica.Take should not return an error")
+			asserts.Nil(replica.Sync(ctx), "replica.Sync should not return an error")
+		}
+
+		// 9 tokens were taken but the 2 taken under the old name were merged away
+		count, err := replicas[1].Count(name)
+		asserts.Nil(err, "replica.Count should not return an error")
+		asserts.Equal(3, count, "only the takes under the new name should add to the count")
+	})
+
+	t.Run("replicas sync over HTTP", func(t *testing.T) {
+		us := &storage.CRDTStorage{ Replica: "us", Transport: &storage.HTTPTransport{}, SyncInterval: time.Hour }
+		eu := &storage.CRDTStorage{ Replica: "eu", SyncInterval: time.Hour }
+		defer us.Close()
+		defer eu.Close()
+
+		server := httptest.NewServer(eu)
+		defer server.Close()
+		us.Peers = []string{ server.URL }
+
+		name := MockBucketName()
+		asserts.Nil(us.Create(name, 10), "replica.Create should not return an error")
+		asserts.Nil(us.Take(name, 4), "replica.Take should not return an error")
+
+		asserts.Nil(us.Sync(ctx), "replica.Sync should not return an error")
+
+		count, err := eu.Count(name)
+		asserts.Nil(err, "the bucket should reach the other replica")
+		asserts.Equal(6, count, "the take should reach the other replica")
+	})
+}
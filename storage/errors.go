@@ -0,0 +1,110 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+)
+
+// Errors shared by every storage provider. Providers map their own failures onto these so that callers can check for
+// them with errors.Is rather then matching on messages, a provider may wrap one in an *Error to say which bucket it
+// was about and what actually went wrong.
+var (
+	// there were not enough tokens in the bucket to take
+	ErrInsufficientTokens = errors.New("Insufficient tokens.")
+
+	// no bucket exists with the given name, it was never created or it has expired
+	ErrBucketNotFound = errors.New("Bucket not found.")
+
+	// the number of tokens to take or put was 0 or less
+	ErrInvalidAmount = errors.New("Amount must be greater than 0.")
+
+	// the name is already used by something which is not a bucket, or by a bucket which looks like a leftover
+	ErrNameConflict = errors.New("Bucket name is already in use.")
+
+	// the provider could not be reached
+	ErrStorageUnavailable = errors.New("Storage unavailable.")
+
+	// the provider does not implement the extension interface a limiter needs
+	ErrNotSupported = errors.New("Storage does not support this feature.")
+
+	// the lease was released or ran out before it was renewed, whoever held it may no longer act on it
+	ErrLeaseExpired = errors.New("Lease expired.")
+
+	// a leaky bucket already has as many requests waiting as it allows
+	ErrQueueFull = errors.New("Queue is full.")
+
+	// the fill strategy is not one of FillSet, FillAdd or FillFull
+	ErrUnknownStrategy = errors.New("Unknown fill strategy.")
+)
+
+// A failure from a storage provider. errors.Is matches Kind, one of the errors above, and errors.As or errors.Unwrap
+// will find Err, whatever the provider returned in the first place.
+type Error struct {
+	Kind error
+	Name string
+	Err error
+}
+
+func (e *Error) Error() string {
+	message := e.Kind.Error()
+
+	if e.Name != "" {
+		message += " Name: " + e.Name
+	}
+
+	if e.Err != nil {
+		message += " Cause: " + e.Err.Error()
+	}
+
+	return message
+}
+
+func (e *Error) Is(target error) bool {
+	return target == e.Kind
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Reject amounts which would turn a take into a put or do nothing at all.
+func validAmount(tokens int) error {
+	if tokens <= 0 {
+		return ErrInvalidAmount
+	}
+
+	return nil
+}
+
+// Map an error returned by the redis client onto the errors above, errors which are already ours or which we don't
+// recognise are passed through as is.
+func redisError(name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if err == redis.Nil {
+		return &Error{Kind: ErrBucketNotFound, Name: name}
+	}
+
+	var ours *Error
+	if errors.As(err, &ours) {
+		return err
+	}
+
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF || strings.HasPrefix(err.Error(), "redis: client is closed") || strings.HasPrefix(err.Error(), "redis: connection pool timeout") {
+		return &Error{Kind: ErrStorageUnavailable, Name: name, Err: err}
+	}
+
+	// the key holds something which is not a count of tokens
+	if _, ok := err.(*strconv.NumError); ok || strings.HasPrefix(err.Error(), "WRONGTYPE") || strings.Contains(err.Error(), "not an integer") {
+		return &Error{Kind: ErrNameConflict, Name: name, Err: err}
+	}
+
+	return err
+}
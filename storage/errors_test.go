@@ -0,0 +1,105 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func TestErrors(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+
+	stores := []storage.Storage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+
+	for _, store := range stores {
+		t.Run("taking too many tokens returns ErrInsufficientTokens", func(t *testing.T) {
+			name := MockBucketName()
+			err := store.Create(name, 1)
+			asserts.Nil(err, "store.Create should not return an error")
+
+			err = store.Take(name, 2)
+			asserts.True(errors.Is(err, storage.ErrInsufficientTokens), "err should be ErrInsufficientTokens")
+		})
+
+		t.Run("a bucket which was never created returns ErrBucketNotFound", func(t *testing.T) {
+			name := MockBucketName()
+
+			err := store.Take(name, 1)
+			asserts.True(errors.Is(err, storage.ErrBucketNotFound), "store.Take should return ErrBucketNotFound")
+
+			_, err = store.TakeAll(name)
+			asserts.True(errors.Is(err, storage.ErrBucketNotFound), "store.TakeAll should return ErrBucketNotFound")
+
+			_, err = store.Count(name)
+			asserts.True(errors.Is(err, storage.ErrBucketNotFound), "store.Count should return ErrBucketNotFound")
+
+			var storageErr *storage.Error
+			asserts.True(errors.As(err, &storageErr), "err should be a *storage.Error")
+			asserts.Equal(name, storageErr.Name, "the error should name the bucket")
+		})
+
+		t.Run("amounts of 0 or less return ErrInvalidAmount and leave the bucket alone", func(t *testing.T) {
+			name := MockBucketName()
+			err := store.Create(name, 5)
+			asserts.Nil(err, "store.Create should not return an error")
+
+			for _, amount := range []int{ 0, -3 } {
+				err = store.Take(name, amount)
+				asserts.True(errors.Is(err, storage.ErrInvalidAmount), "store.Take should return ErrInvalidAmount")
+
+				err = store.Put(name, amount)
+				asserts.True(errors.Is(err, storage.ErrInvalidAmount), "store.Put should return ErrInvalidAmount")
+
+				_, err = store.(storage.RefillStorage).TakeRefill(context.Background(), name, amount, storage.Refill{ Capacity: 5 })
+				asserts.True(errors.Is(err, storage.ErrInvalidAmount), "store.TakeRefill should return ErrInvalidAmount")
+			}
+
+			count, err := store.Count(name)
+			asserts.Nil(err, "store.Count should not return an error")
+			asserts.Equal(5, count, "count should be unchanged")
+		})
+	}
+
+	t.Run("redis maps a key holding something else to ErrNameConflict", func(t *testing.T) {
+		store := stores[1]
+		name := MockBucketName()
+
+		err := testClient.Set(name, "some_value", 0).Err()
+		asserts.Nil(err, "client.Set should not return an error")
+
+		err = store.Create(name, 10)
+		asserts.True(errors.Is(err, storage.ErrNameConflict), "store.Create should return ErrNameConflict")
+
+		err = store.Take(name, 1)
+		asserts.True(errors.Is(err, storage.ErrNameConflict), "store.Take should return ErrNameConflict")
+
+		err = store.Put(name, 1)
+		asserts.True(errors.Is(err, storage.ErrNameConflict), "store.Put should return ErrNameConflict")
+
+		err = testClient.Set(name, 0, 0).Err()
+		asserts.Nil(err, "client.Set should not return an error")
+
+		err = store.Create(name, 10)
+		asserts.True(errors.Is(err, storage.ErrNameConflict), "store.Create should return ErrNameConflict for a value of 0")
+	})
+
+	t.Run("redis maps connection failures to ErrStorageUnavailable", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: redis.NewClient(brokenRedisOptions) }
+
+		err := store.Ping()
+		asserts.True(errors.Is(err, storage.ErrStorageUnavailable), "store.Ping should return ErrStorageUnavailable")
+
+		err = store.Take(MockBucketName(), 1)
+		asserts.True(errors.Is(err, storage.ErrStorageUnavailable), "store.Take should return ErrStorageUnavailable")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
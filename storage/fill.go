@@ -0,0 +1,173 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// How a fill tops a bucket up, see FillStorage.
+type FillStrategy int
+
+const (
+	// Set the bucket to the given number of tokens whatever it held before, what bucket.Fill has always done.
+	FillSet FillStrategy = iota
+
+	// Add the given number of tokens without going past the capacity.
+	FillAdd
+
+	// Fill the bucket up to its capacity.
+	FillFull
+)
+
+func (strategy FillStrategy) String() string {
+	switch strategy {
+	case FillSet:
+		return "set"
+	case FillAdd:
+		return "add"
+	case FillFull:
+		return "full"
+	default:
+		return "unknown"
+	}
+}
+
+// Storage providers which can fill a bucket in a single atomic operation, so that a fill never races with a take or
+// put made at the same time. Fill returns the token value of the bucket afterwards, or ErrUnknownStrategy for a
+// strategy which isn't one of ours. A bucket which already holds more
+// then its capacity, from tokens put in above it, is left alone by FillAdd and FillFull. Waiters are notified like
+// they are by Put and Set, see NotifyStorage.
+type FillStorage interface {
+	Fill(ctx context.Context, bucketName string, tokens int, capacity int, strategy FillStrategy) (int, error)
+}
+
+// Make sure the strategy is one we know, the providers would each fill the bucket differently otherwise.
+func (strategy FillStrategy) valid() error {
+	switch strategy {
+	case FillSet, FillAdd, FillFull:
+		return nil
+	default:
+		return ErrUnknownStrategy
+	}
+}
+
+// Work out the token value of a bucket holding count tokens once filled.
+func (strategy FillStrategy) fill(count, tokens, capacity int) int {
+	switch strategy {
+	case FillAdd:
+		if count + tokens > capacity {
+			tokens = capacity - count
+		}
+
+		if tokens > 0 {
+			count += tokens
+		}
+	case FillFull:
+		if count < capacity {
+			count = capacity
+		}
+	default:
+		count = tokens
+	}
+
+	return count
+}
+
+// The Lua counterpart of FillStrategy.fill. FillSet writes the bucket with the expiration of RedisStorage like Set
+// does while the others only change the value so the bucket keeps whatever expiration it had, like Put.
+//
+// KEYS: the bucket
+// ARGV: tokens, capacity, strategy, expiration in milliseconds or 0, channel
+//
+// Returns {0, count} or {code, 0} for a bucket which does not exist or holds something other then a number, see
+// scriptError.
+const luaFill = `
+	local key, tokens, capacity, strategy, expiration = KEYS[1], tonumber(ARGV[1]), tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4])
+	local raw = redis.call("GET", key)
+
+	if strategy == 0 then
+		if expiration > 0 then
+			redis.call("SET", key, tokens, "PX", expiration)
+		else
+			redis.call("SET", key, tokens)
+		end
+
+		redis.call("PUBLISH", ARGV[5], "fill")
+		return {0, tokens}
+	end
+
+	if not raw then
+		return {-2, 0}
+	end
+
+	local count = tonumber(raw)
+	if not count then
+		return {-3, 0}
+	end
+
+	local filled
+	if strategy == 1 then
+		filled = math.max(count, math.min(capacity, count + tokens))
+	else
+		filled = math.max(count, capacity)
+	end
+
+	if filled ~= count then
+		redis.call("INCRBY", key, filled - count)
+	end
+
+	redis.call("PUBLISH", ARGV[5], "fill")
+	return {0, filled}
+`
+
+func (ms *MemoryStorage) Fill(ctx context.Context, bucketName string, tokens int, capacity int, strategy FillStrategy) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if err := strategy.valid(); err != nil {
+		return 0, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.buckets == nil {
+		ms.buckets = map[string]int{}
+	}
+
+	count, exists := ms.buckets[bucketName]
+	if !exists && strategy != FillSet {
+		return 0, &Error{Kind: ErrBucketNotFound, Name: bucketName}
+	}
+
+	count = strategy.fill(count, tokens, capacity)
+	ms.buckets[bucketName] = count
+	ms.notify(bucketName)
+	return count, nil
+}
+
+func (rs *RedisStorage) Fill(ctx context.Context, bucketName string, tokens int, capacity int, strategy FillStrategy) (int, error) {
+	if err := strategy.valid(); err != nil {
+		return 0, err
+	}
+
+	args := []interface{}{tokens, capacity, int(strategy), int64(rs.Expiration / time.Millisecond), notifyChannel(bucketName)}
+	reply, err := rs.evalInts(ctx, luaFill, []string{bucketName}, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	if len(reply) != 2 {
+		return 0, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	if reply[0] < 0 {
+		return 0, scriptError(bucketName, reply[0])
+	}
+
+	return int(reply[1]), nil
+}
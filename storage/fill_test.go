@@ -0,0 +1,102 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockFillStorage() []storage.FillStorage {
+	return []storage.FillStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+func TestFillStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+	ctx := context.Background()
+
+	for _, store := range MockFillStorage() {
+		t.Run("storage.FillSet sets the token value whatever it was", func(t *testing.T) {
+			name := MockBucketName()
+
+			count, err := store.Fill(ctx, name, 4, 10, storage.FillSet)
+			asserts.Nil(err, "store.Fill should create a bucket which does not exist")
+			asserts.Equal(4, count, "count should be the tokens set")
+
+			count, err = store.Fill(ctx, name, 2, 10, storage.FillSet)
+			asserts.Nil(err, "store.Fill should not return an error")
+			asserts.Equal(2, count, "count should be the tokens set")
+		})
+
+		t.Run("storage.FillAdd adds tokens without going past the capacity", func(t *testing.T) {
+			name := MockBucketName()
+
+			_, err := store.Fill(ctx, name, 4, 10, storage.FillSet)
+			asserts.Nil(err, "store.Fill should not return an error")
+
+			count, err := store.Fill(ctx, name, 4, 10, storage.FillAdd)
+			asserts.Nil(err, "store.Fill should not return an error")
+			asserts.Equal(8, count, "count should be the tokens added to what was there")
+
+			count, err = store.Fill(ctx, name, 4, 10, storage.FillAdd)
+			asserts.Nil(err, "store.Fill should not return an error")
+			asserts.Equal(10, count, "count should stop at the capacity")
+
+			count, err = store.(storage.Storage).Count(name)
+			asserts.Nil(err, "store.Count should not return an error")
+			asserts.Equal(10, count, "count should be stored")
+		})
+
+		t.Run("storage.FillFull fills the bucket to its capacity", func(t *testing.T) {
+			name := MockBucketName()
+
+			_, err := store.Fill(ctx, name, 3, 10, storage.FillSet)
+			asserts.Nil(err, "store.Fill should not return an error")
+
+			count, err := store.Fill(ctx, name, 1, 10, storage.FillFull)
+			asserts.Nil(err, "store.Fill should not return an error")
+			asserts.Equal(10, count, "count should be the capacity")
+		})
+
+		t.Run("a bucket above its capacity is left alone", func(t *testing.T) {
+			name := MockBucketName()
+
+			_, err := store.Fill(ctx, name, 12, 10, storage.FillSet)
+			asserts.Nil(err, "store.Fill should not return an error")
+
+			for _, strategy := range []storage.FillStrategy{ storage.FillAdd, storage.FillFull } {
+				count, err := store.Fill(ctx, name, 4, 10, strategy)
+				asserts.Nil(err, "store.Fill should not return an error")
+				asserts.Equal(12, count, "count should not be taken down to the capacity by %v", strategy)
+			}
+		})
+
+		t.Run("storage.FillAdd and storage.FillFull need a bucket which exists", func(t *testing.T) {
+			for _, strategy := range []storage.FillStrategy{ storage.FillAdd, storage.FillFull } {
+				_, err := store.Fill(ctx, MockBucketName(), 4, 10, strategy)
+				asserts.True(errors.Is(err, storage.ErrBucketNotFound), "store.Fill should return ErrBucketNotFound for %v", strategy)
+			}
+		})
+
+		t.Run("a strategy which isn't one of ours is refused", func(t *testing.T) {
+			name := MockBucketName()
+			asserts.Nil(store.(storage.Storage).Create(name, 2), "store.Create should not return an error")
+
+			_, err := store.Fill(ctx, name, 4, 10, storage.FillStrategy(7))
+			asserts.Equal(storage.ErrUnknownStrategy, err, "store.Fill should return ErrUnknownStrategy")
+
+			count, err := store.(storage.Storage).Count(name)
+			asserts.Nil(err, "store.Count should not return an error")
+			asserts.Equal(2, count, "the bucket should be left alone")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
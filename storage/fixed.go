@@ -0,0 +1,136 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Storage providers which count tokens in fixed windows of time. Every window is its own key, named after the
+// limiter key and the start of the window, and it expires along with the window so nothing is left behind.
+//
+// The start of a window is worked out from the clock of the caller, so nodes sharing a limiter should keep their
+// clocks in sync or they may disagree about where windows begin.
+type FixedWindowStorage interface {
+	TakeFixed(ctx context.Context, key string, tokens int, window Window) (Decision, error)
+}
+
+// The count of a fixed window and the time it ends.
+type fixedWindow struct {
+	count int
+	end time.Time
+}
+
+// Name the key of the fixed window containing now and return the time that window ends.
+func fixedWindowKey(key string, window Window, now time.Time) (string, time.Time) {
+	start := now.Truncate(window.Length)
+	return fmt.Sprintf("%s:%d", key, start.UnixNano() / int64(time.Millisecond)), start.Add(window.Length)
+}
+
+// Fill in a decision for a fixed window holding count tokens after a take of tokens was or was not allowed.
+func fixedDecision(allowed bool, count, tokens int, window Window, end, now time.Time) Decision {
+	decision := Decision{Allowed: allowed, Limit: window.Limit}
+
+	if count < window.Limit {
+		decision.Remaining = window.Limit - count
+	}
+
+	if !allowed {
+		decision.RetryAfter = end.Sub(now)
+		if tokens > window.Limit {
+			decision.RetryAfter = -1
+		}
+	}
+
+	if count > 0 {
+		decision.ResetAfter = end.Sub(now)
+	}
+
+	return decision
+}
+
+const (
+	// KEYS: the key of the current window
+	// ARGV: limit, tokens, the milliseconds left in the window
+	//
+	// Returns {allowed, count}. The key is given an expiry the first time it is written, relative to the redis clock so
+	// that a caller whose clock runs ahead can't expire the window early.
+	luaTakeFixed = `
+		local key = KEYS[1]
+		local limit = tonumber(ARGV[1])
+		local amount = tonumber(ARGV[2])
+		local count = tonumber(redis.call("GET", key)) or 0
+
+		if count + amount > limit then
+			return {0, count}
+		end
+
+		count = redis.call("INCRBY", key, amount)
+		if count == amount then
+			redis.call("PEXPIRE", key, ARGV[3])
+		end
+
+		return {1, count}
+	`
+)
+
+func (ms *MemoryStorage) TakeFixed(ctx context.Context, key string, tokens int, window Window) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.fixed == nil {
+		ms.fixed = map[string]*fixedWindow{}
+	}
+
+	now := time.Now()
+	key, end := fixedWindowKey(key, window, now)
+
+	fw, exists := ms.fixed[key]
+	if !exists {
+		fw = &fixedWindow{end: end}
+		ms.fixed[key] = fw
+	}
+
+	allowed := fw.count+tokens <= window.Limit
+	if allowed {
+		fw.count += tokens
+	}
+
+	ms.sweepInBackground()
+	return fixedDecision(allowed, fw.count, tokens, window, end, now), nil
+}
+
+func (rs *RedisStorage) TakeFixed(ctx context.Context, key string, tokens int, window Window) (Decision, error) {
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	now := time.Now()
+	key, end := fixedWindowKey(key, window, now)
+
+	left := end.Sub(now) / time.Millisecond
+	if left < 1 {
+		left = 1
+	}
+
+	reply, err := rs.evalInts(ctx, luaTakeFixed, []string{key}, window.Limit, tokens, int64(left))
+
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if len(reply) != 2 {
+		return Decision{}, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	return fixedDecision(reply[0] == 1, int(reply[1]), tokens, window, end, now), nil
+}
@@ -0,0 +1,79 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockFixedWindowStorage() []storage.FixedWindowStorage {
+	return []storage.FixedWindowStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+func TestFixedWindowStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+	window := storage.Window{ Limit: 3, Length: time.Millisecond * 50 }
+
+	for _, store := range MockFixedWindowStorage() {
+		t.Run("store.TakeFixed counts tokens within a window and starts over in the next", func(t *testing.T) {
+			name := MockBucketName()
+
+			// line up with the start of a window so the test does not straddle two
+			time.Sleep(time.Until(time.Now().Truncate(window.Length).Add(window.Length)))
+
+			decision, err := store.TakeFixed(context.Background(), name, 3, window)
+			asserts.Nil(err, "store.TakeFixed should not return an error")
+			asserts.True(decision.Allowed, "take within the limit should be allowed")
+			asserts.Equal(0, decision.Remaining, "no tokens should remain")
+
+			decision, err = store.TakeFixed(context.Background(), name, 1, window)
+			asserts.Nil(err, "store.TakeFixed should not return an error")
+			asserts.False(decision.Allowed, "take past the limit should not be allowed")
+			asserts.True(decision.RetryAfter > 0 && decision.RetryAfter <= window.Length, "retry after should be the end of the window")
+
+			time.Sleep(decision.RetryAfter)
+
+			decision, err = store.TakeFixed(context.Background(), name, 1, window)
+			asserts.Nil(err, "store.TakeFixed should not return an error")
+			asserts.True(decision.Allowed, "the next window should start over")
+		})
+	}
+
+	t.Run("redis windows are given an expiry", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient }
+		name := MockBucketName()
+
+		_, err := store.TakeFixed(context.Background(), name, 1, storage.Window{ Limit: 3, Length: time.Hour })
+		asserts.Nil(err, "store.TakeFixed should not return an error")
+
+		keys, err := testClient.Keys(name + ":*").Result()
+		asserts.Nil(err, "client.Keys should not return an error")
+		asserts.Len(keys, 1, "there should be one key for the window")
+
+		ttl, err := testClient.PTTL(keys[0]).Result()
+		asserts.Nil(err, "client.PTTL should not return an error")
+		asserts.True(ttl > 0 && ttl <= time.Hour, "window key should expire with the window")
+	})
+
+	t.Run("redis buckets with a refill rate expire once they would be full again", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient }
+		name := MockBucketName()
+
+		_, err := store.TakeRefill(context.Background(), name, 5, storage.Refill{ Capacity: 10, Rate: 1, Interval: time.Second })
+		asserts.Nil(err, "store.TakeRefill should not return an error")
+
+		ttl, err := testClient.PTTL(name).Result()
+		asserts.Nil(err, "client.PTTL should not return an error")
+		asserts.True(ttl > time.Second * 4 && ttl <= time.Second * 5, "bucket should expire when it would be full")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
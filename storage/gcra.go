@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// GCRA describes a limiter which uses the generic cell rate algorithm. Rate requests are allowed every Period,
+// evenly spaced, with up to Burst requests allowed on top of that at once.
+//
+// Instead of a token value the only thing stored per key is the theoretical arrival time (TAT) of the next request,
+// which makes it a good fit for keys which are cheap and numerous, like one per IP address.
+type GCRA struct {
+	Burst  int
+	Rate   int
+	Period time.Duration
+}
+
+// Storage providers which can store the theoretical arrival times of a GCRA limiter. Throttle is modeled on
+// redis-cell's CL.THROTTLE, it takes quantity from the key and reports the outcome in a single atomic operation.
+type GCRAStorage interface {
+	Throttle(ctx context.Context, key string, quantity int, gcra GCRA) (Decision, error)
+}
+
+// the time between two evenly spaced requests, the scripts work in microseconds so a Rate which would space requests
+// closer then that is as fast as they go
+func (gcra GCRA) emission() time.Duration {
+	emission := gcra.Period / time.Duration(gcra.Rate)
+	if emission < time.Microsecond {
+		return time.Microsecond
+	}
+
+	return emission
+}
+
+// how far ahead of now the theoretical arrival time is allowed to get
+func (gcra GCRA) tolerance() time.Duration {
+	return gcra.emission() * time.Duration(gcra.Burst+1)
+}
+
+// Take quantity from a key whose theoretical arrival time is tat as of now. It returns the decision and the new
+// theoretical arrival time, which is unchanged if the request was not allowed.
+func (gcra GCRA) throttle(tat, now time.Time, quantity int) (Decision, time.Time) {
+	emission := gcra.emission()
+	tolerance := gcra.tolerance()
+	increment := emission * time.Duration(quantity)
+	decision := Decision{Limit: gcra.Burst + 1}
+
+	if tat.Before(now) {
+		tat = now
+	}
+
+	next := tat.Add(increment)
+	diff := now.Sub(next.Add(-tolerance))
+
+	if diff < 0 {
+		decision.RetryAfter = -diff
+		if increment > tolerance {
+			decision.RetryAfter = -1
+		}
+	} else {
+		decision.Allowed = true
+		tat = next
+	}
+
+	decision.ResetAfter = tat.Sub(now)
+	if left := tolerance - decision.ResetAfter; left >= 0 {
+		decision.Remaining = int(left / emission)
+	}
+
+	return decision, tat
+}
+
+const (
+	// KEYS: the key holding the theoretical arrival time
+	// ARGV: emission interval, tolerance, quantity
+	//
+	// Returns {allowed, remaining, retry after, reset after} with times in microseconds. The key expires once the
+	// theoretical arrival time has passed since from then on a missing key means the same thing.
+	luaThrottle = luaNow + `
+		local key = KEYS[1]
+		local emission = tonumber(ARGV[1])
+		local tolerance = tonumber(ARGV[2])
+		local increment = emission * tonumber(ARGV[3])
+
+		local tat = tonumber(redis.call("GET", key)) or now
+		if tat < now then
+			tat = now
+		end
+
+		local allowed = 0
+		local retry = 0
+		local diff = now - (tat + increment - tolerance)
+
+		if diff < 0 then
+			retry = -diff
+			if increment > tolerance then
+				retry = -1
+			end
+		else
+			allowed = 1
+			tat = tat + increment
+			redis.call("SET", key, string.format("%.0f", tat), "PX", math.max(1, math.ceil((tat - now) / 1000)))
+		end
+
+		local remaining = 0
+		if tolerance - (tat - now) >= 0 then
+			remaining = math.floor((tolerance - (tat - now)) / emission)
+		end
+
+		return {allowed, remaining, retry, tat - now}
+	`
+)
+
+func (ms *MemoryStorage) Throttle(ctx context.Context, key string, quantity int, gcra GCRA) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(quantity); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.tats == nil {
+		ms.tats = map[string]time.Time{}
+	}
+
+	now := time.Now()
+	tat, exists := ms.tats[key]
+	if !exists {
+		tat = now
+	}
+
+	decision, tat := gcra.throttle(tat, now, quantity)
+	ms.tats[key] = tat
+
+	ms.sweepInBackground()
+	return decision, nil
+}
+
+func (rs *RedisStorage) Throttle(ctx context.Context, key string, quantity int, gcra GCRA) (Decision, error) {
+	if err := validAmount(quantity); err != nil {
+		return Decision{}, err
+	}
+
+	return rs.evalDecision(ctx, luaThrottle, []string{key}, gcra.Burst + 1, micros(gcra.emission()), micros(gcra.tolerance()), quantity)
+}
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// One bucket's part in a group take, see GroupStorage.
+type Withdrawal struct {
+	Name string
+	Tokens int
+	Refill Refill
+
+	// A forced withdrawal is taken whenever the rest of the group is, even if the bucket is left short and its token
+	// value goes below 0. The bucket then owes tokens which its refill pays back before it has any to give again.
+	Force bool
+}
+
+// Storage providers which can take from several buckets at once, for example charging a request against a per-user,
+// a per-tenant and a global bucket. Either every bucket has enough tokens and they are all taken from or none of them
+// are touched.
+//
+// There is one decision per withdrawal in the same order. They are all allowed or none of them are, a bucket which had
+// enough tokens for a group which was refused has a RetryAfter of 0 and so does a forced one. A bucket named by several
+// withdrawals must have enough tokens for all of them which are not forced.
+type GroupStorage interface {
+	TakeGroup(ctx context.Context, withdrawals []Withdrawal) ([]Decision, error)
+}
+
+// the tokens each bucket in the group must have and the tokens forced out of it in total, in case a bucket is named
+// more then once
+func needs(withdrawals []Withdrawal) (map[string]int, map[string]int, error) {
+	need, force := map[string]int{}, map[string]int{}
+
+	for _, withdrawal := range withdrawals {
+		if err := validAmount(withdrawal.Tokens); err != nil {
+			return nil, nil, err
+		}
+
+		if withdrawal.Force {
+			force[withdrawal.Name] += withdrawal.Tokens
+		} else {
+			need[withdrawal.Name] += withdrawal.Tokens
+		}
+	}
+
+	return need, force, nil
+}
+
+// A bucket named more then once is loaded once and asked for every withdrawal at the same time, with the refill of the
+// first withdrawal naming it.
+//
+// KEYS: see refillKeys for each withdrawal in turn
+// ARGV: tokens, 1 if forced and otherwise 0 followed by Refill.args for each withdrawal in turn
+//
+// Returns {allowed, remaining, retry after, reset after} for each withdrawal in turn, see decide.
+const luaTakeGroup = luaBucket + `
+	local buckets, need, force, order = {}, {}, {}, {}
+
+	for i = 1, #KEYS / 3 do
+		local k, a = (i - 1) * 3 + 1, (i - 1) * 7 + 1
+		local key = KEYS[k]
+
+		if not buckets[key] then
+			buckets[key] = load(k, a + 2)
+			need[key], force[key] = 0, 0
+		end
+
+		if ARGV[a + 1] == "1" then
+			force[key] = force[key] + tonumber(ARGV[a])
+		else
+			need[key] = need[key] + tonumber(ARGV[a])
+		end
+
+		order[i] = key
+	end
+
+	local allowed = 1
+	for key, b in pairs(buckets) do
+		if b.count < need[key] then
+			allowed = 0
+		end
+	end
+
+	if allowed == 1 then
+		for key, b in pairs(buckets) do
+			b.count = b.count - need[key] - force[key]
+			save(b)
+		end
+	end
+
+	-- a refused group only ever waits on the tokens it needs, forced withdrawals never hold it up
+	local reply = {}
+	for _, key in ipairs(order) do
+		local amount = need[key]
+		if allowed == 1 then
+			amount = amount + force[key]
+		end
+
+		local decision = decide(buckets[key], allowed, amount)
+		if allowed == 0 and need[key] == 0 then
+			decision[3] = 0
+		end
+
+		for _, value in ipairs(decision) do
+			table.insert(reply, value)
+		end
+	end
+
+	return reply
+`
+
+func (ms *MemoryStorage) TakeGroup(ctx context.Context, withdrawals []Withdrawal) ([]Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	need, force, err := needs(withdrawals)
+	if err != nil {
+		return nil, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	counts := map[string]int{}
+	refills := map[string]Refill{}
+	allowed := true
+
+	for _, withdrawal := range withdrawals {
+		if _, loaded := counts[withdrawal.Name]; loaded {
+			continue
+		}
+
+		counts[withdrawal.Name] = ms.refill(withdrawal.Name, withdrawal.Refill, now)
+		refills[withdrawal.Name] = withdrawal.Refill
+		allowed = allowed && counts[withdrawal.Name] >= need[withdrawal.Name]
+	}
+
+	if allowed {
+		for name, count := range counts {
+			counts[name] = count - need[name] - force[name]
+			ms.buckets[name] = counts[name]
+		}
+	}
+
+	decisions := make([]Decision, len(withdrawals))
+	for i, withdrawal := range withdrawals {
+		name := withdrawal.Name
+
+		// see luaTakeGroup
+		amount := need[name]
+		if allowed {
+			amount += force[name]
+		}
+
+		decisions[i] = refills[name].decide(allowed, counts[name], amount, ms.refilled[name], ms.warmth[name], now)
+		if !allowed && need[name] == 0 {
+			decisions[i].RetryAfter = 0
+		}
+	}
+
+	return decisions, nil
+}
+
+func (rs *RedisStorage) TakeGroup(ctx context.Context, withdrawals []Withdrawal) ([]Decision, error) {
+	if _, _, err := needs(withdrawals); err != nil {
+		return nil, err
+	}
+
+	if len(withdrawals) == 0 {
+		return []Decision{}, nil
+	}
+
+	var keys []string
+	var args []interface{}
+
+	for _, withdrawal := range withdrawals {
+		keys = append(keys, refillKeys(withdrawal.Name)...)
+		force := 0
+		if withdrawal.Force {
+			force = 1
+		}
+
+		args = append(append(args, withdrawal.Tokens, force), withdrawal.Refill.args()...)
+	}
+
+	reply, err := rs.evalInts(ctx, luaTakeGroup, keys, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(reply) != len(withdrawals) * 4 {
+		return nil, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	decisions := make([]Decision, len(withdrawals))
+	for i, withdrawal := range withdrawals {
+		if decisions[i], err = decisionFromReply(reply[i * 4:i * 4 + 4], withdrawal.Refill.Capacity); err != nil {
+			return nil, err
+		}
+	}
+
+	return decisions, nil
+}
@@ -0,0 +1,110 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockGroupStorage() []storage.GroupStorage {
+	return []storage.GroupStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+func TestGroupStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+	refill := storage.Refill{ Capacity: 10, Rate: 1, Interval: time.Minute }
+
+	for _, store := range MockGroupStorage() {
+		t.Run("store.TakeGroup takes from every bucket or from none", func(t *testing.T) {
+			user, tenant, global := MockBucketName(), MockBucketName(), MockBucketName()
+
+			withdrawals := []storage.Withdrawal{
+				{ Name: user, Tokens: 3, Refill: refill },
+				{ Name: tenant, Tokens: 3, Refill: refill },
+				{ Name: global, Tokens: 3, Refill: refill },
+			}
+
+			// leave the global bucket short
+			_, err := store.TakeGroup(context.Background(), []storage.Withdrawal{{ Name: global, Tokens: 8, Refill: refill }})
+			asserts.Nil(err, "store.TakeGroup should not return an error")
+
+			decisions, err := store.TakeGroup(context.Background(), withdrawals)
+			asserts.Nil(err, "store.TakeGroup should not return an error for insufficient tokens")
+			asserts.Len(decisions, 3, "there should be a decision for each withdrawal")
+
+			for _, decision := range decisions {
+				asserts.False(decision.Allowed, "no withdrawal should be allowed if one bucket is short")
+			}
+
+			asserts.Equal(10, decisions[0].Remaining, "the user bucket should be untouched")
+			asserts.Equal(time.Duration(0), decisions[0].RetryAfter, "the user bucket had enough tokens")
+			asserts.Equal(2, decisions[2].Remaining, "the global bucket should be untouched")
+			asserts.True(decisions[2].RetryAfter > 0, "the global bucket should say when it will have enough")
+
+			withdrawals[2].Tokens = 2
+			decisions, err = store.TakeGroup(context.Background(), withdrawals)
+			asserts.Nil(err, "store.TakeGroup should not return an error")
+
+			for _, decision := range decisions {
+				asserts.True(decision.Allowed, "every withdrawal should be allowed")
+			}
+
+			asserts.Equal(7, decisions[0].Remaining, "the user bucket should be taken from")
+			asserts.Equal(7, decisions[1].Remaining, "the tenant bucket should be taken from")
+			asserts.Equal(0, decisions[2].Remaining, "the global bucket should be taken from")
+		})
+
+		t.Run("a bucket named twice must have enough for both withdrawals", func(t *testing.T) {
+			name := MockBucketName()
+			withdrawals := []storage.Withdrawal{{ Name: name, Tokens: 6, Refill: refill }, { Name: name, Tokens: 6, Refill: refill }}
+
+			decisions, err := store.TakeGroup(context.Background(), withdrawals)
+			asserts.Nil(err, "store.TakeGroup should not return an error for insufficient tokens")
+			asserts.False(decisions[0].Allowed, "12 tokens should not be taken from a bucket of 10")
+
+			count, err := store.(storage.RefillStorage).CountRefill(context.Background(), name, refill)
+			asserts.Nil(err, "store.CountRefill should not return an error")
+			asserts.Equal(10, count, "the bucket should be untouched")
+		})
+
+		t.Run("a forced withdrawal is taken even if it leaves the bucket short", func(t *testing.T) {
+			child, parent := MockBucketName(), MockBucketName()
+
+			_, err := store.TakeGroup(context.Background(), []storage.Withdrawal{{ Name: parent, Tokens: 8, Refill: refill }})
+			asserts.Nil(err, "store.TakeGroup should not return an error")
+
+			withdrawals := []storage.Withdrawal{{ Name: child, Tokens: 5, Refill: refill }, { Name: parent, Tokens: 5, Refill: refill, Force: true }}
+			decisions, err := store.TakeGroup(context.Background(), withdrawals)
+			asserts.Nil(err, "store.TakeGroup should not return an error")
+			asserts.True(decisions[0].Allowed, "a short forced withdrawal should not hold up the group")
+
+			count, err := store.(storage.RefillStorage).CountRefill(context.Background(), parent, refill)
+			asserts.Nil(err, "store.CountRefill should not return an error")
+			asserts.Equal(-3, count, "the forced bucket should owe tokens")
+
+			withdrawals[0].Tokens = 6
+			decisions, err = store.TakeGroup(context.Background(), withdrawals)
+			asserts.Nil(err, "store.TakeGroup should not return an error")
+			asserts.False(decisions[0].Allowed, "the child should be short")
+			asserts.Equal(time.Duration(0), decisions[1].RetryAfter, "a forced withdrawal should never be waited on")
+		})
+
+		t.Run("an invalid amount fails the whole group", func(t *testing.T) {
+			withdrawals := []storage.Withdrawal{{ Name: MockBucketName(), Tokens: 1, Refill: refill }, { Name: MockBucketName(), Tokens: 0, Refill: refill }}
+
+			_, err := store.TakeGroup(context.Background(), withdrawals)
+			asserts.True(errors.Is(err, storage.ErrInvalidAmount), "store.TakeGroup should return ErrInvalidAmount")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
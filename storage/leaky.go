@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Leak describes a leaky bucket in the style of nginx's limit_req. Requests join a queue which drains at Rate requests
+// every Interval and are released one by one as it drains. Up to Burst requests may wait in the queue, requests which
+// would go beyond that are rejected. With NoDelay queued requests go ahead immediately rather then waiting for their
+// turn, though they still take up room in the queue until it drains.
+type Leak struct {
+	Rate     int
+	Interval time.Duration
+	Burst    int
+	NoDelay  bool
+}
+
+// Storage providers which can hold the depth of a leaky bucket queue. The depth is shared so any number of nodes may
+// drain one logical queue, Leak joins the queue and reports the delay in a single atomic operation.
+type LeakyStorage interface {
+	Leak(ctx context.Context, key string, requests int, leak Leak) (Decision, error)
+}
+
+// The depth of a queue as of the last time a request joined it.
+type leakyQueue struct {
+	depth float64
+	last time.Time
+
+	// once the queue has drained it may be swept away, see sweep.go
+	expires time.Time
+}
+
+// the time it takes the queue to drain a single request
+func (leak Leak) period() float64 {
+	return float64(leak.Interval) / float64(leak.Rate)
+}
+
+// Join requests to a queue which was depth deep elapsed ago. The depth is the number of requests ahead of the steady
+// rate, a request arriving at an empty queue does not count towards it. Returns the decision and the new depth which
+// is unchanged if the requests were rejected.
+func (leak Leak) join(depth float64, elapsed time.Duration, requests int) (Decision, float64) {
+	period := leak.period()
+	decision := Decision{Limit: leak.Burst + 1}
+
+	// this is what nginx does for a single request, the rest of the requests queue up behind it
+	base := depth - float64(elapsed)/period
+	excess := math.Max(0, base+1) + float64(requests) - 1
+
+	if excess > float64(leak.Burst) {
+		decision.RetryAfter = time.Duration(math.Ceil((base + float64(requests) - float64(leak.Burst)) * period))
+		if requests > leak.Burst+1 {
+			decision.RetryAfter = -1
+		}
+
+		excess = math.Max(0, base)
+	} else {
+		decision.Allowed = true
+		if !leak.NoDelay {
+			decision.Delay = time.Duration(math.Ceil(excess * period))
+		}
+	}
+
+	decision.Remaining = int(math.Max(0, math.Floor(float64(leak.Burst)-excess)))
+	decision.ResetAfter = time.Duration(math.Ceil(excess * period))
+
+	return decision, excess
+}
+
+const (
+	// KEYS: the hash holding the depth of the queue and the last time a request joined it
+	// ARGV: period, burst, requests, nodelay
+	//
+	// The Lua counterpart of Leak.join with times in microseconds. Returns {allowed, remaining, retry after, reset
+	// after, delay}. The key expires once the queue has drained since a missing queue is an empty one which has had time
+	// to drain.
+	luaLeak = luaNow + `
+		local key = KEYS[1]
+		local period = tonumber(ARGV[1])
+		local burst = tonumber(ARGV[2])
+		local amount = tonumber(ARGV[3])
+
+		local state = redis.call("HMGET", key, "depth", "last")
+		local depth = tonumber(state[1]) or 0
+		local last = tonumber(state[2]) or (now - period)
+
+		local base = depth - (now - last) / period
+		local excess = math.max(0, base + 1) + amount - 1
+		local allowed = 0
+		local retry = 0
+		local delay = 0
+
+		if excess > burst then
+			retry = math.ceil((base + amount - burst) * period)
+			if amount > burst + 1 then
+				retry = -1
+			end
+
+			excess = math.max(0, base)
+		else
+			allowed = 1
+			if ARGV[4] ~= "1" then
+				delay = math.ceil(excess * period)
+			end
+
+			redis.call("HMSET", key, "depth", string.format("%.6f", excess), "last", string.format("%.0f", now))
+			redis.call("PEXPIRE", key, math.max(1, math.ceil(excess * period / 1000)))
+		end
+
+		return {allowed, math.max(0, math.floor(burst - excess)), retry, math.ceil(excess * period), delay}
+	`
+)
+
+func (ms *MemoryStorage) Leak(ctx context.Context, key string, requests int, leak Leak) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(requests); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.queues == nil {
+		ms.queues = map[string]*leakyQueue{}
+	}
+
+	// a new queue is an empty one which has had time to drain
+	now := time.Now()
+	queue, exists := ms.queues[key]
+	if !exists {
+		queue = &leakyQueue{last: now.Add(-time.Duration(leak.period()))}
+		ms.queues[key] = queue
+	}
+
+	decision, depth := leak.join(queue.depth, now.Sub(queue.last), requests)
+	if decision.Allowed {
+		queue.depth, queue.last = depth, now
+		queue.expires = now.Add(decision.ResetAfter)
+	}
+
+	ms.sweepInBackground()
+	return decision, nil
+}
+
+func (rs *RedisStorage) Leak(ctx context.Context, key string, requests int, leak Leak) (Decision, error) {
+	if err := validAmount(requests); err != nil {
+		return Decision{}, err
+	}
+
+	nodelay := 0
+	if leak.NoDelay {
+		nodelay = 1
+	}
+
+	reply, err := rs.evalInts(ctx, luaLeak, []string{key}, leak.period() / float64(time.Microsecond), leak.Burst, requests, nodelay)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if len(reply) != 5 {
+		return Decision{}, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	decision, err := decisionFromReply(reply[:4], leak.Burst + 1)
+	if err != nil {
+		return Decision{}, err
+	}
+
+	decision.Delay = time.Duration(reply[4]) * time.Microsecond
+	return decision, nil
+}
@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// LeasingStorage hands out tokens from memory which it takes from a shared storage provider, usually a RedisStorage,
+// in blocks of BlockSize. Most takes never leave the node and every token is still taken from the shared bucket
+// exactly once, so the limit across every node stays exact. A node fetches its next block in the background once its
+// stock runs low and gives the tokens it has left back to the shared bucket once they have gone TTL without a fetch,
+// or on Close. Tokens which can't be given back are kept and given back again once the next lease runs out.
+//
+// Tokens leased by one node are out of reach of the others until it gives them back, so the block size should be
+// small next to the capacity of the bucket. Count is the shared token value plus this node's stock, it can't see the
+// stock of other nodes. Set drops this node's stock. Buckets with a refill rate are not supported.
+type LeasingStorage struct {
+	Storage Storage
+
+	// Optional, the tokens taken from the shared bucket at once, defaults to 10. Takes of more then BlockSize take
+	// what they are short of in one go.
+	BlockSize int
+
+	// Optional, how long leased tokens are kept after the last fetch before they are given back, defaults to one
+	// second.
+	TTL time.Duration
+
+	mutex sync.Mutex
+	leases map[string]*tokenLease
+}
+
+// The tokens of a bucket a node holds.
+type tokenLease struct {
+	mutex sync.Mutex
+	tokens int
+	fetching bool
+
+	// once returned the lease is out of the map and holds no tokens, a take which finds it looks again
+	returned bool
+	timer *time.Timer
+}
+
+func (ls *LeasingStorage) blockSize() int {
+	if ls.BlockSize <= 0 {
+		return 10
+	}
+
+	return ls.BlockSize
+}
+
+func (ls *LeasingStorage) ttl() time.Duration {
+	if ls.TTL <= 0 {
+		return time.Second
+	}
+
+	return ls.TTL
+}
+
+// the lease of a bucket, locked
+func (ls *LeasingStorage) lease(bucketName string) *tokenLease {
+	for {
+		ls.mutex.Lock()
+		if ls.leases == nil {
+			ls.leases = map[string]*tokenLease{}
+		}
+
+		lease, ok := ls.leases[bucketName]
+		if !ok {
+			lease = &tokenLease{}
+			lease.timer = time.AfterFunc(ls.ttl(), func() { ls.giveBack(context.Background(), bucketName, lease) })
+			ls.leases[bucketName] = lease
+		}
+		ls.mutex.Unlock()
+
+		lease.mutex.Lock()
+		if !lease.returned {
+			return lease
+		}
+		lease.mutex.Unlock()
+	}
+}
+
+// Give the tokens of the lease back to the shared bucket and drop it.
+func (ls *LeasingStorage) giveBack(ctx context.Context, bucketName string, lease *tokenLease) error {
+	ls.mutex.Lock()
+	if ls.leases[bucketName] == lease {
+		delete(ls.leases, bucketName)
+	}
+	ls.mutex.Unlock()
+
+	lease.mutex.Lock()
+	lease.timer.Stop()
+	tokens := lease.tokens
+	lease.tokens, lease.returned = 0, true
+	lease.mutex.Unlock()
+
+	if tokens <= 0 {
+		return nil
+	}
+
+	if err := WithContext(ls.Storage).PutContext(ctx, bucketName, tokens); err != nil {
+		ls.keep(bucketName, tokens)
+		return err
+	}
+
+	return nil
+}
+
+// Keep tokens which couldn't be given back in the stock of the bucket's lease rather then lose them, they are handed
+// out from there or given back again once the lease runs out.
+func (ls *LeasingStorage) keep(bucketName string, tokens int) {
+	lease := ls.lease(bucketName)
+	defer lease.mutex.Unlock()
+
+	lease.tokens += tokens
+}
+
+// Take more tokens for the lease, the caller must hold its lock. The tokens are kept for another TTL.
+func (ls *LeasingStorage) fetch(ctx context.Context, bucketName string, lease *tokenLease, tokens int) error {
+	if err := WithContext(ls.Storage).TakeContext(ctx, bucketName, tokens); err != nil {
+		return err
+	}
+
+	lease.tokens += tokens
+	lease.timer.Reset(ls.ttl())
+	return nil
+}
+
+// Fetch the next block in the background once the stock runs below a quarter of a block, the caller must hold the
+// lock of the lease.
+func (ls *LeasingStorage) prefetch(bucketName string, lease *tokenLease) {
+	if lease.fetching || lease.tokens * 4 >= ls.blockSize() {
+		return
+	}
+
+	lease.fetching = true
+
+	go func() {
+		err := WithContext(ls.Storage).TakeContext(context.Background(), bucketName, ls.blockSize())
+
+		lease.mutex.Lock()
+		lease.fetching = false
+		returned := lease.returned
+
+		if err == nil && !returned {
+			lease.tokens += ls.blockSize()
+			lease.timer.Reset(ls.ttl())
+		}
+		lease.mutex.Unlock()
+
+		// the lease was given back while we were fetching
+		if err == nil && returned {
+			if err := WithContext(ls.Storage).PutContext(context.Background(), bucketName, ls.blockSize()); err != nil {
+				ls.keep(bucketName, ls.blockSize())
+			}
+		}
+	}()
+}
+
+// Give every leased token back to the shared storage provider, for example on shutdown. The storage may still be used
+// afterwards, it leases tokens again as it needs them.
+func (ls *LeasingStorage) Close() error {
+	ls.mutex.Lock()
+	leases := ls.leases
+	ls.leases = nil
+	ls.mutex.Unlock()
+
+	// give back as much as we can, the first error is returned
+	var first error
+	for name, lease := range leases {
+		if err := ls.giveBack(context.Background(), name, lease); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+func (ls *LeasingStorage) Ping() error {
+	return ls.PingContext(context.Background())
+}
+
+func (ls *LeasingStorage) Create(name string, capacity int) error {
+	return ls.CreateContext(context.Background(), name, capacity)
+}
+
+func (ls *LeasingStorage) Take(bucketName string, tokens int) error {
+	return ls.TakeContext(context.Background(), bucketName, tokens)
+}
+
+func (ls *LeasingStorage) TakeAll(bucketName string) (int, error) {
+	return ls.TakeAllContext(context.Background(), bucketName)
+}
+
+func (ls *LeasingStorage) Set(bucketName string, tokens int) error {
+	return ls.SetContext(context.Background(), bucketName, tokens)
+}
+
+func (ls *LeasingStorage) Put(bucketName string, tokens int) error {
+	return ls.PutContext(context.Background(), bucketName, tokens)
+}
+
+func (ls *LeasingStorage) Count(bucketName string) (int, error) {
+	return ls.CountContext(context.Background(), bucketName)
+}
+
+func (ls *LeasingStorage) PingContext(ctx context.Context) error {
+	return WithContext(ls.Storage).PingContext(ctx)
+}
+
+func (ls *LeasingStorage) CreateContext(ctx context.Context, name string, capacity int) error {
+	return WithContext(ls.Storage).CreateContext(ctx, name, capacity)
+}
+
+// Take from the local stock, fetching a block first if it is short. When the shared bucket can't spare a whole block
+// only the tokens the take is short of are fetched.
+func (ls *LeasingStorage) TakeContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := validAmount(tokens); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	lease := ls.lease(bucketName)
+	defer lease.mutex.Unlock()
+
+	if short := tokens - lease.tokens; short > 0 {
+		block := ls.blockSize()
+		if short > block {
+			block = short
+		}
+
+		err := ls.fetch(ctx, bucketName, lease, block)
+		if errors.Is(err, ErrInsufficientTokens) && block > short {
+			err = ls.fetch(ctx, bucketName, lease, short)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	lease.tokens -= tokens
+	ls.prefetch(bucketName, lease)
+	return nil
+}
+
+// Empty the shared bucket and the local stock.
+func (ls *LeasingStorage) TakeAllContext(ctx context.Context, bucketName string) (int, error) {
+	lease := ls.lease(bucketName)
+	defer lease.mutex.Unlock()
+
+	count, err := WithContext(ls.Storage).TakeAllContext(ctx, bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	count, lease.tokens = count + lease.tokens, 0
+	return count, nil
+}
+
+// Set the shared token value and drop the local stock.
+func (ls *LeasingStorage) SetContext(ctx context.Context, bucketName string, tokens int) error {
+	lease := ls.lease(bucketName)
+	defer lease.mutex.Unlock()
+
+	if err := WithContext(ls.Storage).SetContext(ctx, bucketName, tokens); err != nil {
+		return err
+	}
+
+	lease.tokens = 0
+	return nil
+}
+
+// Puts go straight to the shared bucket so other nodes can use the tokens.
+func (ls *LeasingStorage) PutContext(ctx context.Context, bucketName string, tokens int) error {
+	return WithContext(ls.Storage).PutContext(ctx, bucketName, tokens)
+}
+
+// The shared token value plus the local stock, a block being fetched in the background is missed until it arrives.
+func (ls *LeasingStorage) CountContext(ctx context.Context, bucketName string) (int, error) {
+	lease := ls.lease(bucketName)
+	defer lease.mutex.Unlock()
+
+	count, err := WithContext(ls.Storage).CountContext(ctx, bucketName)
+	if err != nil {
+		return 0, err
+	}
+
+	return count + lease.tokens, nil
+}
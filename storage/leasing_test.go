@@ -0,0 +1,167 @@
+package storage_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockSharedStorage() []storage.Storage {
+	return []storage.Storage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+// a Storage whose puts fail while failing is 1, counting the puts tried
+type failingPuts struct {
+	storage.Storage
+	failing int32
+	tried int32
+}
+
+func (fp *failingPuts) Put(bucketName string, tokens int) error {
+	atomic.AddInt32(&fp.tried, 1)
+	if atomic.LoadInt32(&fp.failing) == 1 {
+		return storage.ErrStorageUnavailable
+	}
+
+	return fp.Storage.Put(bucketName, tokens)
+}
+
+// poll until the condition holds or a second has passed, for work done in the background
+func Eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond * 5) {
+		if condition() {
+			return true
+		}
+	}
+
+	return condition()
+}
+
+// the shared token value, -1 on an error
+func SharedCount(shared storage.Storage, name string) int {
+	count, err := shared.Count(name)
+	if err != nil {
+		return -1
+	}
+
+	return count
+}
+
+func TestLeasingStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+
+	for _, shared := range MockSharedStorage() {
+		t.Run("takes are served from a block leased from the shared bucket", func(t *testing.T) {
+			store := &storage.LeasingStorage{ Storage: shared, BlockSize: 10 }
+			defer store.Close()
+			name := MockBucketName()
+
+			err := store.Create(name, 100)
+			asserts.Nil(err, "store.Create should not return an error")
+
+			for i := 0; i < 3; i++ {
+				err = store.Take(name, 1)
+				asserts.Nil(err, "store.Take should not return an error")
+			}
+
+			count, err := shared.Count(name)
+			asserts.Nil(err, "shared.Count should not return an error")
+			asserts.Equal(90, count, "one block should have been leased")
+
+			count, err = store.Count(name)
+			asserts.Nil(err, "store.Count should not return an error")
+			asserts.Equal(97, count, "count should include the local stock")
+
+			err = store.Take(name, 25)
+			asserts.Nil(err, "a take past the block should fetch what it is short of")
+
+			// the stock ran out so the next block is on its way
+			fetched := Eventually(func() bool { return SharedCount(shared, name) == 62 })
+			asserts.True(fetched, "the next block should be fetched in the background")
+
+			count, err = store.Count(name)
+			asserts.Nil(err, "store.Count should not return an error")
+			asserts.Equal(72, count, "count should include the local stock")
+		})
+
+		t.Run("the limit stays exact across nodes", func(t *testing.T) {
+			nodes := []*storage.LeasingStorage{
+				{ Storage: shared, BlockSize: 10 },
+				{ Storage: shared, BlockSize: 10 },
+			}
+			name := MockBucketName()
+
+			err := shared.Create(name, 25)
+			asserts.Nil(err, "shared.Create should not return an error")
+
+			var taken int32
+			var wg sync.WaitGroup
+
+			for _, node := range nodes {
+				wg.Add(1)
+				go func(node *storage.LeasingStorage) {
+					defer wg.Done()
+
+					for node.Take(name, 1) == nil {
+						atomic.AddInt32(&taken, 1)
+					}
+				}(node)
+			}
+
+			wg.Wait()
+
+			for _, node := range nodes {
+				asserts.Nil(node.Close(), "store.Close should not return an error")
+			}
+
+			// a prefetch still in flight gives its block back once it lands
+			exact := Eventually(func() bool { return int(atomic.LoadInt32(&taken)) + SharedCount(shared, name) == 25 })
+			asserts.True(exact, "every token should be taken once or given back")
+		})
+
+		t.Run("unused tokens are given back once the lease runs out", func(t *testing.T) {
+			store := &storage.LeasingStorage{ Storage: shared, BlockSize: 10, TTL: time.Millisecond * 30 }
+			name := MockBucketName()
+
+			err := store.Create(name, 100)
+			asserts.Nil(err, "store.Create should not return an error")
+
+			err = store.Take(name, 1)
+			asserts.Nil(err, "store.Take should not return an error")
+
+			returned := Eventually(func() bool { return SharedCount(shared, name) == 99 })
+			asserts.True(returned, "the rest of the block should be given back")
+		})
+	}
+
+	t.Run("tokens which can't be given back are kept and given back later", func(t *testing.T) {
+		shared := &failingPuts{ Storage: &storage.MemoryStorage{}, failing: 1 }
+		store := &storage.LeasingStorage{ Storage: shared, BlockSize: 10, TTL: time.Millisecond * 30 }
+		name := MockBucketName()
+
+		err := store.Create(name, 100)
+		asserts.Nil(err, "store.Create should not return an error")
+
+		err = store.Take(name, 1)
+		asserts.Nil(err, "store.Take should not return an error")
+
+		tried := Eventually(func() bool { return atomic.LoadInt32(&shared.tried) > 0 })
+		asserts.True(tried, "the lease should try to give the block back")
+
+		atomic.StoreInt32(&shared.failing, 0)
+
+		returned := Eventually(func() bool { return SharedCount(shared, name) == 99 })
+		asserts.True(returned, "the rest of the block should be given back once the shared storage recovers")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
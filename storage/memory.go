@@ -1,14 +1,52 @@
 package storage
 
 import (
+	"context"
 	"sync"
-	"errors"
+	"time"
 )
 
 // Implement an in-memory datastore with a concurrent safe map protected by a RWmutex
 type MemoryStorage struct {
 	mutex sync.RWMutex
 	buckets map[string]int
+
+	// the last time a lazily refilled bucket was brought up to date, how long it has been warming up and how it was
+	// last refilled so that it can be swept once it would be full, see refill.go
+	refilled map[string]time.Time
+	warmth map[string]time.Duration
+	refills map[string]Refill
+
+	// the theoretical arrival times of GCRA keys, see gcra.go
+	tats map[string]time.Time
+
+	// sliding window limiters, see window.go
+	logs map[string]*slidingLog
+	windows map[string]*slidingWindow
+
+	// fixed window counters keyed by the name of the limiter and the start of the window, see fixed.go
+	fixed map[string]*fixedWindow
+
+	// leaky bucket queues, see leaky.go
+	queues map[string]*leakyQueue
+
+	// the rates of adaptive buckets, see adaptive.go
+	rates map[string]*adaptiveRate
+
+	// leased semaphores, see semaphore.go
+	semaphores map[string]*semaphore
+
+	// the active tenants of shared pools, see pool.go
+	pools map[string]*sharedPool
+
+	// channels of the waiters to wake when a bucket gains tokens, see notify.go
+	listeners map[string]map[chan struct{}]bool
+
+	// Limiter state which has expired is deleted on this interval by a goroutine started the first time such state is
+	// stored, the interval defaults to one minute. See sweep.go
+	SweepInterval time.Duration
+	sweeper sync.Once
+	stop chan struct{}
 }
 
 func (ms *MemoryStorage) Ping() error { return nil }
@@ -32,16 +70,24 @@ func (ms *MemoryStorage) Create(name string, capacity int) error {
 	return nil
 }
 
-// Decrement the entry value unless the value < tokens. If value < tokens return an error else return nil.
-// Note that we don't check if name exists as a key of the map, this is because storage.Take is called directly
-// from it's parent method on Bucket where the name is derived from. A bucket can't exist to call if it doesn't already
-// have a name...
+// Decrement the entry value unless the value < tokens. If value < tokens return ErrInsufficientTokens else return nil.
+// A name which was never created returns ErrBucketNotFound just like it would from redis.
 func (ms *MemoryStorage) Take(bucketName string, tokens int) error {
+	if err := validAmount(tokens); err != nil {
+		return err
+	}
+
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 
-	if ms.buckets[bucketName] < tokens {
-		return errors.New("Insufficient tokens.")
+	count, exists := ms.buckets[bucketName]
+
+	if !exists {
+		return &Error{Kind: ErrBucketNotFound, Name: bucketName}
+	}
+
+	if count < tokens {
+		return ErrInsufficientTokens
 	}
 
 	ms.buckets[bucketName] -= tokens
@@ -53,7 +99,12 @@ func (ms *MemoryStorage) TakeAll(bucketName string) (int, error){
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
 
-	count := ms.buckets[bucketName]
+	count, exists := ms.buckets[bucketName]
+
+	if !exists {
+		return 0, &Error{Kind: ErrBucketNotFound, Name: bucketName}
+	}
+
 	ms.buckets[bucketName] = 0
 
 	return count, nil
@@ -62,15 +113,33 @@ func (ms *MemoryStorage) TakeAll(bucketName string) (int, error){
 func (ms *MemoryStorage) Set(bucketName string, tokens int) error {
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
+
+	// set may be the first call a storage gets, e.g. a bucket handed over by another peer
+	if ms.buckets == nil {
+		ms.buckets = map[string]int{}
+	}
+
 	ms.buckets[bucketName] = tokens
+	ms.notify(bucketName)
 	return nil
 }
 
 // Increment the entry value by the given tokens integer
 func (ms *MemoryStorage) Put(bucketName string, tokens int) error {
+	if err := validAmount(tokens); err != nil {
+		return err
+	}
+
 	ms.mutex.Lock()
 	defer ms.mutex.Unlock()
+
+	// like redis INCRBY a put to a bucket which was never created creates it
+	if ms.buckets == nil {
+		ms.buckets = map[string]int{}
+	}
+
 	ms.buckets[bucketName] += tokens
+	ms.notify(bucketName)
 	return nil
 }
 
@@ -79,5 +148,65 @@ func (ms *MemoryStorage) Count(bucketName string) (int, error) {
 	ms.mutex.RLock()
 	defer ms.mutex.RUnlock()
 
-	return ms.buckets[bucketName], nil
-}
\ No newline at end of file
+	count, exists := ms.buckets[bucketName]
+
+	if !exists {
+		return 0, &Error{Kind: ErrBucketNotFound, Name: bucketName}
+	}
+
+	return count, nil
+}
+// MemoryStorage never waits on anything but its own mutex so the context versions of the methods above only check
+// that the context is not done before going ahead.
+
+func (ms *MemoryStorage) PingContext(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (ms *MemoryStorage) CreateContext(ctx context.Context, name string, capacity int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ms.Create(name, capacity)
+}
+
+func (ms *MemoryStorage) TakeContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ms.Take(bucketName, tokens)
+}
+
+func (ms *MemoryStorage) TakeAllContext(ctx context.Context, bucketName string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return ms.TakeAll(bucketName)
+}
+
+func (ms *MemoryStorage) SetContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ms.Set(bucketName, tokens)
+}
+
+func (ms *MemoryStorage) PutContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return ms.Put(bucketName, tokens)
+}
+
+func (ms *MemoryStorage) CountContext(ctx context.Context, bucketName string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return ms.Count(bucketName)
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/go-redis/redis"
+)
+
+// Storage providers which can tell a waiter that a bucket may have gained tokens, see bucket.Wait. The channel
+// receives after Put or Set write to the bucket and is closed if the provider stops listening, in which case the
+// waiter should fall back to polling, as it should when Subscribe returns ErrNotSupported. Notifications are only
+// hints, several writes may be folded into one. Call stop once done with the channel.
+type NotifyStorage interface {
+	Subscribe(ctx context.Context, bucketName string) (notifications <-chan struct{}, stop func(), err error)
+}
+
+// Wake whoever is listening to the bucket without ever blocking, a listener which has not caught up with the last
+// notification yet doesn't need another one. The caller must hold the write lock.
+func (ms *MemoryStorage) notify(bucketName string) {
+	for listener := range ms.listeners[bucketName] {
+		select {
+		case listener <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (ms *MemoryStorage) Subscribe(ctx context.Context, bucketName string) (<-chan struct{}, func(), error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.listeners == nil {
+		ms.listeners = map[string]map[chan struct{}]bool{}
+	}
+
+	if ms.listeners[bucketName] == nil {
+		ms.listeners[bucketName] = map[chan struct{}]bool{}
+	}
+
+	listener := make(chan struct{}, 1)
+	ms.listeners[bucketName][listener] = true
+
+	stop := func() {
+		ms.mutex.Lock()
+		defer ms.mutex.Unlock()
+
+		delete(ms.listeners[bucketName], listener)
+		if len(ms.listeners[bucketName]) == 0 {
+			delete(ms.listeners, bucketName)
+		}
+	}
+
+	return listener, stop, nil
+}
+
+// The channel RedisStorage publishes to whenever Put or Set write to a bucket.
+func notifyChannel(bucketName string) string {
+	return stateKey(bucketName, "notify")
+}
+
+// Subscribe to the bucket's channel with redis pub/sub. The subscription is confirmed before returning so a write
+// made after Subscribe returns is never missed. Each subscriber holds a connection of its own while subscribed.
+func (rs *RedisStorage) Subscribe(ctx context.Context, bucketName string) (<-chan struct{}, func(), error) {
+	return rs.subscribe(ctx, bucketName, notifyChannel(bucketName))
+}
+
+func (rs *RedisStorage) subscribe(ctx context.Context, bucketName string, channel string) (<-chan struct{}, func(), error) {
+	// *redis.Client and *redis.Ring can subscribe, *redis.ClusterClient can't
+	subscriber, ok := rs.Client.(interface{ Subscribe(channels ...string) *redis.PubSub })
+	if !ok {
+		return nil, nil, fmt.Errorf("%w Notifications need a redis client which can subscribe.", ErrNotSupported)
+	}
+
+	pubsub := subscriber.Subscribe(channel)
+
+	err := rs.do(ctx, bucketName, func(client redis.UniversalClient) error {
+		_, err := pubsub.Receive()
+		return err
+	})
+
+	if err != nil {
+		pubsub.Close()
+		return nil, nil, err
+	}
+
+	notifications := make(chan struct{}, 1)
+
+	go func() {
+		defer close(notifications)
+
+		for {
+			// any error, including the one from closing the subscription, ends the notifications
+			if _, err := pubsub.ReceiveMessage(); err != nil {
+				return
+			}
+
+			select {
+			case notifications <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() { pubsub.Close() })
+	}
+
+	return notifications, stop, nil
+}
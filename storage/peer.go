@@ -0,0 +1,351 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// PeerStorage shares buckets between a fleet of processes without Redis, like groupcache. Every bucket is owned by one
+// peer picked by consistent hashing of the bucket name, the owner keeps the bucket in memory and the other peers
+// forward their calls to it over HTTP. Every peer serves the others as an http.Handler on its Self URL.
+//
+// Every peer should be given the same list of peers with SetPeers, whenever a peer joins or leaves. Peers hand the
+// buckets they no longer own over to the new owners so only the buckets which change hands, about one in every
+// number of peers, move. A peer which leaves should be dropped from its own list as well so that it hands over all of
+// its buckets. The buckets of a peer which dies are lost and start over the next time they are created. Calls made
+// while a bucket is being handed over may go to either peer.
+type PeerStorage struct {
+	// the URL the other peers reach this one on
+	Self string
+
+	// Optional, the client used to reach other peers, defaults to http.DefaultClient
+	Client *http.Client
+
+	// Optional, the number of points each peer has on the ring, defaults to 50. More points spread the buckets more
+	// evenly.
+	Points int
+
+	mutex sync.RWMutex
+	ring *hashRing
+
+	// the buckets this peer keeps and their names
+	local MemoryStorage
+	owned map[string]bool
+}
+
+// A consistent hash ring, each peer is hashed onto it at several points and a key is owned by the first point after
+// the hash of the key.
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(points int, peers []string) *hashRing {
+	ring := &hashRing{owners: map[uint32]string{}}
+
+	for _, peer := range peers {
+		for i := 0; i < points; i++ {
+			point := crc32.ChecksumIEEE([]byte(peer + "#" + strconv.Itoa(i)))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = peer
+		}
+	}
+
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+func (ring *hashRing) owner(key string) string {
+	if ring == nil || len(ring.points) == 0 {
+		return ""
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+
+	return ring.owners[ring.points[i]]
+}
+
+// A call from one peer to another, see PeerStorage.ServeHTTP.
+type peerRequest struct {
+	Op string `json:"op"`
+	Name string `json:"name"`
+	Tokens int `json:"tokens"`
+}
+
+type peerResponse struct {
+	Count int `json:"count"`
+
+	// the kind of error, see peerErrors, or its message when it is not one of ours
+	Error string `json:"error,omitempty"`
+}
+
+// Our errors as they are sent between peers.
+var peerErrors = map[string]error{
+	"insufficient": ErrInsufficientTokens,
+	"invalid": ErrInvalidAmount,
+	"not_found": ErrBucketNotFound,
+	"conflict": ErrNameConflict,
+}
+
+// Set the peers in the fleet, this one included unless it is leaving, and hand over the buckets this peer no longer
+// owns to their new owners. Every bucket is handed over even if some fail, the first error is returned. A bucket which
+// failed to move is kept by this peer and handed over again by the next SetPeers.
+func (ps *PeerStorage) SetPeers(peers ...string) error {
+	points := ps.Points
+	if points <= 0 {
+		points = 50
+	}
+
+	ring := newHashRing(points, peers)
+
+	ps.mutex.Lock()
+	ps.ring = ring
+
+	var moving []string
+	for name := range ps.owned {
+		if owner := ring.owner(name); owner != ps.Self && owner != "" {
+			moving = append(moving, name)
+			delete(ps.owned, name)
+		}
+	}
+	ps.mutex.Unlock()
+
+	var first error
+	for _, name := range moving {
+		if err := ps.handOver(name, ring.owner(name)); err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
+
+// Move a bucket to its new owner, which takes the token value this peer had over whatever it has.
+func (ps *PeerStorage) handOver(name string, owner string) error {
+	count, err := ps.local.TakeAll(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := ps.forward(context.Background(), owner, peerRequest{Op: "set", Name: name, Tokens: count}); err != nil {
+		// keep the tokens rather then lose them, the next SetPeers tries the hand over again
+		ps.local.Put(name, count)
+
+		ps.mutex.Lock()
+		ps.owned[name] = true
+		ps.mutex.Unlock()
+		return err
+	}
+
+	return nil
+}
+
+// The peer which owns the bucket, this one when there are no peers.
+func (ps *PeerStorage) Owner(bucketName string) string {
+	ps.mutex.RLock()
+	defer ps.mutex.RUnlock()
+
+	if owner := ps.ring.owner(bucketName); owner != "" {
+		return owner
+	}
+
+	return ps.Self
+}
+
+// Run the call on the owner of the bucket.
+func (ps *PeerStorage) call(ctx context.Context, request peerRequest) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	if owner := ps.Owner(request.Name); owner != ps.Self {
+		return ps.forward(ctx, owner, request)
+	}
+
+	return ps.serve(request)
+}
+
+// Run the call on the buckets this peer keeps.
+func (ps *PeerStorage) serve(request peerRequest) (int, error) {
+	ps.mutex.Lock()
+	if ps.owned == nil {
+		ps.owned = map[string]bool{}
+	}
+
+	switch request.Op {
+	case "create", "set", "put":
+		ps.owned[request.Name] = true
+	}
+	ps.mutex.Unlock()
+
+	switch request.Op {
+	case "create":
+		return 0, ps.local.Create(request.Name, request.Tokens)
+	case "take":
+		return 0, ps.local.Take(request.Name, request.Tokens)
+	case "take_all":
+		return ps.local.TakeAll(request.Name)
+	case "set":
+		return 0, ps.local.Set(request.Name, request.Tokens)
+	case "put":
+		return 0, ps.local.Put(request.Name, request.Tokens)
+	case "count":
+		return ps.local.Count(request.Name)
+	default:
+		return 0, fmt.Errorf("Unknown operation %v.", request.Op)
+	}
+}
+
+func (ps *PeerStorage) forward(ctx context.Context, peer string, request peerRequest) (int, error) {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return 0, err
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+
+	client := ps.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	httpResponse, err := client.Do(httpRequest)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+
+		return 0, &Error{Kind: ErrStorageUnavailable, Name: request.Name, Err: err}
+	}
+	defer httpResponse.Body.Close()
+
+	if httpResponse.StatusCode != http.StatusOK {
+		return 0, &Error{Kind: ErrStorageUnavailable, Name: request.Name, Err: fmt.Errorf("Peer answered %v.", httpResponse.Status)}
+	}
+
+	var response peerResponse
+	if err := json.NewDecoder(httpResponse.Body).Decode(&response); err != nil {
+		return 0, err
+	}
+
+	if response.Error == "" {
+		return response.Count, nil
+	}
+
+	// insufficient tokens and invalid amounts are returned bare like every other provider returns them
+	switch kind := peerErrors[response.Error]; kind {
+	case nil:
+		return 0, errors.New(response.Error)
+	case ErrInsufficientTokens, ErrInvalidAmount:
+		return 0, kind
+	default:
+		return 0, &Error{Kind: kind, Name: request.Name}
+	}
+}
+
+// Serve calls forwarded by other peers. A call is always run on the buckets this peer keeps, even for a bucket it
+// doesn't think it owns, so that peers which don't agree on the ring for a moment never forward a call in circles.
+func (ps *PeerStorage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Peers call each other with POST.", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request peerRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	count, err := ps.serve(request)
+	response := peerResponse{Count: count}
+
+	if err != nil {
+		response.Error = err.Error()
+		for name, kind := range peerErrors {
+			if errors.Is(err, kind) {
+				response.Error = name
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (ps *PeerStorage) Ping() error {
+	return ps.PingContext(context.Background())
+}
+
+func (ps *PeerStorage) Create(name string, capacity int) error {
+	return ps.CreateContext(context.Background(), name, capacity)
+}
+
+func (ps *PeerStorage) Take(bucketName string, tokens int) error {
+	return ps.TakeContext(context.Background(), bucketName, tokens)
+}
+
+func (ps *PeerStorage) TakeAll(bucketName string) (int, error) {
+	return ps.TakeAllContext(context.Background(), bucketName)
+}
+
+func (ps *PeerStorage) Set(bucketName string, tokens int) error {
+	return ps.SetContext(context.Background(), bucketName, tokens)
+}
+
+func (ps *PeerStorage) Put(bucketName string, tokens int) error {
+	return ps.PutContext(context.Background(), bucketName, tokens)
+}
+
+func (ps *PeerStorage) Count(bucketName string) (int, error) {
+	return ps.CountContext(context.Background(), bucketName)
+}
+
+// Peers are only reached when a bucket they own is used, there is nothing to check up front.
+func (ps *PeerStorage) PingContext(ctx context.Context) error {
+	return ctx.Err()
+}
+
+func (ps *PeerStorage) CreateContext(ctx context.Context, name string, capacity int) error {
+	_, err := ps.call(ctx, peerRequest{Op: "create", Name: name, Tokens: capacity})
+	return err
+}
+
+func (ps *PeerStorage) TakeContext(ctx context.Context, bucketName string, tokens int) error {
+	_, err := ps.call(ctx, peerRequest{Op: "take", Name: bucketName, Tokens: tokens})
+	return err
+}
+
+func (ps *PeerStorage) TakeAllContext(ctx context.Context, bucketName string) (int, error) {
+	return ps.call(ctx, peerRequest{Op: "take_all", Name: bucketName})
+}
+
+func (ps *PeerStorage) SetContext(ctx context.Context, bucketName string, tokens int) error {
+	_, err := ps.call(ctx, peerRequest{Op: "set", Name: bucketName, Tokens: tokens})
+	return err
+}
+
+func (ps *PeerStorage) PutContext(ctx context.Context, bucketName string, tokens int) error {
+	_, err := ps.call(ctx, peerRequest{Op: "put", Name: bucketName, Tokens: tokens})
+	return err
+}
+
+func (ps *PeerStorage) CountContext(ctx context.Context, bucketName string) (int, error) {
+	return ps.call(ctx, peerRequest{Op: "count", Name: bucketName})
+}
@@ -0,0 +1,189 @@
+package storage_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+// a peer served by its own httptest server, close the server to take it down
+func MockPeer() (*storage.PeerStorage, *httptest.Server) {
+	peer := &storage.PeerStorage{}
+	server := httptest.NewServer(peer)
+	peer.Self = server.URL
+	return peer, server
+}
+
+// give every peer the same list of peers
+func SetPeers(peers []*storage.PeerStorage, urls []string) error {
+	for _, peer := range peers {
+		if err := peer.SetPeers(urls...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestPeerStorage(t *testing.T) {
+	asserts := assert.New(t)
+
+	var peers []*storage.PeerStorage
+	var urls []string
+	for i := 0; i < 3; i++ {
+		peer, server := MockPeer()
+		defer server.Close()
+
+		peers = append(peers, peer)
+		urls = append(urls, peer.Self)
+	}
+
+	asserts.Nil(SetPeers(peers, urls), "peer.SetPeers should not return an error")
+
+	t.Run("every peer reaches the owner of a bucket", func(t *testing.T) {
+		name := MockBucketName()
+
+		for _, peer := range peers {
+			asserts.Equal(peers[0].Owner(name), peer.Owner(name), "peers should agree on the owner")
+		}
+
+		asserts.Nil(peers[0].Create(name, 10), "peer.Create should not return an error")
+		asserts.Nil(peers[1].Take(name, 4), "peer.Take should not return an error")
+		asserts.Nil(peers[2].Put(name, 1), "peer.Put should not return an error")
+
+		for _, peer := range peers {
+			count, err := peer.Count(name)
+			asserts.Nil(err, "peer.Count should not return an error")
+			asserts.Equal(7, count, "every peer should see the same token value")
+		}
+
+		err := peers[1].Take(name, 8)
+		asserts.Equal(storage.ErrInsufficientTokens, err, "peer.Take should fail with insufficient tokens")
+
+		err = peers[2].Take(name, -1)
+		asserts.Equal(storage.ErrInvalidAmount, err, "peer.Take should fail with an invalid amount")
+
+		_, err = peers[1].Count(MockBucketName())
+		asserts.True(errors.Is(err, storage.ErrBucketNotFound), "peer.Count should fail with bucket not found")
+	})
+
+	t.Run("buckets are spread over the peers", func(t *testing.T) {
+		owners := map[string]int{}
+		for i := 0; i < 300; i++ {
+			owners[peers[0].Owner(fmt.Sprintf("bucket-%v", i))]++
+		}
+
+		for _, url := range urls {
+			asserts.True(owners[url] > 0, "every peer should own a share of the buckets")
+		}
+	})
+
+	t.Run("a put reaches a peer which never kept a bucket", func(t *testing.T) {
+		caller, server := MockPeer()
+		defer server.Close()
+
+		owner, server := MockPeer()
+		defer server.Close()
+
+		asserts.Nil(SetPeers([]*storage.PeerStorage{ caller, owner }, []string{ caller.Self, owner.Self }), "peer.SetPeers should not return an error")
+
+		name := MockBucketName()
+		for owner.Owner(name) != owner.Self {
+			name = MockBucketName()
+		}
+
+		asserts.Nil(caller.Put(name, 3), "peer.Put should create the bucket like redis INCRBY")
+
+		count, err := owner.Count(name)
+		asserts.Nil(err, "owner.Count should not return an error")
+		asserts.Equal(3, count, "the owner should keep the tokens put")
+	})
+
+	t.Run("buckets move when a peer joins and leaves", func(t *testing.T) {
+		var names []string
+		for i := 0; i < 30; i++ {
+			name := MockBucketName()
+			names = append(names, name)
+
+			asserts.Nil(peers[0].Create(name, 20), "peer.Create should not return an error")
+			asserts.Nil(peers[1].Take(name, i % 19 + 1), "peer.Take should not return an error")
+		}
+
+		joining, server := MockPeer()
+		defer server.Close()
+
+		all := append(append([]*storage.PeerStorage{}, peers...), joining)
+		asserts.Nil(SetPeers(all, append(append([]string{}, urls...), joining.Self)), "peer.SetPeers should not return an error")
+
+		for i, name := range names {
+			for _, peer := range all {
+				count, err := peer.Count(name)
+				asserts.Nil(err, "peer.Count should not return an error after a peer joins")
+				asserts.Equal(19 - i % 19, count, "the token value should survive a peer joining")
+			}
+		}
+
+		owned := 0
+		for _, name := range names {
+			if joining.Owner(name) == joining.Self {
+				owned++
+			}
+		}
+		asserts.True(owned > 0 && owned < len(names), "the new peer should take over some of the buckets")
+
+		// the peer leaving drops itself too so it hands its buckets over before it goes
+		asserts.Nil(SetPeers(all, urls), "peer.SetPeers should not return an error")
+		server.Close()
+
+		for i, name := range names {
+			for _, peer := range peers {
+				count, err := peer.Count(name)
+				asserts.Nil(err, "peer.Count should not return an error after a peer leaves")
+				asserts.Equal(19 - i % 19, count, "the token value should survive a peer leaving")
+			}
+		}
+	})
+
+	t.Run("a bucket whose new owner can't be reached is handed over on the next SetPeers", func(t *testing.T) {
+		leaving, server := MockPeer()
+		defer server.Close()
+
+		owner, server := MockPeer()
+		defer server.Close()
+
+		dead := "http://127.0.0.1:1"
+
+		// find a bucket which moves to the dead peer first and to the owner afterwards
+		first, second := &storage.PeerStorage{ Self: leaving.Self }, &storage.PeerStorage{ Self: leaving.Self }
+		asserts.Nil(first.SetPeers(leaving.Self, dead), "peer.SetPeers should not return an error")
+		asserts.Nil(second.SetPeers(leaving.Self, owner.Self), "peer.SetPeers should not return an error")
+
+		name := MockBucketName()
+		for first.Owner(name) != dead || second.Owner(name) != owner.Self {
+			name = MockBucketName()
+		}
+
+		asserts.Nil(leaving.Create(name, 10), "peer.Create should not return an error")
+		asserts.Nil(leaving.Take(name, 3), "peer.Take should not return an error")
+
+		err := leaving.SetPeers(leaving.Self, dead)
+		asserts.True(errors.Is(err, storage.ErrStorageUnavailable), "peer.SetPeers should fail to hand over to a dead peer")
+
+		asserts.Nil(SetPeers([]*storage.PeerStorage{ leaving, owner }, []string{ leaving.Self, owner.Self }), "peer.SetPeers should hand the bucket over")
+
+		count, err := owner.Count(name)
+		asserts.Nil(err, "owner.Count should not return an error")
+		asserts.Equal(7, count, "the new owner should get the tokens the hand over failed to move")
+	})
+
+	t.Run("a peer which can't be reached is unavailable", func(t *testing.T) {
+		lonely := &storage.PeerStorage{ Self: "http://127.0.0.1:1" }
+		lonely.SetPeers("http://127.0.0.1:2")
+
+		err := lonely.Create(MockBucketName(), 10)
+		asserts.True(errors.Is(err, storage.ErrStorageUnavailable), "peer.Create should fail with storage unavailable")
+	})
+}
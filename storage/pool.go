@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Pool describes a global rate shared by whichever tenants are using it right now. Every active tenant gets a share
+// of Rate tokens per Interval in proportion to its weight, but never less then MinShare. A tenant is active from the
+// time it takes from the pool until it has gone Idle without taking, so shares grow as tenants go quiet and shrink as
+// they join. With the floor the shares may add up to more then Rate when there are a great number of tenants.
+//
+// Each tenant has a lazily refilled bucket of its own (see Refill) which refills at its share and holds one Interval
+// of it. The share is worked out again on every take, a bucket holding more then its new share is cut down to it.
+type Pool struct {
+	Rate int
+	Interval time.Duration
+	MinShare int
+	Idle time.Duration
+}
+
+// Storage providers which can keep track of the tenants of a pool. TakeShare marks the tenant active with the given
+// weight, works out its share and takes from it in a single atomic operation. The decision's Limit is the tenant's
+// current share.
+type PoolStorage interface {
+	TakeShare(ctx context.Context, poolName string, tenant string, weight int, tokens int, pool Pool) (Decision, error)
+}
+
+// The refill of a tenant with weight when the active tenants weigh total between them. Rate*weight/total tokens every
+// Interval is kept exact as Rate*weight tokens every Interval*total.
+func (pool Pool) share(weight, total int) Refill {
+	refill := Refill{Capacity: pool.Rate * weight / total, Rate: pool.Rate * weight, Interval: pool.Interval * time.Duration(total)}
+
+	if refill.Capacity < pool.MinShare {
+		refill = Refill{Capacity: pool.MinShare, Rate: pool.MinShare, Interval: pool.Interval}
+	}
+
+	if refill.Capacity < 1 {
+		refill.Capacity = 1
+	}
+
+	return refill
+}
+
+// the keys the pool script expects, see luaTakeShare
+func poolKeys(poolName string, tenant string) []string {
+	return append(refillKeys(tenantName(poolName, tenant)), stateKey(poolName, "active"), stateKey(poolName, "weights"))
+}
+
+// the name of a tenant's bucket
+func tenantName(poolName string, tenant string) string {
+	return stateKey(poolName, "tenant:" + tenant)
+}
+
+// The active tenants of a pool and their weights in MemoryStorage, the pool expires once every tenant is idle. The
+// buckets of the tenants are swept once they would be full again, like their keys expire in redis.
+type sharedPool struct {
+	weights map[string]int
+	seen map[string]time.Time
+	expires time.Time
+	full map[string]time.Time
+}
+
+// KEYS: see poolKeys
+// ARGV: tenant, weight, tokens, rate, interval, minimum share, idle
+//
+// The active tenants are a sorted set scored by when they last took from the pool and their weights are in a hash.
+// Returns {allowed, remaining, retry after, reset after, share}, see decide.
+const luaTakeShare = luaBucket + `
+	local active, weights = KEYS[4], KEYS[5]
+	local tenant, weight, amount = ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3])
+	local rate, interval, minshare, idle = tonumber(ARGV[4]), tonumber(ARGV[5]), tonumber(ARGV[6]), tonumber(ARGV[7])
+
+	-- forget the tenants which went idle
+	local stale = "(" .. string.format("%.0f", now - idle)
+	for _, gone in ipairs(redis.call("ZRANGEBYSCORE", active, "-inf", stale)) do
+		redis.call("HDEL", weights, gone)
+	end
+
+	redis.call("ZREMRANGEBYSCORE", active, "-inf", stale)
+	redis.call("ZADD", active, string.format("%.0f", now), tenant)
+	redis.call("HSET", weights, tenant, weight)
+
+	local total = 0
+	for _, w in ipairs(redis.call("HVALS", weights)) do
+		total = total + tonumber(w)
+	end
+
+	-- the Lua counterpart of Pool.share
+	local share = {capacity = math.floor(rate * weight / total), rate = rate * weight, interval = interval * total, warmup = 0}
+	if share.capacity < minshare then
+		share.capacity, share.rate, share.interval = minshare, minshare, interval
+	end
+
+	share.capacity = math.max(1, share.capacity)
+	share.cold = share.rate
+
+	local b = open(1, share)
+	b.count = math.min(b.count, b.capacity)
+
+	local allowed = 0
+	if b.count >= amount then
+		b.count = b.count - amount
+		allowed = 1
+	end
+
+	save(b)
+
+	redis.call("PEXPIRE", active, math.ceil(idle / 1000))
+	redis.call("PEXPIRE", weights, math.ceil(idle / 1000))
+
+	local decision = decide(b, allowed, amount)
+	table.insert(decision, b.capacity)
+	return decision
+`
+
+func (ms *MemoryStorage) TakeShare(ctx context.Context, poolName string, tenant string, weight int, tokens int, pool Pool) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(weight); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.pools == nil {
+		ms.pools = map[string]*sharedPool{}
+	}
+
+	now := time.Now()
+	p, exists := ms.pools[poolName]
+
+	if !exists || !p.expires.After(now) {
+		full := map[string]time.Time{}
+		if exists {
+			// the buckets of the tenants outlive the pool until they are full
+			full = p.full
+		}
+
+		p = &sharedPool{weights: map[string]int{}, seen: map[string]time.Time{}, full: full}
+		ms.pools[poolName] = p
+		ms.sweepInBackground()
+	}
+
+	for other, seen := range p.seen {
+		if seen.Before(now.Add(-pool.Idle)) {
+			delete(p.seen, other)
+			delete(p.weights, other)
+		}
+	}
+
+	p.seen[tenant], p.weights[tenant] = now, weight
+	p.expires = now.Add(pool.Idle)
+
+	total := 0
+	for _, w := range p.weights {
+		total += w
+	}
+
+	refill := pool.share(weight, total)
+	name := tenantName(poolName, tenant)
+
+	count := ms.refill(name, refill, now)
+	if count > refill.Capacity {
+		count = refill.Capacity
+	}
+
+	allowed := count >= tokens
+	if allowed {
+		count -= tokens
+	}
+
+	ms.buckets[name] = count
+	decision := refill.decide(allowed, count, tokens, ms.refilled[name], ms.warmth[name], now)
+
+	p.full[name] = now
+	if decision.ResetAfter > 0 {
+		p.full[name] = now.Add(decision.ResetAfter)
+	}
+
+	return decision, nil
+}
+
+func (rs *RedisStorage) TakeShare(ctx context.Context, poolName string, tenant string, weight int, tokens int, pool Pool) (Decision, error) {
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(weight); err != nil {
+		return Decision{}, err
+	}
+
+	args := []interface{}{tenant, weight, tokens, pool.Rate, micros(pool.Interval), pool.MinShare, micros(pool.Idle)}
+	reply, err := rs.evalInts(ctx, luaTakeShare, poolKeys(poolName, tenant), args...)
+
+	if err != nil {
+		return Decision{}, err
+	}
+
+	if len(reply) != 5 {
+		return Decision{}, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	return decisionFromReply(reply[:4], int(reply[4]))
+}
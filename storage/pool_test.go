@@ -0,0 +1,85 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockPoolStorage() []storage.PoolStorage {
+	return []storage.PoolStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+func TestPoolStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+
+	for _, store := range MockPoolStorage() {
+		t.Run("no active tenant gets less then the minimum share", func(t *testing.T) {
+			name := MockBucketName()
+			pool := storage.Pool{ Rate: 10, Interval: time.Minute, MinShare: 3, Idle: time.Minute }
+
+			for i, expected := range []int{ 10, 5, 3, 3 } {
+				decision, err := store.TakeShare(context.Background(), name, fmt.Sprint(i), 1, 1, pool)
+				asserts.Nil(err, "store.TakeShare should not return an error")
+				asserts.True(decision.Allowed, "a new tenant should have a full share")
+				asserts.Equal(expected, decision.Limit, "the share should be the larger of the minimum and the tenant's part")
+			}
+		})
+
+		t.Run("a tenant's share refills at its part of the rate", func(t *testing.T) {
+			name := MockBucketName()
+			pool := storage.Pool{ Rate: 100, Interval: time.Second, Idle: time.Minute }
+
+			_, err := store.TakeShare(context.Background(), name, "other", 1, 1, pool)
+			asserts.Nil(err, "store.TakeShare should not return an error")
+
+			decision, err := store.TakeShare(context.Background(), name, "tenant", 1, 50, pool)
+			asserts.Nil(err, "store.TakeShare should not return an error")
+			asserts.True(decision.Allowed, "the tenant should have its whole share")
+
+			decision, err = store.TakeShare(context.Background(), name, "tenant", 1, 1, pool)
+			asserts.Nil(err, "store.TakeShare should not return an error")
+			asserts.False(decision.Allowed, "the tenant should have used up its share")
+			asserts.True(decision.RetryAfter > time.Millisecond * 10 && decision.RetryAfter <= time.Millisecond * 20, "a token should take 20ms at half the rate")
+		})
+	}
+
+	t.Run("the buckets of idle tenants are swept once they are full", func(t *testing.T) {
+		store := &storage.MemoryStorage{ SweepInterval: time.Hour }
+		defer store.Close()
+
+		name := MockBucketName()
+		pool := storage.Pool{ Rate: 10, Interval: time.Millisecond * 20, Idle: time.Millisecond * 20 }
+
+		for i := 0; i < 20; i++ {
+			_, err := store.TakeShare(context.Background(), name, fmt.Sprint(i), 1, 1, pool)
+			asserts.Nil(err, "store.TakeShare should not return an error")
+		}
+
+		tenant := "{" + name + "}:tenant:0"
+
+		store.Sweep()
+		_, err := store.Count(tenant)
+		asserts.Nil(err, "the bucket of a tenant which is still refilling should be kept")
+
+		time.Sleep(time.Millisecond * 100)
+		store.Sweep()
+
+		for i := 0; i < 20; i++ {
+			_, err := store.Count(fmt.Sprintf("{%v}:tenant:%v", name, i))
+			asserts.True(errors.Is(err, storage.ErrBucketNotFound), "the bucket of an idle tenant should be swept")
+		}
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
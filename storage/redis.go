@@ -1,10 +1,13 @@
 package storage
 
 import (
+	"context"
 	"github.com/go-redis/redis"
 	"strconv"
+	"sync"
 	"errors"
 	"fmt"
+	"time"
 )
 
 const (
@@ -23,95 +26,373 @@ const (
 	luaGetAndDecr = `
 		local key = KEYS[1]
 		local amount = tonumber(ARGV[1])
-		local count = tonumber(redis.call("get", key))
+		local raw = redis.call("get", key)
+
+		if not raw then
+			return -2
+		end
+
+		local count = tonumber(raw)
+
+		if count == nil then
+			return -3
+		end
 
 		if count >= amount then
 			return redis.call("DECRBY", key, amount)
 		else
-			error("Insufficient tokens/")
+			return -1
 		end
 	`
 
 	// used for storage.TakeAll(), returns a conditional amount of tokens representing all the tokens
 	luaGetAllAndDecr = `
 		local key = KEYS[1]
-		local count = tonumber(redis.call("get", key))
+		local raw = redis.call("get", key)
+
+		if not raw then
+			return -2
+		end
+
+		local count = tonumber(raw)
+
+		if count == nil then
+			return -3
+		end
+
 		redis.call("DECRBY", key, count)
 		return count
 	`
 )
 
+// RedisStorage works with any redis client: a *redis.Client, including the failover client for Sentinel from
+// redis.NewFailoverClient, a *redis.ClusterClient or a *redis.Ring.
+//
+// With Redis Cluster or a Ring every key a script touches has to live on the same node. The state a bucket keeps next
+// to its token value is stored under keys hash tagged with the bucket name (see stateKey) so a single bucket always
+// works. Anything which takes from several buckets at once, bucket.NewGroup and buckets with a parent, needs bucket
+// names which share a hash tag, for example "{tenant:42}:user:7" and "{tenant:42}". Pub/sub is not supported by
+// *redis.ClusterClient so waiters poll rather then being woken by Put and Set.
 type RedisStorage struct {
-	Client *redis.Client
+	Client redis.UniversalClient
+
+	// Optional, Count reads from ReadClient when it is set, for example a client of a replica. The token value it
+	// returns may lag behind. A *redis.ClusterClient with ReadOnly set in its options reads from replicas by itself.
+	ReadClient redis.UniversalClient
+
+	// Optional, with a CoalesceWindow the takes and puts made at about the same time by any number of goroutines are
+	// collected for up to CoalesceWindow and sent as one pipelined batch, see Batch. Each call waits up to the window
+	// longer but under load far fewer round trips are made. A batch is sent early once it holds CoalesceMax calls,
+	// which defaults to 128. Only Take, TakeRefill with a Rate and Put are coalesced, which is what bucket.Take and
+	// bucket.Put use.
+	CoalesceWindow time.Duration
+	CoalesceMax int
+	coalescer *coalescer
+	coalesceOnce sync.Once
+
+	// Optional, buckets written by Create and Set expire after this long unless they are written again. 0 means
+	// buckets never expire. Buckets with a refill rate expire on their own once they would be full again. The rate of
+	// an adaptive bucket expires with the bucket, or after Expiration when the bucket has never been taken from.
+	Expiration time.Duration
 }
 
 func (rs *RedisStorage) Ping() error {
-	return rs.Client.Ping().Err()
+	return rs.PingContext(context.Background())
 }
 
-// bucket.Create will create a new bucket with the given parameters if one does not exist, if no bucket can be created it will return an error
 func (rs *RedisStorage) Create(name string, capacity int) error {
+	return rs.CreateContext(context.Background(), name, capacity)
+}
+
+func (rs *RedisStorage) Take(bucketName string, tokens int) error {
+	return rs.TakeContext(context.Background(), bucketName, tokens)
+}
+
+func (rs *RedisStorage) TakeAll(bucketName string) (int, error) {
+	return rs.TakeAllContext(context.Background(), bucketName)
+}
+
+func (rs *RedisStorage) Set(bucketName string, tokens int) error {
+	return rs.SetContext(context.Background(), bucketName, tokens)
+}
+
+func (rs *RedisStorage) Put(bucketName string, tokens int) error {
+	return rs.PutContext(context.Background(), bucketName, tokens)
+}
+
+func (rs *RedisStorage) Count(bucketName string) (int, error) {
+	return rs.CountContext(context.Background(), bucketName)
+}
+
+func (rs *RedisStorage) PingContext(ctx context.Context) error {
+	return rs.do(ctx, "", func(client redis.UniversalClient) error {
+		return client.Ping().Err()
+	})
+}
+
+// bucket.Create will create a new bucket with the given parameters if one does not exist, if no bucket can be created it will return an error
+func (rs *RedisStorage) CreateContext(ctx context.Context, name string, capacity int) error {
 	// check if name exists as a key of redis
-	strTokensCount, err := rs.Client.Get(name).Result()
+	var strTokensCount string
+	err := rs.do(ctx, name, func(client redis.UniversalClient) (err error) {
+		strTokensCount, err = client.Get(name).Result()
+		return err
+	})
 
 	// if the name key does not exist in redis create it with the value of capacity and return nil (or an error if redis throws one)
-	if err == redis.Nil || len(strTokensCount) == 0 {
-		// the last param 0 indicates the key will never expire
-		return rs.Client.Set(name, capacity, 0).Err()
+	if errors.Is(err, ErrBucketNotFound) || (err == nil && len(strTokensCount) == 0) {
+		return rs.do(ctx, name, func(client redis.UniversalClient) error {
+			return client.Set(name, capacity, rs.Expiration).Err()
+		})
+	}
+
+	if err != nil {
+		return err
 	}
 
 	// if the found value is a string which cannot be converted to an integer assume this key is protected and return an error
 	tokensCount, err := strconv.Atoi(strTokensCount)
 
 	if err != nil {
-		return err
+		return redisError(name, err)
 	}
 
 	// if the following value is converted to the integer 0 assume this was a programming mistake and the programmer
 	// was not aware that this key already existed, return an error
 	if tokensCount == 0 {
-		return errors.New("Bucket exists in redis but contains a value of 0. Try putting tokens back into this bucket.")
+		return &Error{Kind: ErrNameConflict, Name: name, Err: errors.New("Bucket exists in redis but contains a value of 0. Try putting tokens back into this bucket.")}
 	}
 
 	return nil
 }
 
 // Executes a lua script which decrements the token value by tokensDesired if tokensDesired >= the token value.
-func (rs *RedisStorage) Take(bucketName string, tokens int) error {
-	return rs.Client.Eval(luaGetAndDecr, []string{bucketName}, tokens).Err()
+func (rs *RedisStorage) TakeContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := validAmount(tokens); err != nil {
+		return err
+	}
+
+	if rs.CoalesceWindow > 0 {
+		result, err := rs.coalescing().do(ctx, Op{Name: bucketName, Tokens: tokens})
+		if err != nil {
+			return err
+		}
+
+		if result.Err == nil && !result.Decision.Allowed {
+			return ErrInsufficientTokens
+		}
+
+		return result.Err
+	}
+
+	remaining, err := rs.evalInt(ctx, luaGetAndDecr, []string{bucketName}, tokens)
+
+	if err != nil {
+		return err
+	}
+
+	// the script returns a negative code rather then raising so the error matches MemoryStorage
+	if remaining < 0 {
+		return scriptError(bucketName, remaining)
+	}
+
+	return nil
 }
 
 // returns a conditional amount of tokens representing all the tokens
-func (rs *RedisStorage) TakeAll(bucketName string) (int, error) {
-	raw, err := rs.Client.Eval(luaGetAllAndDecr, []string{bucketName}).Result()
+func (rs *RedisStorage) TakeAllContext(ctx context.Context, bucketName string) (int, error) {
+	count, err := rs.evalInt(ctx, luaGetAllAndDecr, []string{bucketName})
 
 	if err != nil {
 		return 0, err
 	}
 
-	// if the found value is a string which cannot be converted to an integer assume this key is protected and return an error
-	tokenValue, ok := raw.(int64)
+	if count < 0 {
+		return 0, scriptError(bucketName, count)
+	}
 
-	if !ok {
-		return 0, errors.New(fmt.Sprintf("Failed to convert %v to int", raw))
+	return int(count), nil
+}
+
+// Set and Put publish to the bucket's channel in the same transaction as the write, see notify.go
+func (rs *RedisStorage) SetContext(ctx context.Context, bucketName string, tokens int) error {
+	return rs.do(ctx, bucketName, func(client redis.UniversalClient) error {
+		return txPipelined(client, func(pipe *redis.Pipeline) error {
+			pipe.Set(bucketName, tokens, rs.Expiration)
+			publish(pipe, notifyChannel(bucketName), "set")
+			return nil
+		})
+	})
+}
+
+// Increment the token value by a given amount.
+func (rs *RedisStorage) PutContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := validAmount(tokens); err != nil {
+		return err
+	}
+
+	if rs.CoalesceWindow > 0 {
+		result, err := rs.coalescing().do(ctx, Op{Name: bucketName, Tokens: tokens, Put: true})
+		if err != nil {
+			return err
+		}
+
+		return result.Err
 	}
 
-	return int(tokenValue), nil
+	return rs.do(ctx, bucketName, func(client redis.UniversalClient) error {
+		return txPipelined(client, func(pipe *redis.Pipeline) error {
+			pipe.IncrBy(bucketName, int64(tokens))
+			publish(pipe, notifyChannel(bucketName), "put")
+			return nil
+		})
+	})
 }
 
+// Return the token value of a given bucket, read from ReadClient if there is one.
+func (rs *RedisStorage) CountContext(ctx context.Context, bucketName string) (int, error) {
+	reader := rs.Client
+	if rs.ReadClient != nil {
+		reader = rs.ReadClient
+	}
 
-func (rs *RedisStorage) Set(bucketName string, tokens int) error {
-	// 0 indicates no expiration
-	return rs.Client.Set(bucketName, tokens, 0).Err()
+	var count int64
+	err := rs.doWith(ctx, reader, bucketName, func(client redis.UniversalClient) (err error) {
+		count, err = client.Get(bucketName).Int64()
+		return err
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return int(count), nil
 }
 
-// Increment the token value by a given amount.
-func (rs *RedisStorage) Put(bucketName string, tokens int) error {
-	return rs.Client.IncrBy(bucketName, int64(tokens)).Err()
+// Run a command against a copy of the client which carries ctx. The redis client we depend on doesn't watch the
+// context itself so we stop waiting once ctx is done and return ctx.Err(). The command can't be called back once it's
+// sent so it may still have been applied, see ContextStorage. The errors from the client are mapped with redisError.
+//
+// Anything command writes to is only safe to read when do returns nil.
+func (rs *RedisStorage) do(ctx context.Context, name string, command func(client redis.UniversalClient) error) error {
+	return rs.doWith(ctx, rs.Client, name, command)
 }
 
-// Return the token value of a given bucket.
-func (rs *RedisStorage) Count(bucketName string) (int, error) {
-	count, err := rs.Client.Get(bucketName).Int64()
-	return int(count), err
+// Like do but with the given client rather then rs.Client.
+func (rs *RedisStorage) doWith(ctx context.Context, client redis.UniversalClient, name string, command func(client redis.UniversalClient) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	// only *redis.Client carries a context
+	if single, ok := client.(*redis.Client); ok {
+		client = single.WithContext(ctx)
+	}
+
+	if ctx.Done() == nil {
+		return redisError(name, command(client))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- command(client)
+	}()
+
+	select {
+	case err := <-done:
+		return redisError(name, err)
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run the commands queued by fn in a MULTI/EXEC transaction. A *redis.Ring can't run transactions so they are only
+// pipelined there, its commands for one bucket all go to the same shard anyway.
+func txPipelined(client redis.UniversalClient, fn func(pipe *redis.Pipeline) error) error {
+	var err error
+	if tx, ok := client.(interface{ TxPipelined(func(*redis.Pipeline) error) ([]redis.Cmder, error) }); ok {
+		_, err = tx.TxPipelined(fn)
+	} else {
+		_, err = client.Pipelined(fn)
+	}
+
+	return err
+}
+
+// Queue a PUBLISH. Ring and ClusterClient lower case the name of every command they route, in place with unsafe code
+// which garbles the name on recent Go releases, so the command is built with its name in lower case already.
+func publish(pipe *redis.Pipeline, channel string, message string) {
+	pipe.Process(redis.NewIntCmd("publish", channel, message))
+}
+
+// Our scripts return -1 when there are not enough tokens, -2 when the bucket does not exist and -3 when the key holds
+// something other then a number.
+func scriptError(bucketName string, code int64) error {
+	switch code {
+	case -1:
+		return ErrInsufficientTokens
+	case -2:
+		return &Error{Kind: ErrBucketNotFound, Name: bucketName}
+	default:
+		return &Error{Kind: ErrNameConflict, Name: bucketName}
+	}
+}
+
+// Run a lua script by SHA, the first key names the bucket in any error. See script.
+func (rs *RedisStorage) eval(ctx context.Context, body string, keys []string, args ...interface{}) (interface{}, error) {
+	var raw interface{}
+	err := rs.do(ctx, keys[0], func(client redis.UniversalClient) (err error) {
+		raw, err = script(body).Run(client, keys, args...).Result()
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return raw, nil
+}
+
+// Run a lua script which returns an integer.
+func (rs *RedisStorage) evalInt(ctx context.Context, script string, keys []string, args ...interface{}) (int64, error) {
+	raw, err := rs.eval(ctx, script, keys, args...)
+
+	if err != nil {
+		return 0, err
+	}
+
+	value, ok := raw.(int64)
+
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("Failed to convert %v to int", raw))
+	}
+
+	return value, nil
+}
+
+// Run a lua script which returns an array of integers.
+func (rs *RedisStorage) evalInts(ctx context.Context, script string, keys []string, args ...interface{}) ([]int64, error) {
+	return ints(rs.eval(ctx, script, keys, args...))
+}
+
+// Convert the reply of a lua script to an array of integers.
+func ints(raw interface{}, err error) ([]int64, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	values, ok := raw.([]interface{})
+
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("Failed to convert %v to []int", raw))
+	}
+
+	ints := make([]int64, len(values))
+	for i, value := range values {
+		if ints[i], ok = value.(int64); !ok {
+			return nil, errors.New(fmt.Sprintf("Failed to convert %v to int", value))
+		}
+	}
+
+	return ints, nil
 }
\ No newline at end of file
@@ -1,8 +1,11 @@
 package storage_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"testing"
+	"time"
 	"sync/atomic"
 	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/assert"
@@ -77,4 +80,89 @@ func TestRedisStorage_Ping(t *testing.T) {
 
 	err := testClient.FlushDb().Err()
 	asserts.Nil(err, "redist test db should flush")
-}
\ No newline at end of file
+}
+func TestRedisStorage_Clients(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+	ctx := context.Background()
+
+	t.Run("a *redis.Ring works like a *redis.Client", func(t *testing.T) {
+		ring := redis.NewRing(&redis.RingOptions{ Addrs: map[string]string{ "shard": redisOptions.Addr }, DB: redisOptions.DB })
+		store := &storage.RedisStorage{ Client: ring }
+		name := MockBucketName()
+
+		err := store.Create(name, 10)
+		asserts.Nil(err, "store.Create should not return an error")
+
+		notifications, stop, err := store.Subscribe(ctx, name)
+		asserts.Nil(err, "store.Subscribe should not return an error")
+		defer stop()
+
+		err = store.Take(name, 4)
+		asserts.Nil(err, "store.Take should not return an error")
+
+		err = store.Put(name, 1)
+		asserts.Nil(err, "store.Put should not return an error")
+
+		select {
+		case <-notifications:
+		case <-time.After(time.Second):
+			asserts.Fail("store.Put should notify subscribers")
+		}
+
+		count, err := store.Count(name)
+		asserts.Nil(err, "store.Count should not return an error")
+		asserts.Equal(7, count, "count should be what was left after the take and the put")
+	})
+
+	t.Run("state is kept under keys hash tagged with the bucket name", func(t *testing.T) {
+		store := &storage.RedisStorage{ Client: testClient }
+		refill := storage.Refill{ Capacity: 10, Rate: 1, Interval: time.Second }
+
+		for name, key := range map[string]string{
+			"hashed": "{hashed}:refilled",
+			"{tenant}:user": "{tenant}:user:refilled",
+		} {
+			_, err := store.TakeRefill(ctx, name, 1, refill)
+			asserts.Nil(err, "store.TakeRefill should not return an error")
+
+			exists, err := testClient.Exists(key).Result()
+			asserts.Nil(err, "client.Exists should not return an error")
+			asserts.Equal(int64(1), exists, "the state of %v should be kept under %v", name, key)
+		}
+	})
+
+	t.Run("store.Count reads from ReadClient", func(t *testing.T) {
+		replicaOptions := *redisOptions
+		replicaOptions.DB = redisOptions.DB + 1
+		replica := redis.NewClient(&replicaOptions)
+
+		store := &storage.RedisStorage{ Client: testClient, ReadClient: replica }
+		name := MockBucketName()
+
+		err := store.Create(name, 10)
+		asserts.Nil(err, "store.Create should not return an error")
+
+		err = replica.Set(name, 3, 0).Err()
+		asserts.Nil(err, "client.Set should not return an error")
+
+		count, err := store.Count(name)
+		asserts.Nil(err, "store.Count should not return an error")
+		asserts.Equal(3, count, "count should come from the read client")
+
+		err = replica.FlushDb().Err()
+		asserts.Nil(err, "redist test db should flush")
+	})
+
+	t.Run("a client which can't subscribe returns ErrNotSupported", func(t *testing.T) {
+		cluster := redis.NewClusterClient(&redis.ClusterOptions{ Addrs: []string{ redisOptions.Addr } })
+		defer cluster.Close()
+
+		store := &storage.RedisStorage{ Client: cluster }
+		_, _, err := store.Subscribe(ctx, MockBucketName())
+		asserts.True(errors.Is(err, storage.ErrNotSupported), "store.Subscribe should return ErrNotSupported")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,518 @@
+package storage
+
+import (
+	"context"
+	"math"
+	"strings"
+	"time"
+)
+
+// Refill describes a bucket which refills itself. Rather then running a ticker which writes to storage on every
+// interval (see bucket.Fill) the token value is worked out whenever the bucket is used, from the time which has
+// passed since it was last brought up to date. A bucket gains Rate tokens every Interval but never more then Capacity.
+//
+// A bucket which does not exist yet is treated as full, this way a provider is free to forget about idle buckets.
+// A Rate of 0 describes a bucket which does not refill at all, one which does not exist yet is empty.
+//
+// With a WarmUp period a bucket which has been sitting full starts out cold, much like Guava's SmoothWarmingUp. A
+// cold bucket refills at ColdRate and holds a share of Capacity in proportion, the rate and capacity then climb
+// steadily to Rate and Capacity over the WarmUp period for as long as the bucket is being used. A bucket which sits
+// full cools down again as quickly as it warmed up.
+type Refill struct {
+	Capacity int
+	Rate     int
+	Interval time.Duration
+
+	WarmUp   time.Duration
+	ColdRate int
+}
+
+// Storage providers which can refill buckets lazily. Each method brings the bucket up to date and acts on it in a
+// single atomic operation so that concurrent callers can never both spend the same refilled tokens. TakeRefill
+// describes the bucket as it was left in the same operation, so that the decision is consistent with the take.
+type RefillStorage interface {
+	TakeRefill(ctx context.Context, bucketName string, tokens int, refill Refill) (Decision, error)
+	TakeAllRefill(ctx context.Context, bucketName string, refill Refill) (int, error)
+	CountRefill(ctx context.Context, bucketName string, refill Refill) (int, error)
+}
+
+// the rate a cold bucket refills at, a third of the rate unless told otherwise
+func (refill Refill) cold() int {
+	switch {
+	case refill.ColdRate > refill.Rate:
+		return refill.Rate
+	case refill.ColdRate > 0:
+		return refill.ColdRate
+	case refill.Rate >= 3:
+		return refill.Rate / 3
+	default:
+		return 1
+	}
+}
+
+// the rate a bucket which has been warming up for warmth refills at
+func (refill Refill) rate(warmth time.Duration) float64 {
+	if refill.WarmUp <= 0 || warmth >= refill.WarmUp {
+		return float64(refill.Rate)
+	}
+
+	cold := float64(refill.cold())
+	return cold + (float64(refill.Rate)-cold)*float64(warmth)/float64(refill.WarmUp)
+}
+
+// the number of tokens a bucket which has been warming up for warmth may hold
+func (refill Refill) capacity(warmth time.Duration) int {
+	if refill.WarmUp <= 0 {
+		return refill.Capacity
+	}
+
+	capacity := int(float64(refill.Capacity) * refill.rate(warmth) / float64(refill.Rate))
+	if capacity < 1 {
+		return 1
+	}
+
+	return capacity
+}
+
+// Return the token value of a bucket holding count tokens, last brought up to date at last after warming up for
+// warmth, as of now along with when it was brought up to date and how warm it is. Only whole tokens are added, the
+// time owed for a partial token is carried over by moving last forward by exactly the time the added tokens took to
+// accrue.
+//
+// A bucket warms up for as long as it is refilling and cools down for as long as it sits full.
+func (refill Refill) apply(count int, last time.Time, warmth time.Duration, now time.Time) (int, time.Time, time.Duration) {
+	if refill.Rate <= 0 || refill.Interval <= 0 {
+		return count, now, warmth
+	}
+
+	elapsed := now.Sub(last)
+	if elapsed < 0 {
+		elapsed = 0
+	}
+
+	capacity := refill.capacity(warmth)
+	period := float64(refill.Interval) / refill.rate(warmth)
+	fill := time.Duration(float64(capacity-count) * period)
+
+	// already full, tokens put in above the capacity are left alone
+	if fill <= 0 {
+		warmth = refill.cool(warmth, elapsed)
+		if count <= refill.Capacity {
+			count = refill.capacity(warmth)
+		}
+
+		return count, now, warmth
+	}
+
+	if elapsed < fill {
+		gained := int(float64(elapsed) / period)
+		accrued := time.Duration(float64(gained) * period)
+		return count + gained, last.Add(accrued), refill.warm(warmth, accrued)
+	}
+
+	warmth = refill.cool(refill.warm(warmth, fill), elapsed-fill)
+	return refill.capacity(warmth), now, warmth
+}
+
+// Describe a bucket holding count tokens, brought up to date at last after warming up for warmth, once a take of
+// tokens was or was not allowed.
+func (refill Refill) decide(allowed bool, count, tokens int, last time.Time, warmth time.Duration, now time.Time) Decision {
+	decision := Decision{Allowed: allowed, Limit: refill.Capacity}
+
+	if count > 0 {
+		decision.Remaining = count
+	}
+
+	// a bucket which does not refill never will by itself
+	if refill.Rate <= 0 || refill.Interval <= 0 {
+		if !allowed {
+			decision.RetryAfter = -1
+		}
+
+		if count < refill.Capacity {
+			decision.ResetAfter = -1
+		}
+
+		return decision
+	}
+
+	// the time since last has already gone towards the next token
+	period := float64(refill.Interval) / refill.rate(warmth)
+	since := float64(now.Sub(last))
+
+	if !allowed {
+		decision.RetryAfter = time.Duration(math.Max(0, float64(tokens-count)*period-since))
+		if tokens > refill.Capacity {
+			decision.RetryAfter = -1
+		}
+	}
+
+	if capacity := refill.capacity(warmth); count < capacity {
+		decision.ResetAfter = time.Duration(math.Max(0, float64(capacity-count)*period-since))
+	}
+
+	return decision
+}
+
+func (refill Refill) warm(warmth, by time.Duration) time.Duration {
+	if warmth+by > refill.WarmUp {
+		return refill.WarmUp
+	}
+
+	return warmth + by
+}
+
+func (refill Refill) cool(warmth, by time.Duration) time.Duration {
+	if warmth < by {
+		return 0
+	}
+
+	return warmth - by
+}
+
+// the arguments the refill scripts expect for a refill, see luaBucket
+func (refill Refill) args() []interface{} {
+	return []interface{}{refill.Capacity, refill.Rate, micros(refill.Interval), refill.cold(), micros(refill.WarmUp)}
+}
+
+// the keys the refill scripts expect for a bucket, see luaBucket
+func refillKeys(bucketName string) []string {
+	return []string{bucketName, stateKey(bucketName, "refilled"), stateKey(bucketName, "warmth")}
+}
+
+const (
+	// The Lua counterpart of Refill.apply. Time is measured in microseconds from the redis server clock (see luaNow)
+	// so that the clocks of the nodes sharing a bucket never come into it.
+	luaRefill = `
+		local function warmrate(b, warmth)
+			if b.warmup <= 0 or warmth >= b.warmup then
+				return b.rate
+			end
+
+			return b.cold + (b.rate - b.cold) * warmth / b.warmup
+		end
+
+		local function warmcapacity(b, warmth)
+			if b.warmup <= 0 then
+				return b.capacity
+			end
+
+			return math.max(1, math.floor(b.capacity * warmrate(b, warmth) / b.rate))
+		end
+
+		local function refill(b, count, last, warmth)
+			if b.rate <= 0 or b.interval <= 0 then
+				return count, now, warmth
+			end
+
+			local elapsed = math.max(0, now - last)
+			local period = b.interval / warmrate(b, warmth)
+			local fill = (warmcapacity(b, warmth) - count) * period
+
+			if fill <= 0 then
+				warmth = math.max(0, warmth - elapsed)
+				if count <= b.capacity then
+					count = warmcapacity(b, warmth)
+				end
+
+				return count, now, warmth
+			end
+
+			if elapsed < fill then
+				local gained = math.floor(elapsed / period)
+				local accrued = math.floor(gained * period)
+				return count + gained, last + accrued, math.min(b.warmup, warmth + accrued)
+			end
+
+			warmth = math.max(0, math.min(b.warmup, warmth + fill) - (elapsed - fill))
+			return warmcapacity(b, warmth), now, warmth
+		end
+
+		-- The Lua counterpart of Refill.decide, returns {allowed, remaining, retry after, reset after}.
+		local function decide(b, allowed, amount)
+			local remaining = math.max(0, b.count)
+			local retry = 0
+			local reset = 0
+
+			if b.rate <= 0 or b.interval <= 0 then
+				if allowed == 0 then
+					retry = -1
+				end
+
+				if b.count < b.capacity then
+					reset = -1
+				end
+
+				return {allowed, remaining, retry, reset}
+			end
+
+			local period = b.interval / warmrate(b, b.warmth)
+			local since = now - b.last
+
+			if allowed == 0 then
+				retry = math.max(0, math.ceil((amount - b.count) * period - since))
+				if amount > b.capacity then
+					retry = -1
+				end
+			end
+
+			local capacity = warmcapacity(b, b.warmth)
+			if b.count < capacity then
+				reset = math.max(0, math.ceil((capacity - b.count) * period - since))
+			end
+
+			return {allowed, remaining, retry, reset}
+		end
+
+		-- A missing bucket is a full cold one, so once the bucket would be full and cold again its keys can expire
+		-- without anything being lost. Tokens put in above the capacity would be lost though, so those buckets are kept.
+		-- Buckets which do not refill keep whatever expiration they were created with.
+		local function expire(b)
+			if b.rate <= 0 then
+				return
+			end
+
+			if b.count > b.capacity then
+				redis.call("PERSIST", b.key)
+				redis.call("PERSIST", b.stamp)
+				return
+			end
+
+			local ttl = math.max(b.interval, b.last + (b.capacity - b.count) * b.interval / warmrate(b, b.warmth) - now) + b.warmup
+			redis.call("PEXPIRE", b.key, math.ceil(ttl / 1000))
+			redis.call("PEXPIRE", b.stamp, math.ceil(ttl / 1000))
+			if b.warmup > 0 then
+				redis.call("PEXPIRE", b.warm, math.ceil(ttl / 1000))
+			end
+		end
+	`
+
+	// Load the bucket whose keys start at KEYS[k] and whose refill starts at ARGV[a], see refillKeys and Refill.args,
+	// and bring it up to date. open does the same for a refill worked out in the script. save writes it back.
+	luaBucket = luaNow + luaRefill + `
+		local function open(k, b)
+			b.key, b.stamp, b.warm = KEYS[k], KEYS[k + 1], KEYS[k + 2]
+
+			b.stored = tonumber(redis.call("GET", b.key))
+			local count = b.stored or 0
+			if not b.stored and b.rate > 0 then
+				count = b.capacity
+			end
+
+			local last = tonumber(redis.call("GET", b.stamp)) or now
+			local warmth = tonumber(redis.call("GET", b.warm)) or 0
+			b.count, b.last, b.warmth = refill(b, count, last, warmth)
+
+			return b
+		end
+
+		local function load(k, a)
+			return open(k, {
+				capacity = tonumber(ARGV[a]), rate = tonumber(ARGV[a + 1]), interval = tonumber(ARGV[a + 2]),
+				cold = tonumber(ARGV[a + 3]), warmup = tonumber(ARGV[a + 4])
+			})
+		end
+
+		local function save(b)
+			redis.call("INCRBY", b.key, b.count - (b.stored or 0))
+			if b.rate <= 0 then
+				return
+			end
+
+			redis.call("SET", b.stamp, string.format("%.0f", b.last))
+			if b.warmup > 0 then
+				redis.call("SET", b.warm, string.format("%.0f", b.warmth))
+			end
+
+			expire(b)
+		end
+	`
+
+	// Scripts which call TIME before writing must replicate their effects rather then the script itself, otherwise a
+	// replica would run the script against its own clock.
+	luaNow = `
+		redis.replicate_commands()
+		local time = redis.call("TIME")
+		local now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+	`
+
+	// KEYS: see refillKeys
+	// ARGV: tokens followed by Refill.args
+	//
+	// Returns {allowed, remaining, retry after, reset after}, see decide.
+	luaTakeRefill = luaBucket + `
+		local amount = tonumber(ARGV[1])
+		local b = load(1, 2)
+
+		if b.count < amount then
+			return decide(b, 0, amount)
+		end
+
+		b.count = b.count - amount
+		save(b)
+		return decide(b, 1, amount)
+	`
+
+	// KEYS: see refillKeys
+	// ARGV: see Refill.args
+	luaTakeAllRefill = luaBucket + `
+		local b = load(1, 1)
+		local count = b.count
+
+		b.count = 0
+		save(b)
+		return count
+	`
+
+	// KEYS: see refillKeys
+	// ARGV: see Refill.args
+	luaCountRefill = luaBucket + `
+		return load(1, 1).count
+	`
+)
+
+// Name the key which holds a piece of state belonging to a bucket, such as the time it was last refilled. The bucket
+// name is used as a hash tag unless it has one already, so that Redis Cluster keeps the state on the same node as the
+// bucket: "{user:7}:refilled" hashes like "user:7" does.
+func stateKey(bucketName string, state string) string {
+	if hasHashTag(bucketName) {
+		return bucketName + ":" + state
+	}
+
+	return "{" + bucketName + "}:" + state
+}
+
+// Name a bucket which belongs to another, such as the ceiling of a bucket in a hierarchy, the way stateKey names the
+// bucket's own state so that Redis Cluster keeps both on the same node.
+func StateKey(bucketName string, state string) string {
+	return stateKey(bucketName, state)
+}
+
+// Whether Redis Cluster would hash the key by a tag, the part between the first { and the next } if there is anything
+// in between.
+func hasHashTag(key string) bool {
+	start := strings.IndexByte(key, '{')
+	return start > -1 && strings.IndexByte(key[start + 1:], '}') > 0
+}
+
+// Convert a duration to the whole microseconds that the Lua scripts work in.
+func micros(duration time.Duration) int64 {
+	return int64(duration / time.Microsecond)
+}
+
+func (ms *MemoryStorage) TakeRefill(ctx context.Context, bucketName string, tokens int, refill Refill) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	count := ms.refill(bucketName, refill, now)
+	allowed := count >= tokens
+
+	if allowed {
+		count -= tokens
+		ms.buckets[bucketName] = count
+	}
+
+	return refill.decide(allowed, count, tokens, ms.refilled[bucketName], ms.warmth[bucketName], now), nil
+}
+
+func (ms *MemoryStorage) TakeAllRefill(ctx context.Context, bucketName string, refill Refill) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	count := ms.refill(bucketName, refill, time.Now())
+	ms.buckets[bucketName] = 0
+	return count, nil
+}
+
+// Counting writes the refilled token value back so it needs the write lock like every other refill operation.
+func (ms *MemoryStorage) CountRefill(ctx context.Context, bucketName string, refill Refill) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	return ms.refill(bucketName, refill, time.Now()), nil
+}
+
+// Bring a bucket up to date and return its token value, the caller must hold the write lock.
+func (ms *MemoryStorage) refill(bucketName string, refill Refill, now time.Time) int {
+	if ms.buckets == nil {
+		ms.buckets = map[string]int{}
+	}
+
+	if ms.refilled == nil {
+		ms.refilled = map[string]time.Time{}
+		ms.warmth = map[string]time.Duration{}
+		ms.refills = map[string]Refill{}
+	}
+
+	count, exists := ms.buckets[bucketName]
+	if !exists && refill.Rate > 0 {
+		count = refill.Capacity
+	}
+
+	last, exists := ms.refilled[bucketName]
+	if !exists {
+		last = now
+	}
+
+	count, last, warmth := refill.apply(count, last, ms.warmth[bucketName], now)
+
+	// a bucket which doesn't refill and was never created stays that way until something is put in it
+	if _, exists := ms.buckets[bucketName]; exists || refill.Rate > 0 {
+		ms.buckets[bucketName] = count
+	}
+
+	if refill.Rate > 0 {
+		ms.refilled[bucketName] = last
+		ms.warmth[bucketName] = warmth
+		ms.refills[bucketName] = refill
+		ms.sweepInBackground()
+	}
+
+	return count
+}
+
+func (rs *RedisStorage) TakeRefill(ctx context.Context, bucketName string, tokens int, refill Refill) (Decision, error) {
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	// a batched take without a rate is a plain take, see Op
+	if rs.CoalesceWindow > 0 && refill.Rate > 0 {
+		result, err := rs.coalescing().do(ctx, Op{Name: bucketName, Tokens: tokens, Refill: refill})
+		if err != nil {
+			return Decision{}, err
+		}
+
+		return result.Decision, result.Err
+	}
+
+	args := append([]interface{}{tokens}, refill.args()...)
+	return rs.evalDecision(ctx, luaTakeRefill, refillKeys(bucketName), refill.Capacity, args...)
+}
+
+func (rs *RedisStorage) TakeAllRefill(ctx context.Context, bucketName string, refill Refill) (int, error) {
+	count, err := rs.evalInt(ctx, luaTakeAllRefill, refillKeys(bucketName), refill.args()...)
+	return int(count), err
+}
+
+func (rs *RedisStorage) CountRefill(ctx context.Context, bucketName string, refill Refill) (int, error) {
+	count, err := rs.evalInt(ctx, luaCountRefill, refillKeys(bucketName), refill.args()...)
+	return int(count), err
+}
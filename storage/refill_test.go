@@ -0,0 +1,111 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockRefillStorage() []storage.RefillStorage {
+	return []storage.RefillStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+func TestRefillStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+	refill := storage.Refill{ Capacity: 10, Rate: 10, Interval: time.Millisecond * 100 }
+
+	for _, store := range MockRefillStorage() {
+		t.Run("a bucket which does not exist is treated as full", func(t *testing.T) {
+			count, err := store.CountRefill(context.Background(), MockBucketName(), refill)
+			asserts.Nil(err, "store.CountRefill should not return an error")
+			asserts.Equal(refill.Capacity, count, "count should equal capacity")
+		})
+
+		t.Run("store.TakeRefill takes tokens and refuses to overdraw", func(t *testing.T) {
+			name := MockBucketName()
+
+			// a token every 6 seconds so that none refill while the test runs, however slowly it is scheduled
+			slow := storage.Refill{ Capacity: 10, Rate: 10, Interval: time.Minute }
+
+			decision, err := store.TakeRefill(context.Background(), name, 8, slow)
+			asserts.Nil(err, "store.TakeRefill should not return an error")
+			asserts.True(decision.Allowed, "take within the capacity should be allowed")
+			asserts.Equal(2, decision.Remaining, "remaining should be the tokens left")
+			asserts.Equal(slow.Capacity, decision.Limit, "limit should be the capacity")
+			asserts.True(decision.ResetAfter > time.Second * 47 && decision.ResetAfter <= time.Second * 48, "reset after should be the time to refill 8 tokens")
+
+			decision, err = store.TakeRefill(context.Background(), name, 3, slow)
+			asserts.Nil(err, "store.TakeRefill should not return an error for insufficient tokens")
+			asserts.False(decision.Allowed, "take past the token value should not be allowed")
+			asserts.True(decision.RetryAfter > time.Second * 5 && decision.RetryAfter <= time.Second * 6, "retry after should be the time to refill 1 token")
+
+			decision, err = store.TakeRefill(context.Background(), name, 11, slow)
+			asserts.Nil(err, "store.TakeRefill should not return an error for insufficient tokens")
+			asserts.Equal(time.Duration(-1), decision.RetryAfter, "take past the capacity should never be allowed")
+
+			count, err := store.CountRefill(context.Background(), name, slow)
+			asserts.Nil(err, "store.CountRefill should not return an error")
+			asserts.Equal(2, count, "count should not be changed by a failed take")
+		})
+
+		t.Run("store.TakeAllRefill empties the bucket which then refills over time", func(t *testing.T) {
+			name := MockBucketName()
+
+			count, err := store.TakeAllRefill(context.Background(), name, refill)
+			asserts.Nil(err, "store.TakeAllRefill should not return an error")
+			asserts.Equal(refill.Capacity, count, "count should equal capacity")
+
+			time.Sleep(time.Millisecond * 35)
+
+			count, err = store.CountRefill(context.Background(), name, refill)
+			asserts.Nil(err, "store.CountRefill should not return an error")
+			asserts.True(count >= 3 && count < refill.Capacity, "bucket should have partially refilled")
+		})
+	}
+
+	t.Run("memory buckets are swept once they would be full again", func(t *testing.T) {
+		store := &storage.MemoryStorage{ SweepInterval: time.Hour }
+		defer store.Close()
+
+		name := MockBucketName()
+		refill := storage.Refill{ Capacity: 5, Rate: 100, Interval: time.Second }
+
+		_, err := store.TakeRefill(context.Background(), name, 2, refill)
+		asserts.Nil(err, "store.TakeRefill should not return an error")
+
+		store.Sweep()
+		_, err = store.Count(name)
+		asserts.Nil(err, "a bucket which is still refilling should be kept")
+
+		time.Sleep(time.Millisecond * 50)
+		store.Sweep()
+
+		_, err = store.Count(name)
+		asserts.True(errors.Is(err, storage.ErrBucketNotFound), "a full bucket should be swept")
+
+		count, err := store.CountRefill(context.Background(), name, refill)
+		asserts.Nil(err, "store.CountRefill should not return an error")
+		asserts.Equal(5, count, "a swept bucket should be full")
+	})
+
+	t.Run("a bucket which does not refill reports that it never will", func(t *testing.T) {
+		for _, store := range MockRefillStorage() {
+			decision, err := store.TakeRefill(context.Background(), MockBucketName(), 1, storage.Refill{ Capacity: 10 })
+			asserts.Nil(err, "store.TakeRefill should not return an error")
+			asserts.False(decision.Allowed, "a bucket which does not exist is empty")
+			asserts.Equal(time.Duration(-1), decision.RetryAfter, "retry after should be -1")
+			asserts.Equal(time.Duration(-1), decision.ResetAfter, "reset after should be -1")
+		}
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,214 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// Storage providers which can keep a counting semaphore. Unlike tokens taken from a bucket the slots of a semaphore
+// are leased, a holder renews its lease while it works and a lease which runs out is reclaimed so that a holder which
+// crashed can't leak a slot for good.
+//
+// Every grant comes with a fencing token which is greater then every one granted before it by the same semaphore. A
+// holder passes it along with whatever it writes so that the writes of a holder whose lease ran out, say because it
+// was paused, can be told apart and refused.
+type SemaphoreStorage interface {
+	// Lease one of limit slots to id for ttl if one is free. The decision says how many slots are left and, if none
+	// were, how long until the first lease runs out.
+	Acquire(ctx context.Context, semaphoreName string, id string, limit int, ttl time.Duration) (fence int64, decision Decision, err error)
+
+	// Extend the lease held by id to ttl from now, ErrLeaseExpired if it has been released or ran out.
+	Renew(ctx context.Context, semaphoreName string, id string, ttl time.Duration) error
+
+	// Give up the lease held by id, releasing a lease which has already gone does nothing.
+	Release(ctx context.Context, semaphoreName string, id string) error
+}
+
+// A semaphore in MemoryStorage, the fence is kept for as long as the storage is so it never goes backwards.
+type semaphore struct {
+	leases map[string]time.Time
+	fence int64
+}
+
+// Forget leases which ran out by now.
+func (sem *semaphore) reclaim(now time.Time) {
+	for id, expires := range sem.leases {
+		if !expires.After(now) {
+			delete(sem.leases, id)
+		}
+	}
+}
+
+// the keys the semaphore scripts expect, the fence never expires so it never goes backwards
+func semaphoreKeys(semaphoreName string) []string {
+	return []string{stateKey(semaphoreName, "leases"), stateKey(semaphoreName, "fence")}
+}
+
+const (
+	// The leases are a sorted set of holders scored by when their lease runs out.
+	luaSemaphore = luaNow + `
+		local leases, fence = KEYS[1], KEYS[2]
+		redis.call("ZREMRANGEBYSCORE", leases, "-inf", string.format("%.0f", now))
+
+		-- keep the leases around for as long as the longest of them
+		local function keep(ttl)
+			if redis.call("PTTL", leases) < math.ceil(ttl / 1000) then
+				redis.call("PEXPIRE", leases, math.ceil(ttl / 1000))
+			end
+		end
+	`
+
+	// KEYS: see semaphoreKeys
+	// ARGV: id, limit, ttl
+	//
+	// Returns {fence, allowed, remaining, retry after}.
+	luaAcquire = luaSemaphore + `
+		local id, limit, ttl = ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3])
+		local held = redis.call("ZCARD", leases)
+
+		if held >= limit then
+			local first = redis.call("ZRANGE", leases, 0, 0, "WITHSCORES")
+			local retry = -1
+			if first[2] then
+				retry = tonumber(first[2]) - now
+			end
+
+			return {0, 0, 0, retry}
+		end
+
+		local token = redis.call("INCR", fence)
+		redis.call("ZADD", leases, string.format("%.0f", now + ttl), id)
+		keep(ttl)
+
+		return {token, 1, limit - held - 1, 0}
+	`
+
+	// KEYS: see semaphoreKeys
+	// ARGV: id, ttl
+	//
+	// Returns 1 if the lease was renewed and 0 if it had gone.
+	luaRenew = luaSemaphore + `
+		local id, ttl = ARGV[1], tonumber(ARGV[2])
+
+		if not redis.call("ZSCORE", leases, id) then
+			return 0
+		end
+
+		redis.call("ZADD", leases, string.format("%.0f", now + ttl), id)
+		keep(ttl)
+
+		return 1
+	`
+)
+
+// the semaphore with the given name with the leases which ran out reclaimed, the caller must hold the write lock
+func (ms *MemoryStorage) semaphore(semaphoreName string, now time.Time) *semaphore {
+	if ms.semaphores == nil {
+		ms.semaphores = map[string]*semaphore{}
+	}
+
+	sem, exists := ms.semaphores[semaphoreName]
+	if !exists {
+		sem = &semaphore{leases: map[string]time.Time{}}
+		ms.semaphores[semaphoreName] = sem
+	}
+
+	sem.reclaim(now)
+	return sem
+}
+
+func (ms *MemoryStorage) Acquire(ctx context.Context, semaphoreName string, id string, limit int, ttl time.Duration) (int64, Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+	sem := ms.semaphore(semaphoreName, now)
+	decision := Decision{Limit: limit}
+
+	if len(sem.leases) >= limit {
+		decision.RetryAfter = -1
+		for _, expires := range sem.leases {
+			if decision.RetryAfter < 0 || expires.Sub(now) < decision.RetryAfter {
+				decision.RetryAfter = expires.Sub(now)
+			}
+		}
+
+		return 0, decision, nil
+	}
+
+	sem.fence++
+	sem.leases[id] = now.Add(ttl)
+
+	decision.Allowed, decision.Remaining = true, limit - len(sem.leases)
+	return sem.fence, decision, nil
+}
+
+func (ms *MemoryStorage) Renew(ctx context.Context, semaphoreName string, id string, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	sem := ms.semaphore(semaphoreName, time.Now())
+	if _, held := sem.leases[id]; !held {
+		return &Error{Kind: ErrLeaseExpired, Name: semaphoreName}
+	}
+
+	sem.leases[id] = time.Now().Add(ttl)
+	return nil
+}
+
+func (ms *MemoryStorage) Release(ctx context.Context, semaphoreName string, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	delete(ms.semaphore(semaphoreName, time.Now()).leases, id)
+	return nil
+}
+
+func (rs *RedisStorage) Acquire(ctx context.Context, semaphoreName string, id string, limit int, ttl time.Duration) (int64, Decision, error) {
+	reply, err := rs.evalInts(ctx, luaAcquire, semaphoreKeys(semaphoreName), id, limit, micros(ttl))
+	if err != nil {
+		return 0, Decision{}, err
+	}
+
+	if len(reply) != 4 {
+		return 0, Decision{}, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	decision := Decision{Allowed: reply[1] == 1, Limit: limit, Remaining: int(reply[2]), RetryAfter: time.Duration(reply[3]) * time.Microsecond}
+	if reply[3] < 0 {
+		decision.RetryAfter = -1
+	}
+
+	return reply[0], decision, nil
+}
+
+func (rs *RedisStorage) Renew(ctx context.Context, semaphoreName string, id string, ttl time.Duration) error {
+	renewed, err := rs.evalInt(ctx, luaRenew, semaphoreKeys(semaphoreName), id, micros(ttl))
+	if err == nil && renewed == 0 {
+		return &Error{Kind: ErrLeaseExpired, Name: semaphoreName}
+	}
+
+	return err
+}
+
+func (rs *RedisStorage) Release(ctx context.Context, semaphoreName string, id string) error {
+	return rs.do(ctx, semaphoreName, func(client redis.UniversalClient) error {
+		return client.ZRem(stateKey(semaphoreName, "leases"), id).Err()
+	})
+}
@@ -0,0 +1,72 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func MockSemaphoreStorage() []storage.SemaphoreStorage {
+	return []storage.SemaphoreStorage{
+		&storage.MemoryStorage{},
+		&storage.RedisStorage{ Client: redis.NewClient(redisOptions) },
+	}
+}
+
+func TestSemaphoreStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+
+	for _, store := range MockSemaphoreStorage() {
+		t.Run("store.Acquire grants up to the limit and says when the first lease runs out", func(t *testing.T) {
+			name := MockBucketName()
+
+			fence, decision, err := store.Acquire(context.Background(), name, "a", 2, time.Millisecond * 100)
+			asserts.Nil(err, "store.Acquire should not return an error")
+			asserts.True(decision.Allowed, "a free slot should be granted")
+			asserts.Equal(1, decision.Remaining, "one slot should be left")
+			asserts.Equal(int64(1), fence, "the first fence should be 1")
+
+			fence, decision, err = store.Acquire(context.Background(), name, "b", 2, time.Second)
+			asserts.Nil(err, "store.Acquire should not return an error")
+			asserts.Equal(int64(2), fence, "the fence should go up with every grant")
+
+			_, decision, err = store.Acquire(context.Background(), name, "c", 2, time.Second)
+			asserts.Nil(err, "store.Acquire should not return an error when every slot is held")
+			asserts.False(decision.Allowed, "no slot should be granted")
+			asserts.True(decision.RetryAfter > time.Millisecond * 50 && decision.RetryAfter <= time.Millisecond * 100, "retry after should be when the first lease runs out")
+		})
+
+		t.Run("store.Renew keeps a lease from running out", func(t *testing.T) {
+			name := MockBucketName()
+
+			_, _, err := store.Acquire(context.Background(), name, "a", 1, time.Millisecond * 50)
+			asserts.Nil(err, "store.Acquire should not return an error")
+
+			time.Sleep(time.Millisecond * 30)
+			err = store.Renew(context.Background(), name, "a", time.Millisecond * 50)
+			asserts.Nil(err, "store.Renew should not return an error")
+
+			time.Sleep(time.Millisecond * 30)
+			_, decision, err := store.Acquire(context.Background(), name, "b", 1, time.Second)
+			asserts.Nil(err, "store.Acquire should not return an error")
+			asserts.False(decision.Allowed, "the renewed lease should still hold the slot")
+
+			time.Sleep(time.Millisecond * 40)
+			err = store.Renew(context.Background(), name, "a", time.Millisecond * 50)
+			asserts.True(errors.Is(err, storage.ErrLeaseExpired), "store.Renew should return ErrLeaseExpired once the lease ran out")
+
+			fence, decision, err := store.Acquire(context.Background(), name, "b", 1, time.Second)
+			asserts.Nil(err, "store.Acquire should not return an error")
+			asserts.True(decision.Allowed, "the slot should have been reclaimed")
+			asserts.Equal(int64(2), fence, "the fence should keep going up after a lease is reclaimed")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
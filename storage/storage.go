@@ -1,5 +1,10 @@
 package storage
 
+import (
+	"context"
+	"time"
+)
+
 // Interface for storage providers. I know the 'I' prefix isn't Golang convention but I prefer it.
 type Storage interface {
 	Ping() error
@@ -9,4 +14,113 @@ type Storage interface {
 	Set(bucketName string, tokens int) error
 	Put(bucketName string, tokens int) error
 	Count(bucketName string) (int, error)
-}
\ No newline at end of file
+}
+
+// Storage providers which accept a context for every operation. A provider should give up and return ctx.Err() once
+// the context is done rather then block past a deadline. Both of the providers in this package implement it, the
+// methods of Storage simply call these with context.Background().
+//
+// An error from ctx.Err() doesn't mean nothing happened. A call which had already reached the storage when the context
+// was done may still have been applied, RedisStorage for one stops waiting on a command which was sent but can't call
+// it back. Callers which must know, like a take which should not be lost, can Count the bucket afterwards.
+type ContextStorage interface {
+	Storage
+	PingContext(ctx context.Context) error
+	CreateContext(ctx context.Context, name string, tokens int) error
+	TakeContext(ctx context.Context, bucketName string, tokens int) error
+	TakeAllContext(ctx context.Context, bucketName string) (int, error)
+	SetContext(ctx context.Context, bucketName string, tokens int) error
+	PutContext(ctx context.Context, bucketName string, tokens int) error
+	CountContext(ctx context.Context, bucketName string) (int, error)
+}
+
+// Return store as a ContextStorage. A provider which does not implement it is wrapped so that a context which is
+// already done is respected, a call which has started can't be interrupted though.
+func WithContext(store Storage) ContextStorage {
+	if contextStore, ok := store.(ContextStorage); ok {
+		return contextStore
+	}
+
+	return contextless{store}
+}
+
+type contextless struct {
+	Storage
+}
+
+func (cl contextless) PingContext(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return cl.Ping()
+}
+
+func (cl contextless) CreateContext(ctx context.Context, name string, tokens int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return cl.Create(name, tokens)
+}
+
+func (cl contextless) TakeContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return cl.Take(bucketName, tokens)
+}
+
+func (cl contextless) TakeAllContext(ctx context.Context, bucketName string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cl.TakeAll(bucketName)
+}
+
+func (cl contextless) SetContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return cl.Set(bucketName, tokens)
+}
+
+func (cl contextless) PutContext(ctx context.Context, bucketName string, tokens int) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return cl.Put(bucketName, tokens)
+}
+
+func (cl contextless) CountContext(ctx context.Context, bucketName string) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cl.Count(bucketName)
+}
+
+// The outcome of asking a rate limiter for tokens. It carries the same information as the reply to redis-cell's
+// CL.THROTTLE so that it may be used to fill in rate-limit headers.
+type Decision struct {
+	Allowed bool
+
+	// the maximum number of tokens which may be taken at once
+	Limit int
+
+	// the number of tokens which could still be taken right now
+	Remaining int
+
+	// how long until the request could be allowed, 0 if it was allowed and -1 if it never will be
+	RetryAfter time.Duration
+
+	// how long until the limiter is back to its full limit, -1 if it never will be by itself
+	ResetAfter time.Duration
+
+	// how long an allowed request should wait before going ahead, only limiters which queue requests set this
+	Delay time.Duration
+}
@@ -1,6 +1,7 @@
 package storage_test
 
 import (
+	"errors"
 	"testing"
 	"github.com/go-redis/redis"
 	"github.com/stretchr/testify/assert"
@@ -65,11 +66,15 @@ func TestTokenBucket(t *testing.T) {
 
 		t.Run("store.Take shound not return an error", func(t *testing.T){
 			options.Capacity = 1
+			options.Name = MockBucketName()
 			bucket, err := tb.New(options)
 			asserts.Nil(err, "Should be able to create a bucket for store.Take test")
 
 			err = options.Storage.Take(bucket.Name, 1)
 			asserts.Nil(err, "store.Take should not return an error")
+
+			err = options.Storage.Take(bucket.Name, 1)
+			asserts.True(errors.Is(err, storage.ErrInsufficientTokens), "store.Take should report insufficient tokens the same way for every provider")
 		})
 
 		t.Run("store.Count shound not return an error", func(t *testing.T){
@@ -0,0 +1,123 @@
+package storage
+
+import "time"
+
+// Delete limiter state which has expired. This is done in the background on MemoryStorage.SweepInterval so there is
+// normally no need to call it, the limiters never read expired state as anything other then missing.
+func (ms *MemoryStorage) Sweep() {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	now := time.Now()
+
+	// a missing bucket is a full cold one, so a bucket which would be just that by now is the same as a missing one
+	for name, refill := range ms.refills {
+		count, _, warmth := refill.apply(ms.buckets[name], ms.refilled[name], ms.warmth[name], now)
+		missing, _, cold := refill.apply(refill.Capacity, now, 0, now)
+
+		if count == missing && warmth == cold {
+			delete(ms.buckets, name)
+			delete(ms.refilled, name)
+			delete(ms.warmth, name)
+			delete(ms.refills, name)
+		}
+	}
+
+	for name, state := range ms.rates {
+		changed := state.increased
+		if state.decreased.After(changed) {
+			changed = state.decreased
+		}
+
+		if _, refilling := ms.refills[name]; !refilling && !changed.Add(state.cooldown).After(now) {
+			delete(ms.rates, name)
+		}
+	}
+
+	for key, tat := range ms.tats {
+		if !tat.After(now) {
+			delete(ms.tats, key)
+		}
+	}
+
+	for key, log := range ms.logs {
+		if !log.expires.After(now) {
+			delete(ms.logs, key)
+		}
+	}
+
+	for key, sw := range ms.windows {
+		if !sw.expires.After(now) {
+			delete(ms.windows, key)
+		}
+	}
+
+	for key, fw := range ms.fixed {
+		if !fw.end.After(now) {
+			delete(ms.fixed, key)
+		}
+	}
+
+	for key, queue := range ms.queues {
+		if !queue.expires.After(now) {
+			delete(ms.queues, key)
+		}
+	}
+
+	for key, pool := range ms.pools {
+		// a missing tenant bucket is full, see Refill
+		for name, full := range pool.full {
+			if !full.After(now) {
+				delete(ms.buckets, name)
+				delete(ms.refilled, name)
+				delete(ms.warmth, name)
+				delete(pool.full, name)
+			}
+		}
+
+		if !pool.expires.After(now) && len(pool.full) == 0 {
+			delete(ms.pools, key)
+		}
+	}
+}
+
+// Stop sweeping expired state in the background. The storage may still be used afterwards.
+func (ms *MemoryStorage) Close() error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.stop != nil {
+		close(ms.stop)
+		ms.stop = nil
+	}
+
+	// make sure a sweeper is never started after closing
+	ms.sweeper.Do(func() {})
+	return nil
+}
+
+// Start the background sweeper unless it has already been started, the caller must hold the write lock.
+func (ms *MemoryStorage) sweepInBackground() {
+	ms.sweeper.Do(func() {
+		interval := ms.SweepInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+
+		ms.stop = make(chan struct{})
+
+		go func(stop chan struct{}) {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+
+			for {
+				select {
+				case <-ticker.C:
+					ms.Sweep()
+				case <-stop:
+					return
+				}
+			}
+		}(ms.stop)
+	})
+}
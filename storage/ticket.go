@@ -0,0 +1,271 @@
+package storage
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A waiter's place in a queue kept in storage, see QueueStorage. The ID should be unique across every process sharing
+// the queue, NewTicketID makes one.
+type Ticket struct {
+	ID string
+	Tokens int
+
+	// tickets with a lower priority value are granted first, tickets of the same priority in the order they joined
+	Priority int
+
+	// how long the ticket stays in the queue without being renewed, once a lease runs out the ticket is reclaimed so
+	// that a crashed waiter can't hold up the queue
+	Lease time.Duration
+}
+
+// How a ticket stands after QueueStorage.Queue.
+type TicketStatus struct {
+	Granted bool
+
+	// the number of tickets ahead of this one, 0 at the head of the queue and -1 once granted
+	Position int
+
+	// the number of tickets still in the queue
+	Depth int
+
+	// the bucket as it stands for the tokens the ticket wants, RetryAfter is only meaningful at the head of the queue
+	Decision Decision
+}
+
+// Storage providers which keep a queue of waiters for a bucket that every process sharing the bucket waits in. Tokens
+// are granted to the tickets at the head of the queue in order, whoever happens to serve the queue, so waiters on
+// different nodes get their turn fairly. The waiter holding a ticket is told through the channel from SubscribeTicket
+// when it is granted or reaches the head of the queue, only the head needs to hear about tokens being put in.
+type QueueStorage interface {
+	// Join the queue unless the ticket is already in it, renew its lease and grant tokens to as many tickets at the
+	// head of the queue as the bucket allows. A ticket whose lease ran out joins again at the back.
+	Queue(ctx context.Context, bucketName string, ticket Ticket, refill Refill) (TicketStatus, error)
+
+	// Leave the queue. Tokens which were granted to the ticket but never collected with Queue are put back.
+	Dequeue(ctx context.Context, bucketName string, ticket Ticket, refill Refill) error
+
+	// A channel which receives when the ticket may have been granted or reached the head of the queue. Subscribe
+	// before joining the queue so nothing is missed and call stop once done.
+	SubscribeTicket(ctx context.Context, bucketName string, id string) (notifications <-chan struct{}, stop func(), err error)
+}
+
+// Make a random ticket ID.
+func NewTicketID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// the keys the queue scripts expect after refillKeys
+func queueKeys(bucketName string) []string {
+	return append(refillKeys(bucketName),
+		stateKey(bucketName, "queue"),
+		stateKey(bucketName, "tickets"),
+		stateKey(bucketName, "leases"),
+		stateKey(bucketName, "granted"),
+		stateKey(bucketName, "seq"),
+	)
+}
+
+// the channel a ticket's waiter listens on, a channel is not a key so it's fine to build its name in the scripts
+func ticketChannel(bucketName string, id string) string {
+	return ticketChannelPrefix(bucketName) + id
+}
+
+func ticketChannelPrefix(bucketName string) string {
+	return stateKey(bucketName, "ticket:")
+}
+
+const (
+	// The queue is a sorted set of ticket IDs scored by priority and then by the order they joined, the tokens each
+	// ticket wants are in a hash and their leases in another sorted set scored by when they run out. Tickets which
+	// were granted to a waiter other then the one running the script are kept in a sorted set, with their tokens
+	// still in the hash, until they are collected or their lease runs out and the tokens are put back.
+	luaQueueing = luaBucket + `
+		local queue, tickets, leases, granted, seq = KEYS[4], KEYS[5], KEYS[6], KEYS[7], KEYS[8]
+
+		local function head()
+			return redis.call("ZRANGE", queue, 0, 0)[1]
+		end
+
+		local function remove(ticket)
+			redis.call("ZREM", queue, ticket)
+			redis.call("HDEL", tickets, ticket)
+			redis.call("ZREM", leases, ticket)
+		end
+
+		-- forget tickets whose waiters stopped renewing their leases, other then the one running the script, and put
+		-- back the tokens of granted tickets nobody came for. The bucket's refill starts at ARGV[a].
+		local function reclaim(id, a)
+			local stamp = string.format("%.0f", now)
+
+			for _, ticket in ipairs(redis.call("ZRANGEBYSCORE", leases, "-inf", stamp)) do
+				if ticket ~= id then
+					remove(ticket)
+				end
+			end
+
+			local b
+			for _, ticket in ipairs(redis.call("ZRANGEBYSCORE", granted, "-inf", stamp)) do
+				if ticket ~= id then
+					b = b or load(1, a)
+					b.count = b.count + (tonumber(redis.call("HGET", tickets, ticket)) or 0)
+					redis.call("HDEL", tickets, ticket)
+					redis.call("ZREM", granted, ticket)
+				end
+			end
+
+			if b then
+				save(b)
+			end
+		end
+
+		-- tell whoever is now at the head of the queue that it's their turn
+		local function announce(before, id, prefix)
+			local after = head()
+
+			if after and after ~= before and after ~= id then
+				redis.call("PUBLISH", prefix .. after, "head")
+			end
+
+			if redis.call("ZCARD", queue) == 0 then
+				redis.call("DEL", seq)
+			end
+		end
+	`
+
+	// KEYS: see queueKeys
+	// ARGV: ticket ID, tokens, priority, lease, channel prefix followed by Refill.args
+	//
+	// Returns {granted, position, depth, allowed, remaining, retry after, reset after}, see decide.
+	luaQueue = luaQueueing + `
+		local id, amount, priority, lease, prefix = ARGV[1], tonumber(ARGV[2]), tonumber(ARGV[3]), tonumber(ARGV[4]), ARGV[5]
+		local deadline = string.format("%.0f", now + lease)
+		local before = head()
+
+		reclaim(id, 6)
+
+		-- granted by somebody else since we last looked
+		if redis.call("ZSCORE", granted, id) then
+			redis.call("ZREM", granted, id)
+			redis.call("HDEL", tickets, id)
+
+			local decision = decide(load(1, 6), 1, amount)
+			return {1, -1, redis.call("ZCARD", queue), decision[1], decision[2], decision[3], decision[4]}
+		end
+
+		if not redis.call("ZSCORE", queue, id) then
+			local order = redis.call("INCR", seq)
+			redis.call("ZADD", queue, string.format("%.0f", priority * 1000000000000 + order), id)
+			redis.call("HSET", tickets, id, amount)
+		end
+
+		redis.call("ZADD", leases, deadline, id)
+
+		local b = load(1, 6)
+		local served, mine = false, false
+
+		while true do
+			local first = head()
+			if not first then
+				break
+			end
+
+			local need = tonumber(redis.call("HGET", tickets, first))
+			if b.count < need then
+				break
+			end
+
+			b.count = b.count - need
+			served = true
+
+			-- the waiter has until its own lease runs out to collect the tokens
+			local expires = redis.call("ZSCORE", leases, first) or deadline
+			remove(first)
+
+			if first == id then
+				mine = true
+			else
+				-- keep the tokens until they are collected in case they have to be put back
+				redis.call("HSET", tickets, first, need)
+				redis.call("ZADD", granted, expires, first)
+				redis.call("PUBLISH", prefix .. first, "granted")
+			end
+		end
+
+		if served then
+			save(b)
+		end
+
+		announce(before, id, prefix)
+
+		local depth = redis.call("ZCARD", queue)
+		if mine then
+			local decision = decide(b, 1, amount)
+			return {1, -1, depth, decision[1], decision[2], decision[3], decision[4]}
+		end
+
+		local decision = decide(b, 0, amount)
+		return {0, redis.call("ZRANK", queue, id), depth, decision[1], decision[2], decision[3], decision[4]}
+	`
+
+	// KEYS: see queueKeys
+	// ARGV: ticket ID, tokens, channel prefix followed by Refill.args
+	luaDequeue = luaQueueing + `
+		local id, amount, prefix = ARGV[1], tonumber(ARGV[2]), ARGV[3]
+		local before = head()
+
+		remove(id)
+
+		-- tokens were taken out for the ticket but it never came for them
+		if redis.call("ZREM", granted, id) == 1 then
+			redis.call("HDEL", tickets, id)
+			local b = load(1, 4)
+			b.count = b.count + amount
+			save(b)
+		end
+
+		announce(before, id, prefix)
+		return 0
+	`
+)
+
+func (rs *RedisStorage) Queue(ctx context.Context, bucketName string, ticket Ticket, refill Refill) (TicketStatus, error) {
+	if err := validAmount(ticket.Tokens); err != nil {
+		return TicketStatus{}, err
+	}
+
+	args := append([]interface{}{ticket.ID, ticket.Tokens, ticket.Priority, micros(ticket.Lease), ticketChannelPrefix(bucketName)}, refill.args()...)
+	reply, err := rs.evalInts(ctx, luaQueue, queueKeys(bucketName), args...)
+
+	if err != nil {
+		return TicketStatus{}, err
+	}
+
+	if len(reply) != 7 {
+		return TicketStatus{}, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	decision, err := decisionFromReply(reply[3:], refill.Capacity)
+	status := TicketStatus{Granted: reply[0] == 1, Position: int(reply[1]), Depth: int(reply[2]), Decision: decision}
+	return status, err
+}
+
+func (rs *RedisStorage) Dequeue(ctx context.Context, bucketName string, ticket Ticket, refill Refill) error {
+	args := append([]interface{}{ticket.ID, ticket.Tokens, ticketChannelPrefix(bucketName)}, refill.args()...)
+	_, err := rs.evalInt(ctx, luaDequeue, queueKeys(bucketName), args...)
+	return err
+}
+
+// Subscribe to the ticket's channel, the subscription is confirmed before returning. See RedisStorage.Subscribe.
+func (rs *RedisStorage) SubscribeTicket(ctx context.Context, bucketName string, id string) (<-chan struct{}, func(), error) {
+	return rs.subscribe(ctx, bucketName, ticketChannel(bucketName, id))
+}
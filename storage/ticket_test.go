@@ -0,0 +1,153 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+	"time"
+	"github.com/go-redis/redis"
+	"github.com/stretchr/testify/assert"
+	"github.com/b3ntly/bucket/storage"
+)
+
+func TestQueueStorage(t *testing.T) {
+	asserts := assert.New(t)
+	testClient := redis.NewClient(redisOptions)
+
+	// two processes sharing the queue
+	first := &storage.RedisStorage{ Client: redis.NewClient(redisOptions) }
+	second := &storage.RedisStorage{ Client: redis.NewClient(redisOptions) }
+
+	t.Run("tickets from different clients are granted in the order they joined", func(t *testing.T) {
+		name := MockBucketName()
+		refill := storage.Refill{ Capacity: 3, Rate: 20, Interval: time.Second }
+
+		_, err := first.TakeAllRefill(context.Background(), name, refill)
+		asserts.Nil(err, "store.TakeAllRefill should not return an error")
+
+		a := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 2, Lease: time.Second * 10 }
+		b := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 1, Lease: time.Second * 10 }
+
+		granted, stop, err := first.SubscribeTicket(context.Background(), name, a.ID)
+		asserts.Nil(err, "store.SubscribeTicket should not return an error")
+		defer stop()
+
+		status, err := first.Queue(context.Background(), name, a, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.False(status.Granted, "an empty bucket should not grant the ticket")
+		asserts.Equal(0, status.Position, "the first ticket should be at the head of the queue")
+
+		status, err = second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.Equal(1, status.Position, "the second ticket should be behind the first")
+		asserts.Equal(2, status.Depth, "both tickets should be queued")
+
+		// enough for the head but not for both
+		time.Sleep(time.Millisecond * 125)
+
+		status, err = second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.False(status.Granted, "the second ticket should not jump the queue")
+		asserts.Equal(0, status.Position, "the second ticket should now be at the head")
+
+		select {
+		case <-granted:
+		case <-time.After(time.Second):
+			asserts.Fail("the first ticket should be told it was granted")
+		}
+
+		status, err = first.Queue(context.Background(), name, a, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.True(status.Granted, "the first ticket should have been granted by the second client")
+		asserts.True(status.Decision.Allowed, "a granted ticket should be allowed")
+	})
+
+	t.Run("a ticket whose lease runs out is reclaimed", func(t *testing.T) {
+		name := MockBucketName()
+		refill := storage.Refill{ Capacity: 5 }
+
+		_, err := first.TakeAllRefill(context.Background(), name, refill)
+		asserts.Nil(err, "store.TakeAllRefill should not return an error")
+
+		a := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 1, Lease: time.Millisecond * 50 }
+		b := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 1, Lease: time.Second * 10 }
+
+		_, err = first.Queue(context.Background(), name, a, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+
+		status, err := second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.Equal(1, status.Position, "the second ticket should be behind the first")
+
+		time.Sleep(time.Millisecond * 100)
+
+		status, err = second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.Equal(0, status.Position, "the expired ticket should no longer hold up the queue")
+		asserts.Equal(1, status.Depth, "only the live ticket should be queued")
+	})
+
+	t.Run("tokens granted to a ticket whose lease runs out are put back", func(t *testing.T) {
+		name := MockBucketName()
+		refill := storage.Refill{ Capacity: 5 }
+
+		_, err := first.TakeAllRefill(context.Background(), name, refill)
+		asserts.Nil(err, "store.TakeAllRefill should not return an error")
+
+		a := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 1, Lease: time.Millisecond * 50 }
+		b := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 1, Lease: time.Second * 10 }
+
+		_, err = first.Queue(context.Background(), name, a, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+
+		asserts.Nil(first.Put(name, 1), "store.Put should not return an error")
+
+		status, err := second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.False(status.Granted, "the token should go to the first ticket")
+
+		// the first waiter never comes back for its token
+		time.Sleep(time.Millisecond * 100)
+
+		status, err = second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.True(status.Granted, "the uncollected token should be put back and go to the next ticket")
+
+		count, err := first.CountRefill(context.Background(), name, refill)
+		asserts.Nil(err, "store.CountRefill should not return an error")
+		asserts.Equal(0, count, "the token should only be handed out once")
+	})
+
+	t.Run("store.Dequeue puts back tokens which were granted but never collected", func(t *testing.T) {
+		name := MockBucketName()
+		refill := storage.Refill{ Capacity: 2, Rate: 10, Interval: time.Second }
+
+		_, err := first.TakeAllRefill(context.Background(), name, refill)
+		asserts.Nil(err, "store.TakeAllRefill should not return an error")
+
+		a := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 1, Lease: time.Second * 10 }
+		b := storage.Ticket{ ID: storage.NewTicketID(), Tokens: 1, Lease: time.Second * 10 }
+
+		_, err = first.Queue(context.Background(), name, a, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+
+		time.Sleep(time.Millisecond * 120)
+
+		status, err := second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.False(status.Granted, "only one token should have refilled")
+
+		err = first.Dequeue(context.Background(), name, a, refill)
+		asserts.Nil(err, "store.Dequeue should not return an error")
+
+		count, err := first.CountRefill(context.Background(), name, refill)
+		asserts.Nil(err, "store.CountRefill should not return an error")
+		asserts.Equal(1, count, "the uncollected token should be back in the bucket")
+
+		status, err = second.Queue(context.Background(), name, b, refill)
+		asserts.Nil(err, "store.Queue should not return an error")
+		asserts.True(status.Granted, "the token should go to the next ticket")
+	})
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
@@ -0,0 +1,120 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// A Transport carries the state of a CRDTStorage replica to a peer and brings back the peer's state. The peer merges
+// the state it is sent, so a single exchange syncs both replicas. Peers are named however the transport likes.
+type Transport interface {
+	Exchange(ctx context.Context, peer string, state CRDTState) (CRDTState, error)
+}
+
+// Sync replicas over HTTP, every peer is the URL a CRDTStorage is served on (CRDTStorage implements http.Handler).
+type HTTPTransport struct {
+	// Optional, defaults to http.DefaultClient. It has no timeout of its own, exchanges made in the background give up
+	// once the SyncInterval is over.
+	Client *http.Client
+}
+
+func (ht *HTTPTransport) Exchange(ctx context.Context, peer string, state CRDTState) (CRDTState, error) {
+	body, err := json.Marshal(state)
+	if err != nil {
+		return CRDTState{}, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, peer, bytes.NewReader(body))
+	if err != nil {
+		return CRDTState{}, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	client := ht.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	response, err := client.Do(request)
+	if err != nil {
+		return CRDTState{}, &Error{Kind: ErrStorageUnavailable, Name: peer, Err: err}
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return CRDTState{}, &Error{Kind: ErrStorageUnavailable, Name: peer, Err: fmt.Errorf("Peer answered %v.", response.Status)}
+	}
+
+	var remote CRDTState
+	if err := json.NewDecoder(response.Body).Decode(&remote); err != nil {
+		return CRDTState{}, err
+	}
+
+	return remote, nil
+}
+
+// Sync replicas in the same process, peers are named by the Replica of each CRDTStorage added. Links between
+// replicas can be cut to simulate a partition, for testing.
+type MemoryTransport struct {
+	mutex sync.RWMutex
+	replicas map[string]*CRDTStorage
+	cut map[[2]string]bool
+}
+
+// Make the replica reachable as a peer.
+func (mt *MemoryTransport) Add(replica *CRDTStorage) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	if mt.replicas == nil {
+		mt.replicas = map[string]*CRDTStorage{}
+	}
+
+	mt.replicas[replica.Replica] = replica
+}
+
+// Cut every link between the replicas of one side and the replicas of the other, in both directions.
+func (mt *MemoryTransport) Partition(side []string, other []string) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	if mt.cut == nil {
+		mt.cut = map[[2]string]bool{}
+	}
+
+	for _, a := range side {
+		for _, b := range other {
+			mt.cut[[2]string{a, b}], mt.cut[[2]string{b, a}] = true, true
+		}
+	}
+}
+
+// Restore every link which was cut.
+func (mt *MemoryTransport) Heal() {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	mt.cut = nil
+}
+
+func (mt *MemoryTransport) Exchange(ctx context.Context, peer string, state CRDTState) (CRDTState, error) {
+	if err := ctx.Err(); err != nil {
+		return CRDTState{}, err
+	}
+
+	mt.mutex.RLock()
+	replica, ok := mt.replicas[peer]
+	cut := mt.cut[[2]string{state.Replica, peer}]
+	mt.mutex.RUnlock()
+
+	if !ok || cut {
+		return CRDTState{}, &Error{Kind: ErrStorageUnavailable, Name: peer, Err: fmt.Errorf("%v can't reach %v.", state.Replica, peer)}
+	}
+
+	replica.Merge(state)
+	return replica.State(), nil
+}
@@ -0,0 +1,363 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Window describes a limiter which allows Limit tokens in any rolling Length of time, for example 100 requests in any
+// 60 seconds. Unlike a bucket refilled on a ticker it does not let through twice the limit around a refill.
+type Window struct {
+	Limit  int
+	Length time.Duration
+}
+
+// Storage providers which keep an exact log of when tokens were taken. Memory costs one timestamp per token.
+type SlidingLogStorage interface {
+	TakeLog(ctx context.Context, key string, tokens int, window Window) (Decision, error)
+}
+
+// Storage providers which approximate a sliding window from the counts of the current and previous fixed windows,
+// weighting the previous count by how much of it still overlaps the sliding window. Memory costs two counts per key.
+type SlidingWindowStorage interface {
+	TakeWindow(ctx context.Context, key string, tokens int, window Window) (Decision, error)
+}
+
+// A ring buffer holding the time each token in a sliding log was taken, oldest first.
+type slidingLog struct {
+	times []time.Time
+	head int
+	size int
+
+	// once every entry has slid out of the window the log may be swept away, see sweep.go
+	expires time.Time
+}
+
+// the time of the i'th oldest entry
+func (log *slidingLog) at(i int) time.Time {
+	return log.times[(log.head+i)%len(log.times)]
+}
+
+func (log *slidingLog) take(tokens int, window Window, now time.Time) Decision {
+	// the limit changed, start over with a buffer of the right size
+	if len(log.times) != window.Limit {
+		*log = slidingLog{times: make([]time.Time, window.Limit)}
+	}
+
+	// evict everything which has slid out of the window
+	for log.size > 0 && !log.at(0).After(now.Add(-window.Length)) {
+		log.head = (log.head + 1) % len(log.times)
+		log.size--
+	}
+
+	decision := Decision{Limit: window.Limit}
+
+	switch {
+	case tokens > window.Limit:
+		decision.RetryAfter = -1
+	case log.size+tokens > window.Limit:
+		// wait for enough of the oldest entries to slide out of the window
+		decision.RetryAfter = log.at(log.size + tokens - window.Limit - 1).Add(window.Length).Sub(now)
+	default:
+		decision.Allowed = true
+		for i := 0; i < tokens; i++ {
+			log.times[(log.head+log.size)%len(log.times)] = now
+			log.size++
+		}
+	}
+
+	decision.Remaining = window.Limit - log.size
+	if log.size > 0 {
+		log.expires = log.at(log.size - 1).Add(window.Length)
+		decision.ResetAfter = log.expires.Sub(now)
+	}
+
+	return decision
+}
+
+// The counts of the fixed window starting at start and of the one before it.
+type slidingWindow struct {
+	start int64
+	previous int
+	current int
+
+	// once neither count overlaps the sliding window it may be swept away, see sweep.go
+	expires time.Time
+}
+
+// Move the window forward to the one containing now, the count of the window before it carries over as the previous
+// count only if the two are adjacent.
+func (sw *slidingWindow) roll(start int64, length int64) {
+	switch start - sw.start {
+	case 0:
+	case length:
+		sw.previous, sw.current = sw.current, 0
+	default:
+		sw.previous, sw.current = 0, 0
+	}
+
+	sw.start = start
+}
+
+func (sw *slidingWindow) take(tokens int, window Window, now time.Time) Decision {
+	length := int64(window.Length)
+	sw.roll(now.UnixNano()-now.UnixNano()%length, length)
+
+	elapsed := float64(now.UnixNano() - sw.start)
+	estimate := float64(sw.previous)*(1-elapsed/float64(length)) + float64(sw.current)
+	decision := Decision{Limit: window.Limit}
+
+	if estimate+float64(tokens) <= float64(window.Limit) {
+		decision.Allowed = true
+		sw.current += tokens
+		estimate += float64(tokens)
+	} else {
+		decision.RetryAfter = time.Duration(windowRetry(float64(sw.previous), float64(sw.current), float64(tokens), float64(window.Limit), elapsed, float64(length)))
+	}
+
+	decision.Remaining = int(math.Max(0, math.Floor(float64(window.Limit)-estimate)))
+	decision.ResetAfter = time.Duration(windowReset(float64(sw.previous), float64(sw.current), elapsed, float64(length)))
+	sw.expires = now.Add(decision.ResetAfter)
+
+	return decision
+}
+
+// How long until tokens fit under the limit, in the same unit as elapsed and length. If the current count alone
+// leaves no room we have to wait for the next window, where the current count becomes the previous one.
+func windowRetry(previous, current, tokens, limit, elapsed, length float64) float64 {
+	if tokens > limit {
+		return -1
+	}
+
+	if current+tokens <= limit {
+		return math.Ceil(length*(1-(limit-current-tokens)/previous) - elapsed)
+	}
+
+	wait := length - elapsed
+	if current > 0 {
+		wait += math.Max(0, math.Ceil(length*(1-(limit-tokens)/current)))
+	}
+
+	return wait
+}
+
+// How long until neither window counts against the limit any more.
+func windowReset(previous, current, elapsed, length float64) float64 {
+	switch {
+	case current > 0:
+		return 2*length - elapsed
+	case previous > 0:
+		return length - elapsed
+	default:
+		return 0
+	}
+}
+
+const (
+	// KEYS: the sorted set holding the log and the key which hands out unique members for it
+	// ARGV: limit, length, tokens
+	//
+	// Entries are scored by the time they were taken in microseconds. Returns {allowed, remaining, retry after,
+	// reset after}.
+	luaTakeLog = luaNow + `
+		local key = KEYS[1]
+		local seq = KEYS[2]
+		local limit = tonumber(ARGV[1])
+		local length = tonumber(ARGV[2])
+		local amount = tonumber(ARGV[3])
+
+		redis.call("ZREMRANGEBYSCORE", key, "-inf", string.format("%.0f", now - length))
+		local count = redis.call("ZCARD", key)
+
+		local allowed = 0
+		local retry = 0
+
+		if amount > limit then
+			retry = -1
+		elseif count + amount > limit then
+			local oldest = redis.call("ZRANGE", key, count + amount - limit - 1, count + amount - limit - 1, "WITHSCORES")
+			retry = tonumber(oldest[2]) + length - now
+		else
+			allowed = 1
+			for i = 1, amount do
+				redis.call("ZADD", key, string.format("%.0f", now), redis.call("INCR", seq))
+			end
+
+			count = count + amount
+			redis.call("PEXPIRE", key, math.ceil(length / 1000))
+			redis.call("PEXPIRE", seq, math.ceil(length / 1000))
+		end
+
+		local reset = 0
+		if count > 0 then
+			local newest = redis.call("ZRANGE", key, -1, -1, "WITHSCORES")
+			reset = tonumber(newest[2]) + length - now
+		end
+
+		return {allowed, limit - count, retry, reset}
+	`
+
+	// KEYS: the hash holding the start of the current window and the counts of the current and previous windows
+	// ARGV: limit, length, tokens
+	//
+	// Returns {allowed, remaining, retry after, reset after}.
+	luaTakeWindow = luaNow + `
+		local key = KEYS[1]
+		local limit = tonumber(ARGV[1])
+		local length = tonumber(ARGV[2])
+		local amount = tonumber(ARGV[3])
+
+		local state = redis.call("HMGET", key, "start", "previous", "current")
+		local start = now - (now % length)
+		local previous = tonumber(state[2]) or 0
+		local current = tonumber(state[3]) or 0
+
+		local last = tonumber(state[1]) or start
+		if start - last == length then
+			previous, current = current, 0
+		elseif start ~= last then
+			previous, current = 0, 0
+		end
+
+		local elapsed = now - start
+		local estimate = previous * (1 - elapsed / length) + current
+		local allowed = 0
+		local retry = 0
+
+		if estimate + amount <= limit then
+			allowed = 1
+			current = current + amount
+			estimate = estimate + amount
+		elseif amount > limit then
+			retry = -1
+		elseif current + amount <= limit then
+			retry = math.ceil(length * (1 - (limit - current - amount) / previous) - elapsed)
+		else
+			retry = length - elapsed
+			if current > 0 then
+				retry = retry + math.max(0, math.ceil(length * (1 - (limit - amount) / current)))
+			end
+		end
+
+		redis.call("HMSET", key, "start", string.format("%.0f", start), "previous", previous, "current", current)
+		redis.call("PEXPIRE", key, math.ceil(2 * length / 1000))
+
+		local reset = 0
+		if current > 0 then
+			reset = 2 * length - elapsed
+		elseif previous > 0 then
+			reset = length - elapsed
+		end
+
+		return {allowed, math.max(0, math.floor(limit - estimate)), retry, reset}
+	`
+)
+
+func (ms *MemoryStorage) TakeLog(ctx context.Context, key string, tokens int, window Window) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.logs == nil {
+		ms.logs = map[string]*slidingLog{}
+	}
+
+	log, exists := ms.logs[key]
+	if !exists {
+		log = &slidingLog{}
+		ms.logs[key] = log
+	}
+
+	ms.sweepInBackground()
+	return log.take(tokens, window, time.Now()), nil
+}
+
+func (ms *MemoryStorage) TakeWindow(ctx context.Context, key string, tokens int, window Window) (Decision, error) {
+	if err := ctx.Err(); err != nil {
+		return Decision{}, err
+	}
+
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+
+	if ms.windows == nil {
+		ms.windows = map[string]*slidingWindow{}
+	}
+
+	sw, exists := ms.windows[key]
+	if !exists {
+		sw = &slidingWindow{}
+		ms.windows[key] = sw
+	}
+
+	ms.sweepInBackground()
+	return sw.take(tokens, window, time.Now()), nil
+}
+
+func (rs *RedisStorage) TakeLog(ctx context.Context, key string, tokens int, window Window) (Decision, error) {
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	keys := []string{key, stateKey(key, "seq")}
+	return rs.evalDecision(ctx, luaTakeLog, keys, window.Limit, window.Limit, micros(window.Length), tokens)
+}
+
+func (rs *RedisStorage) TakeWindow(ctx context.Context, key string, tokens int, window Window) (Decision, error) {
+	if err := validAmount(tokens); err != nil {
+		return Decision{}, err
+	}
+
+	return rs.evalDecision(ctx, luaTakeWindow, []string{key}, window.Limit, window.Limit, micros(window.Length), tokens)
+}
+
+// Run a lua script which returns {allowed, remaining, retry after, reset after} with times in microseconds and a
+// retry after of -1 meaning never.
+func (rs *RedisStorage) evalDecision(ctx context.Context, script string, keys []string, limit int, args ...interface{}) (Decision, error) {
+	reply, err := rs.evalInts(ctx, script, keys, args...)
+
+	if err != nil {
+		return Decision{}, err
+	}
+
+	return decisionFromReply(reply, limit)
+}
+
+func decisionFromReply(reply []int64, limit int) (Decision, error) {
+	if len(reply) != 4 {
+		return Decision{}, errors.New(fmt.Sprintf("Unexpected reply %v from script", reply))
+	}
+
+	decision := Decision{
+		Allowed: reply[0] == 1,
+		Limit: limit,
+		Remaining: int(reply[1]),
+		RetryAfter: time.Duration(reply[2]) * time.Microsecond,
+		ResetAfter: time.Duration(reply[3]) * time.Microsecond,
+	}
+
+	// -1 means never, don't turn it into -1µs
+	if reply[2] < 0 {
+		decision.RetryAfter = -1
+	}
+
+	if reply[3] < 0 {
+		decision.ResetAfter = -1
+	}
+
+	return decision, nil
+}
@@ -0,0 +1,159 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// The state of a Task.
+type Status int
+
+const (
+	Running Status = iota
+	Succeeded
+	Failed
+	Cancelled
+)
+
+func (status Status) String() string {
+	switch status {
+	case Running:
+		return "running"
+	case Succeeded:
+		return "succeeded"
+	case Failed:
+		return "failed"
+	case Cancelled:
+		return "cancelled"
+	default:
+		return "unknown"
+	}
+}
+
+// A handle on something a bucket does in the background, returned by bucket.Watch, bucket.Fill, bucket.CoordinatedFill
+// and bucket.DynamicFill. Every method is safe to call from any number of goroutines at any time, including after the
+// task has finished. Done and Err work like they do on a context.Context.
+type Task struct {
+	ctx context.Context
+	cancel context.CancelFunc
+	done chan struct{}
+
+	mutex sync.Mutex
+	status Status
+	err error
+
+	// see Task.Leadership, only tasks which run an election have one
+	leader bool
+	leadership chan bool
+}
+
+// Run work in the background as a task, work should return once ctx is done.
+func start(work func(ctx context.Context) error) *Task {
+	task := newTask()
+	task.run(work)
+	return task
+}
+
+// A task which has not started yet, so that work can refer to it.
+func newTask() *Task {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Task{ctx: ctx, cancel: cancel, done: make(chan struct{})}
+}
+
+func (task *Task) run(work func(ctx context.Context) error) {
+	go func() {
+		task.finish(work(task.ctx))
+	}()
+}
+
+func (task *Task) finish(err error) {
+	task.mutex.Lock()
+
+	switch {
+	case err == nil:
+		task.status = Succeeded
+	case errors.Is(err, context.Canceled):
+		task.status, task.err = Cancelled, err
+	default:
+		task.status, task.err = Failed, err
+	}
+
+	task.mutex.Unlock()
+
+	task.lead(false)
+	if task.leadership != nil {
+		close(task.leadership)
+	}
+
+	task.cancel()
+	close(task.done)
+}
+
+// Record whether the task leads its election, the leadership channel only ever holds the latest change.
+func (task *Task) lead(leader bool) {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	if task.leadership == nil || task.leader == leader {
+		return
+	}
+
+	task.leader = leader
+
+	select {
+	case <-task.leadership:
+	default:
+	}
+
+	task.leadership <- leader
+}
+
+// For tasks which run an election, such as bucket.CoordinatedFill, a channel which receives true when this node
+// becomes the leader and false when it stops being the leader. Only the latest change is kept for a slow reader. The
+// channel is closed once the task has finished, nil for tasks which don't run an election.
+func (task *Task) Leadership() <-chan bool {
+	return task.leadership
+}
+
+// Whether the task leads its election right now, see Task.Leadership.
+func (task *Task) Leader() bool {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	return task.leader
+}
+
+// Stop the task and wait for it to finish. Stopping a task which has already finished does nothing. A task which was
+// stopped before it could succeed or fail ends up Cancelled with an Err of context.Canceled.
+func (task *Task) Stop() {
+	task.cancel()
+	<-task.done
+}
+
+// A channel which is closed once the task has finished, however it finished.
+func (task *Task) Done() <-chan struct{} {
+	return task.done
+}
+
+// nil while the task is running or if it succeeded, otherwise the reason it failed or context.Canceled if it was
+// stopped.
+func (task *Task) Err() error {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	return task.err
+}
+
+func (task *Task) Status() Status {
+	task.mutex.Lock()
+	defer task.mutex.Unlock()
+
+	return task.status
+}
+
+// Block until the task has finished and return Err.
+func (task *Task) Wait() error {
+	<-task.done
+	return task.Err()
+}
@@ -0,0 +1,63 @@
+package bucket_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+	tb "github.com/b3ntly/bucket"
+	"github.com/b3ntly/bucket/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+// a storage provider whose Set always fails
+type failingStorage struct {
+	storage.Storage
+}
+
+func (fs failingStorage) Set(bucketName string, tokens int) error {
+	return storage.ErrStorageUnavailable
+}
+
+func TestTask(t *testing.T) {
+	asserts := assert.New(t)
+
+	t.Run("any number of goroutines can observe and stop a task", func(t *testing.T) {
+		bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: &storage.MemoryStorage{} })
+		asserts.Nil(err, "Failed to create a bucket for the task test")
+
+		task := bucket.Fill(10, time.Millisecond)
+
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(2)
+
+			go func() {
+				defer wg.Done()
+				<-task.Done()
+				asserts.Equal(tb.Cancelled, task.Status(), "every observer should see the task cancelled")
+			}()
+
+			go func() {
+				defer wg.Done()
+				task.Stop()
+			}()
+		}
+
+		wg.Wait()
+		asserts.Equal("cancelled", task.Status().String(), "status should print as cancelled")
+	})
+
+	t.Run("a task fails on an error from the storage provider", func(t *testing.T) {
+		bucket, err := tb.New(&tb.Options{ Name: MockBucketName(), Capacity: 10, Storage: failingStorage{ &storage.MemoryStorage{} } })
+		asserts.Nil(err, "Failed to create a bucket for the task test")
+
+		task := bucket.Fill(10, time.Millisecond)
+		err = task.Wait()
+		asserts.True(errors.Is(err, storage.ErrStorageUnavailable), "task.Wait should return the error from the provider")
+		asserts.Equal(tb.Failed, task.Status(), "the task should have failed")
+
+		task.Stop()
+		asserts.Equal(tb.Failed, task.Status(), "stopping a finished task does nothing")
+	})
+}
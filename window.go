@@ -0,0 +1,134 @@
+package bucket
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"github.com/b3ntly/bucket/storage"
+)
+
+/**
+ * window.go provides limiters which allow a number of tokens in any rolling window of time, for example 100 requests
+ * in any 60 seconds.
+ *
+ * SlidingLog keeps the exact time every token was taken so it is exact but costs memory per token. SlidingWindow
+ * keeps a count for the current and previous fixed windows and weights the previous count by how much of it the
+ * rolling window still overlaps, it is approximate but costs two integers per key.
+ *
+ * Unlike a bucket refilled by bucket.Fill neither lets through twice the limit around the edge of a window.
+ */
+
+type (
+	SlidingLog struct {
+		storage storage.SlidingLogStorage
+
+		// the name of the limiter, it prefixes every key so that limiters may share storage
+		Name string
+
+		window storage.Window
+	}
+
+	SlidingWindow struct {
+		storage storage.SlidingWindowStorage
+
+		// the name of the limiter, it prefixes every key so that limiters may share storage
+		Name string
+
+		window storage.Window
+	}
+
+	WindowOptions struct {
+		Storage storage.Storage
+		Name string
+
+		// Limit tokens are allowed in any rolling Window, Window defaults to one minute
+		Limit int
+		Window time.Duration
+	}
+)
+
+// initialize options with defaults
+func (opts *WindowOptions) init() (*WindowOptions, error) {
+	if opts.Storage == nil {
+		opts.Storage = DefaultMemoryStore
+	}
+
+	if opts.Window <= 0 {
+		opts.Window = time.Minute
+	}
+
+	if opts.Limit <= 0 {
+		return nil, errors.New("Window limiters require a positive limit.")
+	}
+
+	return opts, opts.Storage.Ping()
+}
+
+// Create a sliding log limiter, it uses in-memory storage unless told otherwise. The storage provider must implement
+// storage.SlidingLogStorage.
+func NewSlidingLog(options *WindowOptions) (*SlidingLog, error) {
+	options, err := options.init()
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := options.Storage.(storage.SlidingLogStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Sliding logs need a storage.SlidingLogStorage.", storage.ErrNotSupported)
+	}
+
+	return &SlidingLog{storage: store, Name: options.Name, window: storage.Window{Limit: options.Limit, Length: options.Window}}, nil
+}
+
+// Create a sliding window limiter, it uses in-memory storage unless told otherwise. The storage provider must
+// implement storage.SlidingWindowStorage.
+func NewSlidingWindow(options *WindowOptions) (*SlidingWindow, error) {
+	options, err := options.init()
+	if err != nil {
+		return nil, err
+	}
+
+	store, ok := options.Storage.(storage.SlidingWindowStorage)
+	if !ok {
+		return nil, fmt.Errorf("%w Sliding windows need a storage.SlidingWindowStorage.", storage.ErrNotSupported)
+	}
+
+	return &SlidingWindow{storage: store, Name: options.Name, window: storage.Window{Limit: options.Limit, Length: options.Window}}, nil
+}
+
+// Take tokens from the given key if doing so keeps the key within its limit for the rolling window.
+func (limiter *SlidingLog) Take(key string, tokens int) (storage.Decision, error) {
+	return limiter.TakeContext(context.Background(), key, tokens)
+}
+
+func (limiter *SlidingLog) TakeContext(ctx context.Context, key string, tokens int) (storage.Decision, error) {
+	return limiter.storage.TakeLog(ctx, limiter.Name + ":" + key, tokens, limiter.window)
+}
+
+// Take a single token from the given key.
+func (limiter *SlidingLog) Allow(key string) (storage.Decision, error) {
+	return limiter.AllowContext(context.Background(), key)
+}
+
+func (limiter *SlidingLog) AllowContext(ctx context.Context, key string) (storage.Decision, error) {
+	return limiter.TakeContext(ctx, key, 1)
+}
+
+// Take tokens from the given key if the estimate for the rolling window stays within the limit.
+func (limiter *SlidingWindow) Take(key string, tokens int) (storage.Decision, error) {
+	return limiter.TakeContext(context.Background(), key, tokens)
+}
+
+func (limiter *SlidingWindow) TakeContext(ctx context.Context, key string, tokens int) (storage.Decision, error) {
+	return limiter.storage.TakeWindow(ctx, limiter.Name + ":" + key, tokens, limiter.window)
+}
+
+// Take a single token from the given key.
+func (limiter *SlidingWindow) Allow(key string) (storage.Decision, error) {
+	return limiter.AllowContext(context.Background(), key)
+}
+
+func (limiter *SlidingWindow) AllowContext(ctx context.Context, key string) (storage.Decision, error) {
+	return limiter.TakeContext(ctx, key, 1)
+}
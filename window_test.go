@@ -0,0 +1,83 @@
+package bucket_test
+
+import (
+	tb "github.com/b3ntly/bucket"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestSlidingLog(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("sliding log allows the limit in any rolling window", func(t *testing.T) {
+			limiter, err := tb.NewSlidingLog(&tb.WindowOptions{
+				Name: MockBucketName(),
+				Limit: 3,
+				Window: time.Millisecond * 100,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a sliding log")
+
+			decision, err := limiter.Take("key", 2)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.True(decision.Allowed, "first take should be allowed")
+
+			time.Sleep(time.Millisecond * 50)
+
+			decision, err = limiter.Allow("key")
+			asserts.Nil(err, "limiter.Allow should not return an error")
+			asserts.True(decision.Allowed, "take within the limit should be allowed")
+			asserts.Equal(0, decision.Remaining, "no tokens should remain")
+
+			decision, err = limiter.Allow("key")
+			asserts.Nil(err, "limiter.Allow should not return an error")
+			asserts.False(decision.Allowed, "take past the limit should not be allowed")
+			asserts.True(decision.RetryAfter > 0 && decision.RetryAfter <= time.Millisecond * 50, "retry after should wait for the oldest entries")
+
+			time.Sleep(decision.RetryAfter + time.Millisecond * 5)
+
+			decision, err = limiter.Take("key", 2)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.True(decision.Allowed, "entries should have slid out of the window")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}
+
+func TestSlidingWindow(t *testing.T) {
+	asserts := assert.New(t)
+
+	for _, store := range MockStorage() {
+		t.Run("sliding window stops at the limit and reports when to retry", func(t *testing.T) {
+			limiter, err := tb.NewSlidingWindow(&tb.WindowOptions{
+				Name: MockBucketName(),
+				Limit: 5,
+				Window: time.Millisecond * 100,
+				Storage: store,
+			})
+			asserts.Nil(err, "Failed to create a sliding window")
+
+			decision, err := limiter.Take("key", 5)
+			asserts.Nil(err, "limiter.Take should not return an error")
+			asserts.True(decision.Allowed, "take within the limit should be allowed")
+
+			decision, err = limiter.Allow("key")
+			asserts.Nil(err, "limiter.Allow should not return an error")
+			asserts.False(decision.Allowed, "take past the limit should not be allowed")
+			asserts.True(decision.RetryAfter > 0, "retry after should be positive")
+
+			time.Sleep(decision.RetryAfter + time.Millisecond * 5)
+
+			decision, err = limiter.Allow("key")
+			asserts.Nil(err, "limiter.Allow should not return an error")
+			asserts.True(decision.Allowed, "take should be allowed after retry after")
+		})
+	}
+
+	err := testClient.FlushDb().Err()
+	asserts.Nil(err, "redist test db should flush")
+}